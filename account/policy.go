@@ -0,0 +1,67 @@
+package account
+
+import (
+	"errors"
+	"time"
+)
+
+// why a user is refused
+var (
+	ErrNoSuchUser         = errors.New("no such user")
+	ErrUserDisabled       = errors.New("user is disabled")
+	ErrUserExpired        = errors.New("user has expired")
+	ErrQuotaExceeded      = errors.New("monthly quota is used up")
+	ErrTooManyConnections = errors.New("too many connections")
+	ErrCipherNotAllowed   = errors.New("cipher not allowed")
+)
+
+/**
+ * Policy limits what a user can do, the zero value allows everything
+ * MonthlyQuota counts bytes of both directions in a calendar month of UTC
+ *
+ */
+type Policy struct {
+	Enabled        *bool      `json:"enabled,omitempty"`         // nil: enabled
+	ExpireAt       *time.Time `json:"expire_at,omitempty"`       // nil: never expires
+	MonthlyQuota   uint64     `json:"monthly_quota,omitempty"`   // 0: unlimited
+	MaxConnections int        `json:"max_connections,omitempty"` // concurrent connections of an inbound, 0: unlimited
+	Cipher         string     `json:"cipher,omitempty"`          // cipher of data stream, "": any the inbound allows
+}
+
+func (policy Policy) IsEnabled() bool {
+	return policy.Enabled == nil || *policy.Enabled
+}
+
+// check what does not depend on usage
+func (policy Policy) CheckAccess(now time.Time) error {
+	if !policy.IsEnabled() {
+		return ErrUserDisabled
+	}
+	if policy.ExpireAt != nil && !now.Before(*policy.ExpireAt) {
+		return ErrUserExpired
+	}
+	return nil
+}
+
+// monthlyUsage: bytes used this month
+func (policy Policy) CheckQuota(monthlyUsage uint64) error {
+	if policy.MonthlyQuota > 0 && monthlyUsage >= policy.MonthlyQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// connections: active connections besides the new one
+func (policy Policy) CheckConnections(connections int) error {
+	if policy.MaxConnections > 0 && connections >= policy.MaxConnections {
+		return ErrTooManyConnections
+	}
+	return nil
+}
+
+func (policy Policy) CheckCipher(cipherName string) error {
+	if policy.Cipher != "" && cipherName != policy.Cipher {
+		return ErrCipherNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package account
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	now := time.Now()
+	disabled, past, future := false, now.Add(-time.Hour), now.Add(time.Hour)
+
+	for _, test := range []struct {
+		policy Policy
+		want   error
+	}{
+		{Policy{}, nil},
+		{Policy{Enabled: &disabled}, ErrUserDisabled},
+		{Policy{ExpireAt: &past}, ErrUserExpired},
+		{Policy{ExpireAt: &future}, nil},
+	} {
+		if err := test.policy.CheckAccess(now); err != test.want {
+			t.Errorf("Access of %+v get %v, want %v", test.policy, err, test.want)
+		}
+	}
+
+	policy := Policy{MonthlyQuota: 100, MaxConnections: 2}
+	if err := policy.CheckQuota(99); err != nil {
+		t.Errorf("Quota should not be used up by 99 bytes: %v", err)
+	}
+	if err := policy.CheckQuota(100); err != ErrQuotaExceeded {
+		t.Errorf("Quota of 100 bytes used up get %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := policy.CheckConnections(1); err != nil {
+		t.Errorf("A second connection should be allowed: %v", err)
+	}
+	if err := policy.CheckConnections(2); err != ErrTooManyConnections {
+		t.Errorf("A third connection get %v, want %v", err, ErrTooManyConnections)
+	}
+	if err := (Policy{}).CheckQuota(1 << 40); err != nil {
+		t.Errorf("Zero quota should be unlimited: %v", err)
+	}
+	if err := (Policy{Cipher: "aes-128-gcm"}).CheckCipher("aes-128-cfb"); err != ErrCipherNotAllowed {
+		t.Errorf("Another cipher get %v, want %v", err, ErrCipherNotAllowed)
+	}
+}
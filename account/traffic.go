@@ -0,0 +1,339 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"masker/log"
+	"masker/metrics"
+)
+
+// Traffic of a user in bytes, uplink is from client to destination
+type Traffic struct {
+	Uplink   uint64 `json:"uplink"`
+	Downlink uint64 `json:"downlink"`
+}
+
+// what is saved in state file
+type trafficState struct {
+	Users        map[string]Traffic `json:"users"`         // key: mask user id or socks username
+	Month        string             `json:"month"`         // month of MonthlyUsage, like 2006-01
+	MonthlyUsage map[string]uint64  `json:"monthly_usage"` // bytes up and down in month, for quota
+	UpdatedAt    time.Time          `json:"updated_at"`
+}
+
+// calendar month of UTC, quota is renewed when it changes
+func trafficMonth(now time.Time) string {
+	return now.UTC().Format("2006-01")
+}
+
+type userTraffic struct {
+	uplink   metrics.Counter // bytes since the store is created
+	downlink metrics.Counter
+	flushed  Traffic // part of the counters already added to state file
+}
+
+/**
+ * TrafficStore counts traffic of users, and keeps the totals in a state file
+ * Flush adds traffic counted since last flush to the file, rather than overwriting it,
+ * so that changes made to the file by ResetTraffic in another process are kept
+ * without a state file, totals are kept in memory only
+ *
+ */
+type TrafficStore struct {
+	stateFile  string
+	flushMutex sync.Mutex // one flush at a time, file io is not done under mutex
+	mutex      sync.Mutex
+	users      map[string]*userTraffic
+	persisted  *trafficState // state file as of last flush, never changed in place
+}
+
+// the state file is created on first flush if it does not exist, "" for none
+func NewTrafficStore(stateFile string) (*TrafficStore, error) {
+	state := newTrafficState()
+	if stateFile != "" {
+		var err error
+		if state, err = readTrafficState(stateFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return &TrafficStore{
+		stateFile: stateFile,
+		users:     make(map[string]*userTraffic),
+		persisted: state,
+	}, nil
+}
+
+// counters of user to add to relaying channels
+func (store *TrafficStore) Counters(user string) (uplink *metrics.Counter, downlink *metrics.Counter) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	traffic, ok := store.users[user]
+	if !ok {
+		traffic = new(userTraffic)
+		store.users[user] = traffic
+	}
+	return &traffic.uplink, &traffic.downlink
+}
+
+// total traffic of user, in state file and counted since last flush
+func (store *TrafficStore) Traffic(user string) Traffic {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	total := store.persisted.Users[user]
+	if traffic, ok := store.users[user]; ok {
+		total.Uplink += traffic.uplink.Value() - traffic.flushed.Uplink
+		total.Downlink += traffic.downlink.Value() - traffic.flushed.Downlink
+	}
+	return total
+}
+
+// bytes up and down of user in this month
+// traffic not flushed yet counts for this month, even if it is from last month
+func (store *TrafficStore) MonthlyUsage(user string) uint64 {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	usage := uint64(0)
+	if store.persisted.Month == trafficMonth(time.Now()) {
+		usage = store.persisted.MonthlyUsage[user]
+	}
+	if traffic, ok := store.users[user]; ok {
+		usage += traffic.uplink.Value() - traffic.flushed.Uplink
+		usage += traffic.downlink.Value() - traffic.flushed.Downlink
+	}
+	return usage
+}
+
+// add traffic counted since last flush to state file
+func (store *TrafficStore) Flush() error {
+	store.flushMutex.Lock()
+	defer store.flushMutex.Unlock()
+
+	store.mutex.Lock()
+	deltas := make(map[string]Traffic, len(store.users))
+	for user, traffic := range store.users {
+		uplink, downlink := traffic.uplink.Value(), traffic.downlink.Value()
+		deltas[user] = Traffic{
+			Uplink:   uplink - traffic.flushed.Uplink,
+			Downlink: downlink - traffic.flushed.Downlink,
+		}
+		traffic.flushed = Traffic{uplink, downlink}
+	}
+	store.mutex.Unlock()
+
+	addDeltas := func(state *trafficState) {
+		if month := trafficMonth(time.Now()); state.Month != month {
+			state.Month = month
+			state.MonthlyUsage = make(map[string]uint64)
+		}
+		for user, delta := range deltas {
+			if delta == (Traffic{}) {
+				continue
+			}
+			total := state.Users[user]
+			total.Uplink += delta.Uplink
+			total.Downlink += delta.Downlink
+			state.Users[user] = total
+			state.MonthlyUsage[user] += delta.Uplink + delta.Downlink
+		}
+	}
+
+	var state *trafficState
+	var err error
+	if store.stateFile == "" {
+		store.mutex.Lock()
+		state = store.persisted.clone()
+		store.mutex.Unlock()
+		addDeltas(state)
+	} else {
+		state, err = updateTrafficState(store.stateFile, addDeltas)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err != nil {
+		// try again on next flush
+		for user, delta := range deltas {
+			traffic := store.users[user]
+			traffic.flushed.Uplink -= delta.Uplink
+			traffic.flushed.Downlink -= delta.Downlink
+		}
+		return err
+	}
+	store.persisted = state
+	return nil
+}
+
+// flush every interval until stop is closed, the last flush is left to the caller
+func (store *TrafficStore) FlushEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := store.Flush(); err != nil {
+				log.Warning("Err in flushing traffic to %s: %v", store.stateFile, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// totals of all users in state file
+func ReadTraffic(stateFile string) (map[string]Traffic, error) {
+	state, err := readTrafficState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	return state.Users, nil
+}
+
+// clear traffic of users in state file, all users if none is given
+// a running node keeps counting from zero after its next flush
+func ResetTraffic(stateFile string, users ...string) error {
+	_, err := updateTrafficState(stateFile, func(state *trafficState) {
+		if len(users) == 0 {
+			state.Users = make(map[string]Traffic)
+			state.MonthlyUsage = make(map[string]uint64)
+		}
+		for _, user := range users {
+			delete(state.Users, user)
+			delete(state.MonthlyUsage, user)
+		}
+	})
+	return err
+}
+
+// users in state file, sorted
+func SortedTrafficUsers(users map[string]Traffic) []string {
+	names := make([]string, 0, len(users))
+	for user := range users {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTrafficState() *trafficState {
+	return &trafficState{
+		Users:        make(map[string]Traffic),
+		MonthlyUsage: make(map[string]uint64),
+	}
+}
+
+func (state *trafficState) clone() *trafficState {
+	copied := newTrafficState()
+	copied.Month = state.Month
+	copied.UpdatedAt = state.UpdatedAt
+	for user, traffic := range state.Users {
+		copied.Users[user] = traffic
+	}
+	for user, usage := range state.MonthlyUsage {
+		copied.MonthlyUsage[user] = usage
+	}
+	return copied
+}
+
+// a missing state file is empty
+func readTrafficState(stateFile string) (*trafficState, error) {
+	state := newTrafficState()
+
+	rawData, err := ioutil.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(rawData, state); err != nil {
+		return nil, fmt.Errorf("broken traffic state file %s: %v", stateFile, err)
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]Traffic)
+	}
+	if state.MonthlyUsage == nil {
+		state.MonthlyUsage = make(map[string]uint64)
+	}
+	return state, nil
+}
+
+// read, change and write state file under its lock
+// the file is replaced as a whole, so that a crash never leaves half of it
+func updateTrafficState(stateFile string, update func(*trafficState)) (*trafficState, error) {
+	unlock, err := lockFile(stateFile + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := readTrafficState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	update(state)
+	state.UpdatedAt = time.Now()
+
+	rawData, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(stateFile), filepath.Base(stateFile)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(rawData)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmpFile.Name(), stateFile); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+const (
+	lockRetryInterval = 10 * time.Millisecond
+	lockTimeout       = 5 * time.Second
+	lockStaleAge      = 30 * time.Second // lock left by a crashed process
+)
+
+// lock by creating the lock file exclusively, works across processes
+func lockFile(lockPath string) (unlock func(), err error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > lockStaleAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout in locking %s", lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
@@ -0,0 +1,85 @@
+package account
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTrafficStore(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "traffic.json")
+
+	store, err := NewTrafficStore(stateFile)
+	if err != nil {
+		t.Fatalf("Err in creating traffic store: %v", err)
+	}
+	uplink, downlink := store.Counters("alice")
+	uplink.Add(100)
+	downlink.Add(1000)
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Err in flushing traffic: %v", err)
+	}
+	uplink.Add(1)
+	if traffic := store.Traffic("alice"); traffic != (Traffic{101, 1000}) {
+		t.Errorf("Traffic of alice is %+v, want {101 1000}", traffic)
+	}
+
+	// reset by another process, counting goes on from zero
+	if err = ResetTraffic(stateFile, "alice"); err != nil {
+		t.Fatalf("Err in resetting traffic: %v", err)
+	}
+	uplink.Add(10)
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Err in flushing traffic: %v", err)
+	}
+	users, err := ReadTraffic(stateFile)
+	if err != nil {
+		t.Fatalf("Err in reading traffic: %v", err)
+	}
+	if users["alice"] != (Traffic{11, 0}) {
+		t.Errorf("Traffic of alice after reset is %+v, want {11 0}", users["alice"])
+	}
+
+	// totals survive restart
+	restarted, err := NewTrafficStore(stateFile)
+	if err != nil {
+		t.Fatalf("Err in reloading traffic store: %v", err)
+	}
+	if traffic := restarted.Traffic("alice"); traffic != (Traffic{11, 0}) {
+		t.Errorf("Traffic of alice after restart is %+v, want {11 0}", traffic)
+	}
+}
+
+func TestMonthlyUsage(t *testing.T) {
+	store, err := NewTrafficStore("")
+	if err != nil {
+		t.Fatalf("Err in creating traffic store: %v", err)
+	}
+	uplink, downlink := store.Counters("alice")
+	uplink.Add(10)
+	downlink.Add(20)
+	if usage := store.MonthlyUsage("alice"); usage != 30 {
+		t.Errorf("Monthly usage before flush is %d, want 30", usage)
+	}
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Err in flushing traffic: %v", err)
+	}
+	if usage := store.MonthlyUsage("alice"); usage != 30 {
+		t.Errorf("Monthly usage after flush is %d, want 30", usage)
+	}
+
+	// usage of last month is not counted, totals are kept
+	store.persisted.Month = "2000-01"
+	uplink.Add(5)
+	if usage := store.MonthlyUsage("alice"); usage != 5 {
+		t.Errorf("Monthly usage in a new month is %d, want 5", usage)
+	}
+	if err = store.Flush(); err != nil {
+		t.Fatalf("Err in flushing traffic: %v", err)
+	}
+	if usage := store.MonthlyUsage("alice"); usage != 5 {
+		t.Errorf("Monthly usage after flush in a new month is %d, want 5", usage)
+	}
+	if traffic := store.Traffic("alice"); traffic != (Traffic{15, 20}) {
+		t.Errorf("Traffic of alice is %+v, want {15 20}", traffic)
+	}
+}
@@ -1,119 +1,441 @@
 package account
 
 import (
-	"container/heap"
+	"crypto/hmac"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"masker/cryption"
 )
 
 const (
-	updateIntervalSec = 10
-	cacheDurationSec  = 120
+	// hashes of time within now +-HashWindowSec are accepted, clients pick time within +-30s
+	// the rest allows for clock skew
+	HashWindowSec = 60
+	hashSlots     = 2*HashWindowSec + 1
+
+	// an entry keeps 40 bits of a hash over the index of its user
+	userIndexBits = 24
+	userIndexMask = 1<<userIndexBits - 1
+	maxUsers      = 1 << userIndexBits
 )
 
+// HashKind tells how the user hash of a handshake is made, see cryption.TimeHMACHash
+type HashKind int
+
+const (
+	HashMD5    HashKind = iota // HMAC-MD5, legacy header of mask
+	HashSHA256                 // HMAC-SHA256 cut to IDBytesLen, headers of mask since v1
+	hashKinds
+)
+
+// hashers of every kind, not safe for concurrent use
+type hasherSet [hashKinds]*cryption.TimeHMACHasher
+
+func newHasherSet() *hasherSet {
+	return &hasherSet{
+		HashMD5:    cryption.NewTimeHMACHasher(),
+		HashSHA256: cryption.NewTimeHMACSHA256Hasher(),
+	}
+}
+
 type User struct {
 	Id *ID `json:"id"`
+	Policy
 }
 
+/**
+ * UserSet is safe for concurrent use, users can be changed while connections are authenticated
+ * GetUser finds a user by the hash of kind sent in handshake, and checks its policy as far as it can
+ * error is ErrNoSuchUser for an unknown hash, or why the user is refused
+ *
+ */
 type UserSet interface {
 	AddUser(User) error
-	GetUser([]byte) (*ID, int64, bool)
+	RemoveUser(User) error
+	UpdateUser(User) error
+	ListUsers() []User
+	GetUser(HashKind, []byte) (*User, int64, error)
+	Close() error
 }
 
-type TimedUserSet struct {
-	validUserIdList   []*ID
-	userHashMap       map[string]indexTimePair
-	userHashEntryHeap *hashEntryHeap
+// replaced rather than changed in place, so that it can be read after the lock is released
+type timedUser struct {
+	User
+	keys [hashKinds]*cryption.TimeHMACKey
+}
+
+// hashes of all users for one time sec
+type hashSlot struct {
+	timeSec int64
+	entries []uint64 // sorted, see hashEntry
 }
 
-type indexTimePair struct {
-	userIndex int
-	timeSec   int64
+/**
+ * TimedUserSet finds users by HMAC(user.Id, timeSec), see newMaskRequest
+ * hashes are kept for each kind and second in the window, one slot per second, a slot is rebuilt when its second moves out of the window
+ * - memory: 8 bytes for each user, kind and second, about 2 KiB per user
+ * - cpu: each second hashes every user once for each kind, a lookup binary searches every slot of its kind
+ * - a hash is cut to 40 bits in its entry, and compared as a whole against the user the entry points to
+ *
+ * all slots are filled before NewTimedUserSet returns
+ *
+ */
+type TimedUserSet struct {
+	mutex       sync.RWMutex
+	users       []*timedUser      // by index, nil for removed ones
+	indexes     map[string]uint32 // key: user id text
+	freeIndexes []uint32          // of removed users, for reuse
+	slots       [hashKinds][hashSlots]hashSlot
+	hashedUntil int64     // last time sec hashed
+	hashers     sync.Pool // of *hasherSet
+	stop        chan struct{}
+	stopOnce    sync.Once
 }
 
 func NewTimedUserSet(userList ...User) (UserSet, error) {
-	userSet := new(TimedUserSet)
-	userSet.userHashMap = make(map[string]indexTimePair)
-	userSet.userHashEntryHeap = newHashEntryHeap(100)
+	ticker := time.NewTicker(time.Second)
+	userSet, err := newTimedUserSet(ticker.C, userList...)
+	if err != nil {
+		ticker.Stop()
+		return nil, err
+	}
+	go func() {
+		<-userSet.stop
+		ticker.Stop()
+	}()
+	return userSet, nil
+}
 
-	userSet.validUserIdList = make([]*ID, 0, len(userList))
+// slots are rehashed on every tick
+func newTimedUserSet(tick <-chan time.Time, userList ...User) (*TimedUserSet, error) {
+	if len(userList) > maxUsers {
+		return nil, fmt.Errorf("too many users: %d, at most %d", len(userList), maxUsers)
+	}
+	userSet := &TimedUserSet{
+		users:   make([]*timedUser, 0, len(userList)),
+		indexes: make(map[string]uint32, len(userList)),
+		stop:    make(chan struct{}),
+	}
+	userSet.hashers.New = func() interface{} {
+		return newHasherSet()
+	}
+
+	// the last one of duplicated users is kept
 	for _, user := range userList {
-		userSet.validUserIdList = append(userSet.validUserIdList, user.Id)
+		user := newTimedUser(user)
+		if index, ok := userSet.indexes[user.Id.Text]; ok {
+			userSet.users[index] = user
+			continue
+		}
+		userSet.indexes[user.Id.Text] = uint32(len(userSet.users))
+		userSet.users = append(userSet.users, user)
 	}
 
-	go userSet.updateUserHash(time.Tick(updateIntervalSec * time.Second))
+	userSet.fillSlots(time.Now().Unix())
+	go userSet.updateUserHash(tick)
 	return userSet, nil
 }
 
-/**
- * every tick cycle update userSet.userHashMap
- * that is, add new user hash about the just experienced time period and delete old user hash that lose timeliness
- * a user hash will lose timeliness if the time interval between current time and timeSec is larger than cacheDurationSec
- *
- * key of userSet.userHashMap: HMAC(user.Id, timeSec)
- *
- */
-func (userSet *TimedUserSet) updateUserHash(tick <-chan time.Time) {
-	now := time.Now()
+func newTimedUser(user User) *timedUser {
+	return &timedUser{
+		User: user,
+		keys: [hashKinds]*cryption.TimeHMACKey{
+			HashMD5:    cryption.NewTimeHMACKey(user.Id.Bytes),
+			HashSHA256: cryption.NewTimeHMACSHA256Key(user.Id.Bytes),
+		},
+	}
+}
 
-	// timeSecWillBeHashed is the next time sec that will be used to generate user hash
-	// time before "timeSecWillBeHashed" has been used
-	timeSecWillBeHashed := now.Unix() - cacheDurationSec
+// hash prefix in the high 40 bits, user index in the low 24 bits
+func hashEntry(userHash []byte, index uint32) uint64 {
+	return hashPrefix(userHash) | uint64(index)
+}
+
+func hashPrefix(userHash []byte) uint64 {
+	return uint64(userHash[0])<<56 | uint64(userHash[1])<<48 | uint64(userHash[2])<<40 |
+		uint64(userHash[3])<<32 | uint64(userHash[4])<<24
+}
 
-	// user hash that associated with timeSecWillBeRemoved is the next hash that will be discarded
-	// time before "timeSecWillBeRemoved" has lost timeliness
-	timeSecWillBeRemoved := timeSecWillBeHashed
+// sort.Slice is several times slower for slots of many users
+type hashEntries []uint64
 
-	for {
-		// problem:
-		// first tick does not come immediately, userHashMap is empty during this time
-		// so, request arrives too early will be denied because listener can not find the corresponding user hash
-		now = <-tick
-		curTimeSec := now.Unix()
-
-		// time sec before "timeSecLoseTimeliness" are all too old to lose timeliness
-		// user hash associate with them will be discarded
-		timeSecLoseTimeliness := curTimeSec - cacheDurationSec
-		for userSet.userHashEntryHeap.Len() > 0 {
-			entry := (*userSet.userHashEntryHeap)[0]
-			timeSecWillBeRemoved = entry.timeSec
-			if timeSecWillBeRemoved >= timeSecLoseTimeliness {
-				break
+func (entries hashEntries) Len() int           { return len(entries) }
+func (entries hashEntries) Less(i, j int) bool { return entries[i] < entries[j] }
+func (entries hashEntries) Swap(i, j int)      { entries[i], entries[j] = entries[j], entries[i] }
+
+func slotOf(timeSec int64) int {
+	return int((timeSec%hashSlots + hashSlots) % hashSlots)
+}
+
+// fill all slots of the window around now, in parallel
+func (userSet *TimedUserSet) fillSlots(now int64) {
+	timeSecs := make(chan int64, hashSlots)
+	for timeSec := now - HashWindowSec; timeSec <= now+HashWindowSec; timeSec++ {
+		timeSecs <- timeSec
+	}
+	close(timeSecs)
+
+	var wait sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			hashers := newHasherSet()
+			for timeSec := range timeSecs {
+				for kind := range userSet.slots {
+					entries := buildEntries(userSet.users, HashKind(kind), timeSec, hashers[kind])
+					userSet.slots[kind][slotOf(timeSec)] = hashSlot{timeSec, entries}
+				}
 			}
+		}()
+	}
+	wait.Wait()
+	userSet.hashedUntil = now + HashWindowSec
+}
+
+func buildEntries(users []*timedUser, kind HashKind, timeSec int64, hasher *cryption.TimeHMACHasher) []uint64 {
+	entries := make([]uint64, 0, len(users))
+	for index, user := range users {
+		if user != nil {
+			entries = append(entries, hashEntry(hasher.Hash(user.keys[kind], timeSec), uint32(index)))
+		}
+	}
+	sort.Sort(hashEntries(entries))
+	return entries
+}
+
+// every tick hash seconds coming into the window, replacing those moving out of it
+func (userSet *TimedUserSet) updateUserHash(tick <-chan time.Time) {
+	hashers := newHasherSet()
+	for {
+		select {
+		case now := <-tick:
+			userSet.hashUntil(now.Unix()+HashWindowSec, hashers)
+		case <-userSet.stop:
+			return
+		}
+	}
+}
 
-			delete(userSet.userHashMap, entry.userHash)
-			heap.Pop(userSet.userHashEntryHeap)
+// slots are hashed without the lock, users changed meanwhile are fixed before installing
+func (userSet *TimedUserSet) hashUntil(until int64, hashers *hasherSet) {
+	userSet.mutex.RLock()
+	from := userSet.hashedUntil + 1
+	userSet.mutex.RUnlock()
+	if from < until-hashSlots+1 {
+		from = until - hashSlots + 1
+	}
+
+	for timeSec := from; timeSec <= until; timeSec++ {
+		userSet.mutex.RLock()
+		snapshot := append([]*timedUser(nil), userSet.users...)
+		userSet.mutex.RUnlock()
+
+		var entries [hashKinds][]uint64
+		for kind := range entries {
+			entries[kind] = buildEntries(snapshot, HashKind(kind), timeSec, hashers[kind])
+		}
+
+		userSet.mutex.Lock()
+		for kind := range entries {
+			kindEntries := userSet.reconcile(entries[kind], snapshot, HashKind(kind), timeSec, hashers[kind])
+			userSet.slots[kind][slotOf(timeSec)] = hashSlot{timeSec, kindEntries}
+		}
+		userSet.hashedUntil = timeSec
+		userSet.mutex.Unlock()
+	}
+}
+
+// apply users added or removed after snapshot to entries, must hold the mutex
+func (userSet *TimedUserSet) reconcile(entries []uint64, snapshot []*timedUser, kind HashKind, timeSec int64, hasher *cryption.TimeHMACHasher) []uint64 {
+	removed := make(map[uint32]bool)
+	added := make([]uint64, 0)
+	for index := 0; index < len(userSet.users) || index < len(snapshot); index++ {
+		var before, after *timedUser
+		if index < len(snapshot) {
+			before = snapshot[index]
+		}
+		if index < len(userSet.users) {
+			after = userSet.users[index]
+		}
+		if sameUser(before, after) {
+			continue
 		}
+		if before != nil {
+			removed[uint32(index)] = true
+		}
+		if after != nil {
+			added = append(added, hashEntry(hasher.Hash(after.keys[kind], timeSec), uint32(index)))
+		}
+	}
+	if len(removed) == 0 && len(added) == 0 {
+		return entries
+	}
 
-		for userIndex := 0; userIndex < len(userSet.validUserIdList); userIndex++ {
-			userSet.generateNewUserHash(timeSecWillBeHashed, curTimeSec, userIndex)
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !removed[uint32(entry&userIndexMask)] {
+			kept = append(kept, entry)
 		}
 	}
+	kept = append(kept, added...)
+	sort.Sort(hashEntries(kept))
+	return kept
 }
 
-func (userSet *TimedUserSet) generateNewUserHash(timeSecWillBeHashed, curTimeSec int64, userIndex int) {
-	userIdBytes := userSet.validUserIdList[userIndex].Bytes
-	for ; timeSecWillBeHashed < curTimeSec+cacheDurationSec; timeSecWillBeHashed++ {
-		userHash := string(cryption.TimeHMACHash(userIdBytes, timeSecWillBeHashed))
-		userSet.userHashMap[userHash] = indexTimePair{userIndex, timeSecWillBeHashed}
-		heap.Push(userSet.userHashEntryHeap, &hashEntry{userHash, timeSecWillBeHashed})
+// an updated user keeps its hashes
+func sameUser(before *timedUser, after *timedUser) bool {
+	if before == nil || after == nil {
+		return before == after
 	}
+	return before.Id.Text == after.Id.Text
 }
 
+// hashes of the user are ready when it returns
 func (userSet *TimedUserSet) AddUser(user User) error {
-	userIndex := len(userSet.validUserIdList)
-	userSet.validUserIdList = append(userSet.validUserIdList, user.Id)
+	added := newTimedUser(user)
+	hashers := userSet.hashers.Get().(*hasherSet)
+	defer userSet.hashers.Put(hashers)
+
+	userSet.mutex.Lock()
+	defer userSet.mutex.Unlock()
 
-	curTimeSec := time.Now().Unix()
-	go userSet.generateNewUserHash(curTimeSec-cacheDurationSec, curTimeSec, userIndex)
+	if _, ok := userSet.indexes[user.Id.Text]; ok {
+		return fmt.Errorf("user %s already exists", user.Id.Text)
+	}
+	var index uint32
+	if n := len(userSet.freeIndexes); n > 0 {
+		index = userSet.freeIndexes[n-1]
+		userSet.freeIndexes = userSet.freeIndexes[:n-1]
+		userSet.users[index] = added
+	} else if len(userSet.users) < maxUsers {
+		index = uint32(len(userSet.users))
+		userSet.users = append(userSet.users, added)
+	} else {
+		return fmt.Errorf("too many users, at most %d", maxUsers)
+	}
+	userSet.indexes[user.Id.Text] = index
+
+	for kind := range userSet.slots {
+		for i := range userSet.slots[kind] {
+			slot := &userSet.slots[kind][i]
+			entry := hashEntry(hashers[kind].Hash(added.keys[kind], slot.timeSec), index)
+			at := sort.Search(len(slot.entries), func(j int) bool { return slot.entries[j] >= entry })
+			slot.entries = append(slot.entries, 0)
+			copy(slot.entries[at+1:], slot.entries[at:])
+			slot.entries[at] = entry
+		}
+	}
 	return nil
 }
 
-func (userSet *TimedUserSet) GetUser(userHash []byte) (*ID, int64, bool) {
-	if pair, ok := userSet.userHashMap[string(userHash)]; ok {
-		return userSet.validUserIdList[pair.userIndex], pair.timeSec, true
-	} else {
-		return nil, 0, false
+// the user is unable to authenticate once it returns, its hashes are evicted
+func (userSet *TimedUserSet) RemoveUser(user User) error {
+	hashers := userSet.hashers.Get().(*hasherSet)
+	defer userSet.hashers.Put(hashers)
+
+	userSet.mutex.Lock()
+	defer userSet.mutex.Unlock()
+
+	index, ok := userSet.indexes[user.Id.Text]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, user.Id.Text)
+	}
+	removed := userSet.users[index]
+	userSet.users[index] = nil
+	delete(userSet.indexes, user.Id.Text)
+	userSet.freeIndexes = append(userSet.freeIndexes, index)
+
+	for kind := range userSet.slots {
+		for i := range userSet.slots[kind] {
+			slot := &userSet.slots[kind][i]
+			entry := hashEntry(hashers[kind].Hash(removed.keys[kind], slot.timeSec), index)
+			at := sort.Search(len(slot.entries), func(j int) bool { return slot.entries[j] >= entry })
+			if at < len(slot.entries) && slot.entries[at] == entry {
+				slot.entries = append(slot.entries[:at], slot.entries[at+1:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// change policy of a user, hashes of the id stay valid
+func (userSet *TimedUserSet) UpdateUser(user User) error {
+	userSet.mutex.Lock()
+	defer userSet.mutex.Unlock()
+
+	index, ok := userSet.indexes[user.Id.Text]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchUser, user.Id.Text)
+	}
+	userSet.users[index] = &timedUser{
+		User: user,
+		keys: userSet.users[index].keys,
+	}
+	return nil
+}
+
+// users sorted by id
+func (userSet *TimedUserSet) ListUsers() []User {
+	userSet.mutex.RLock()
+	userList := make([]User, 0, len(userSet.indexes))
+	for _, user := range userSet.users {
+		if user != nil {
+			userList = append(userList, user.User)
+		}
+	}
+	userSet.mutex.RUnlock()
+
+	sort.Slice(userList, func(i, j int) bool {
+		return userList[i].Id.Text < userList[j].Id.Text
+	})
+	return userList
+}
+
+// disabled and expired users are refused here, quota and connections are left to the listener
+// the user returned must not be changed
+func (userSet *TimedUserSet) GetUser(kind HashKind, userHash []byte) (*User, int64, error) {
+	if kind < 0 || kind >= hashKinds || len(userHash) != IDBytesLen {
+		return nil, 0, ErrNoSuchUser
+	}
+	user, timeSec := userSet.findUser(kind, userHash)
+	if user == nil {
+		return nil, 0, ErrNoSuchUser
+	}
+	if err := user.CheckAccess(time.Now()); err != nil {
+		return user, timeSec, err
+	}
+	return user, timeSec, nil
+}
+
+func (userSet *TimedUserSet) findUser(kind HashKind, userHash []byte) (*User, int64) {
+	hashers := userSet.hashers.Get().(*hasherSet)
+	defer userSet.hashers.Put(hashers)
+	hasher := hashers[kind]
+	prefix := hashPrefix(userHash)
+
+	userSet.mutex.RLock()
+	defer userSet.mutex.RUnlock()
+
+	for i := range userSet.slots[kind] {
+		slot := &userSet.slots[kind][i]
+		at := sort.Search(len(slot.entries), func(j int) bool { return slot.entries[j] >= prefix })
+		for ; at < len(slot.entries) && slot.entries[at]&^userIndexMask == prefix; at++ {
+			user := userSet.users[slot.entries[at]&userIndexMask]
+			if user != nil && hmac.Equal(hasher.Hash(user.keys[kind], slot.timeSec), userHash) {
+				return &user.User, slot.timeSec
+			}
+		}
 	}
+	return nil, 0
+}
+
+// stop rehashing
+func (userSet *TimedUserSet) Close() error {
+	userSet.stopOnce.Do(func() { close(userSet.stop) })
+	return nil
 }
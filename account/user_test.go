@@ -0,0 +1,229 @@
+package account
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"masker/cryption"
+)
+
+func newTestUser(t testing.TB, index int) User {
+	id, err := NewID(fmt.Sprintf("a90779d4-f0e8-456a-8a12-%012x", index))
+	if err != nil {
+		t.Fatalf("Err in creating user id: %v", err)
+	}
+	return User{Id: id}
+}
+
+// a user set rehashed only by ticks sent to it
+func newTickedUserSet(t testing.TB, userList ...User) (*TimedUserSet, chan<- time.Time) {
+	tick := make(chan time.Time)
+	userSet, err := newTimedUserSet(tick, userList...)
+	if err != nil {
+		t.Fatalf("Err in creating user set: %v", err)
+	}
+	return userSet, tick
+}
+
+func TestTimedUserSet(t *testing.T) {
+	alice, bob := newTestUser(t, 1), newTestUser(t, 2)
+	userSet, tick := newTickedUserSet(t, alice)
+	defer userSet.Close()
+
+	// hashes of the whole window are ready at once
+	now := time.Now().Unix()
+	for _, timeSec := range []int64{now - 30, now, now + 30} {
+		aliceHash := cryption.TimeHMACHash(alice.Id.Bytes, timeSec)
+		if user, gotTimeSec, err := userSet.GetUser(HashMD5, aliceHash); err != nil || user.Id.Text != alice.Id.Text || gotTimeSec != timeSec {
+			t.Errorf("Get alice by hash of %d: %v, %d, %v", timeSec, user, gotTimeSec, err)
+		}
+	}
+	// hashes of headers since v1 are found by their own kind only
+	sha256Hash := cryption.TimeHMACSHA256Hash(alice.Id.Bytes, now)
+	if user, gotTimeSec, err := userSet.GetUser(HashSHA256, sha256Hash); err != nil || user.Id.Text != alice.Id.Text || gotTimeSec != now {
+		t.Errorf("Get alice by sha256 hash of %d: %v, %d, %v", now, user, gotTimeSec, err)
+	}
+	if _, _, err := userSet.GetUser(HashMD5, sha256Hash); err != ErrNoSuchUser {
+		t.Errorf("Sha256 hash taken as md5 get %v, want %v", err, ErrNoSuchUser)
+	}
+	if _, _, err := userSet.GetUser(HashSHA256, cryption.TimeHMACHash(alice.Id.Bytes, now)); err != ErrNoSuchUser {
+		t.Errorf("Md5 hash taken as sha256 get %v, want %v", err, ErrNoSuchUser)
+	}
+
+	if _, _, err := userSet.GetUser(HashMD5, cryption.TimeHMACHash(alice.Id.Bytes, now-HashWindowSec-10)); err != ErrNoSuchUser {
+		t.Errorf("Hash out of window get %v, want %v", err, ErrNoSuchUser)
+	}
+
+	// seconds coming into window are hashed on tick
+	tick <- time.Unix(now+5, 0)
+	tick <- time.Unix(now+5, 0) // the first tick is handled once the second is received
+	if _, _, err := userSet.GetUser(HashMD5, cryption.TimeHMACHash(alice.Id.Bytes, now+HashWindowSec+5)); err != nil {
+		t.Errorf("Err in getting alice by hash of a new second: %v", err)
+	}
+
+	// added users can authenticate at once
+	if err := userSet.AddUser(bob); err != nil {
+		t.Fatalf("Err in adding bob: %v", err)
+	}
+	if err := userSet.AddUser(bob); err == nil {
+		t.Errorf("Adding bob twice should fail")
+	}
+	bobHash := cryption.TimeHMACHash(bob.Id.Bytes, now-10)
+	if _, _, err := userSet.GetUser(HashMD5, bobHash); err != nil {
+		t.Errorf("Err in getting bob just added: %v", err)
+	}
+	if _, _, err := userSet.GetUser(HashSHA256, cryption.TimeHMACSHA256Hash(bob.Id.Bytes, now-10)); err != nil {
+		t.Errorf("Err in getting bob just added by sha256 hash: %v", err)
+	}
+
+	// policy changes apply to the next handshake
+	disabled := false
+	bob.Enabled = &disabled
+	if err := userSet.UpdateUser(bob); err != nil {
+		t.Fatalf("Err in updating bob: %v", err)
+	}
+	if _, _, err := userSet.GetUser(HashMD5, bobHash); err != ErrUserDisabled {
+		t.Errorf("Disabled bob get %v, want %v", err, ErrUserDisabled)
+	}
+
+	// removed users can't authenticate at once, and their hashes are gone
+	if err := userSet.RemoveUser(alice); err != nil {
+		t.Fatalf("Err in removing alice: %v", err)
+	}
+	if _, _, err := userSet.GetUser(HashMD5, cryption.TimeHMACHash(alice.Id.Bytes, now)); err != ErrNoSuchUser {
+		t.Errorf("Removed alice get %v, want %v", err, ErrNoSuchUser)
+	}
+	userSet.mutex.RLock()
+	for kind := range userSet.slots {
+		for _, slot := range userSet.slots[kind] {
+			if len(slot.entries) != 1 {
+				t.Errorf("Slot of %d has %d entries of kind %d after alice is removed, want 1", slot.timeSec, len(slot.entries), kind)
+				break
+			}
+		}
+	}
+	userSet.mutex.RUnlock()
+	if err := userSet.RemoveUser(alice); err == nil {
+		t.Errorf("Removing alice twice should fail")
+	}
+
+	if userList := userSet.ListUsers(); len(userList) != 1 || userList[0].Id.Text != bob.Id.Text || userList[0].IsEnabled() {
+		t.Errorf("Unexpected users: %v", userList)
+	}
+}
+
+func TestTimedUserSetConcurrency(t *testing.T) {
+	userList := make([]User, 8)
+	for i := range userList {
+		userList[i] = newTestUser(t, i)
+	}
+	userSet, tick := newTickedUserSet(t, userList[:4]...)
+	defer userSet.Close()
+
+	now := time.Now().Unix()
+	var wait sync.WaitGroup
+	for i := range userList {
+		user := userList[i]
+		wait.Add(2)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 20; j++ {
+				userSet.GetUser(HashMD5, cryption.TimeHMACHash(user.Id.Bytes, now))
+				userSet.ListUsers()
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			for j := 0; j < 5; j++ {
+				userSet.AddUser(user)
+				userSet.UpdateUser(user)
+				userSet.RemoveUser(user)
+			}
+		}()
+	}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for j := int64(1); j <= 3; j++ {
+			tick <- time.Unix(now+j, 0)
+		}
+	}()
+	wait.Wait()
+
+	// slots hashed during changes agree with users left
+	userSet.mutex.RLock()
+	defer userSet.mutex.RUnlock()
+	for kind := range userSet.slots {
+		for _, slot := range userSet.slots[kind] {
+			if len(slot.entries) != len(userSet.indexes) {
+				t.Errorf("Slot of %d has %d entries of kind %d, want %d", slot.timeSec, len(slot.entries), kind, len(userSet.indexes))
+				break
+			}
+		}
+	}
+}
+
+func benchmarkUsers(b *testing.B, n int) []User {
+	userList := make([]User, n)
+	for i := range userList {
+		userList[i] = newTestUser(b, i)
+	}
+	return userList
+}
+
+func BenchmarkGetUser(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		userList := benchmarkUsers(b, n)
+		userSet, _ := newTickedUserSet(b, userList...)
+		now := time.Now().Unix()
+		validHash := cryption.TimeHMACHash(userList[n/2].Id.Bytes, now)
+		invalidHash := cryption.TimeHMACHash(newTestUser(b, n+1).Id.Bytes, now)
+
+		b.Run(fmt.Sprintf("valid/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := userSet.GetUser(HashMD5, validHash); err != nil {
+					b.Fatalf("Err in getting user: %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("invalid/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				userSet.GetUser(HashMD5, invalidHash)
+			}
+		})
+		userSet.Close()
+	}
+}
+
+// time to fill the window, and memory kept per user
+func BenchmarkNewTimedUserSet(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		userList := benchmarkUsers(b, n)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			var before, after runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				userSet, _ := newTickedUserSet(b, userList...)
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(n), "bytes/user")
+				userSet.Close()
+			}
+		})
+	}
+}
+
+// cost of a tick, hashing one second of all users
+func BenchmarkHashSecond(b *testing.B) {
+	userSet, _ := newTickedUserSet(b, benchmarkUsers(b, 100000)...)
+	defer userSet.Close()
+	hashers := newHasherSet()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		userSet.hashUntil(userSet.hashedUntil+1, hashers)
+	}
+}
@@ -0,0 +1,325 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"masker/account"
+	"masker/core"
+	"masker/log"
+)
+
+// inbounds able to change users at runtime, like mask
+type userManager interface {
+	AddUser(account.User) error
+	RemoveUser(account.User) error
+	ListUsers() []account.User
+}
+
+// header carrying token of admin config
+const tokenHeader = "X-Admin-Token"
+
+/**
+ * Server serves admin api in json, to clients on loopback addresses only
+ * pages in browsers are kept out, they may reach loopback by csrf or dns rebinding
+ * - Host must be a loopback address or localhost, Origin must be absent
+ * - body of POST must be application/json, which a form can't send without preflight
+ * - X-Admin-Token must match token of admin config, if it is set
+ *
+ * - GET    /connections                    list sessions relaying data
+ * - DELETE /connections/{id}               kill a session
+ * - GET    /inbounds/{tag}/users           list users of an inbound
+ * - POST   /inbounds/{tag}/users           add a user, body: {"id": "...", "monthly_quota": ...}
+ * - DELETE /inbounds/{tag}/users/{id}      remove a user
+ * - GET    /outbounds/{tag}/next_nodes     list next nodes of an outbound and their health
+ * - POST   /reload                         reload config, like SIGHUP
+ *
+ */
+type Server struct {
+	node   *core.Node
+	token  string // no token is required if empty
+	reload func() error
+	server *http.Server
+}
+
+// reload: reload config of node, the same as what SIGHUP does
+func NewServer(node *core.Node, token string, reload func() error) *Server {
+	server := &Server{
+		node:   node,
+		token:  token,
+		reload: reload,
+	}
+	server.server = &http.Server{Handler: server}
+	return server
+}
+
+func (server *Server) Listen(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	log.Info("Admin api listening on %v...", ln.Addr())
+
+	go func() {
+		err := server.server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Err in serving admin api: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (server *Server) Close() error {
+	return server.server.Close()
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if !fromLoopback(request) {
+		writeError(writer, http.StatusForbidden, "admin api is for local clients only")
+		return
+	}
+	if !isLoopbackHost(request.Host) {
+		writeError(writer, http.StatusForbidden, "admin api must be reached by a loopback host, not "+request.Host)
+		return
+	}
+	if request.Header.Get("Origin") != "" {
+		writeError(writer, http.StatusForbidden, "admin api is not for browsers")
+		return
+	}
+	if !server.authorized(request) {
+		writeError(writer, http.StatusUnauthorized, "missing or wrong "+tokenHeader)
+		return
+	}
+	if request.Method == http.MethodPost && !isJSON(request) {
+		writeError(writer, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "connections":
+		server.handleConnections(writer, request)
+	case len(parts) == 2 && parts[0] == "connections":
+		server.handleConnection(writer, request, parts[1])
+	case len(parts) == 3 && parts[0] == "inbounds" && parts[2] == "users":
+		server.handleUsers(writer, request, parts[1])
+	case len(parts) == 4 && parts[0] == "inbounds" && parts[2] == "users":
+		server.handleUser(writer, request, parts[1], parts[3])
+	case len(parts) == 3 && parts[0] == "outbounds" && parts[2] == "next_nodes":
+		server.handleNextNodes(writer, request, parts[1])
+	case len(parts) == 1 && parts[0] == "reload":
+		server.handleReload(writer, request)
+	default:
+		writeError(writer, http.StatusNotFound, "no such api")
+	}
+}
+
+func (server *Server) handleConnections(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	sessions := server.node.Sessions()
+	views := make([]connectionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, newConnectionView(session))
+	}
+	writeJSON(writer, http.StatusOK, views)
+}
+
+func (server *Server) handleConnection(writer http.ResponseWriter, request *http.Request, idText string) {
+	if !allowMethod(writer, request, http.MethodDelete) {
+		return
+	}
+
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, "illegal connection id "+idText)
+		return
+	}
+	if !server.node.KillSession(id) {
+		writeError(writer, http.StatusNotFound, "no connection "+idText)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleUsers(writer http.ResponseWriter, request *http.Request, tag string) {
+	manager, ok := server.userManager(writer, tag)
+	if !ok {
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		userList := manager.ListUsers()
+		views := make([]userView, 0, len(userList))
+		for _, user := range userList {
+			views = append(views, userView{ID: user.Id.Text, Policy: user.Policy})
+		}
+		writeJSON(writer, http.StatusOK, views)
+	case http.MethodPost:
+		var view userView
+		if err := json.NewDecoder(request.Body).Decode(&view); err != nil {
+			writeError(writer, http.StatusBadRequest, "illegal user: "+err.Error())
+			return
+		}
+		user, err := toUser(view.ID)
+		if err != nil {
+			writeError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+		user.Policy = view.Policy
+		if err = manager.AddUser(user); err != nil {
+			writeError(writer, http.StatusConflict, err.Error())
+			return
+		}
+		writeJSON(writer, http.StatusCreated, view)
+	default:
+		allowMethod(writer, request, http.MethodGet, http.MethodPost)
+	}
+}
+
+func (server *Server) handleUser(writer http.ResponseWriter, request *http.Request, tag string, id string) {
+	if !allowMethod(writer, request, http.MethodDelete) {
+		return
+	}
+	manager, ok := server.userManager(writer, tag)
+	if !ok {
+		return
+	}
+
+	user, err := toUser(id)
+	if err != nil {
+		writeError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = manager.RemoveUser(user); err != nil {
+		writeError(writer, http.StatusNotFound, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleNextNodes(writer http.ResponseWriter, request *http.Request, tag string) {
+	if !allowMethod(writer, request, http.MethodGet) {
+		return
+	}
+
+	caller, ok := server.node.OutboundCaller(tag)
+	if !ok {
+		writeError(writer, http.StatusNotFound, "no outbound "+tag)
+		return
+	}
+	reporter, ok := caller.(core.NextNodeReporter)
+	if !ok {
+		writeError(writer, http.StatusBadRequest, "outbound "+tag+" has no next nodes")
+		return
+	}
+
+	statusList := reporter.NextNodes()
+	views := make([]nextNodeView, 0, len(statusList))
+	for _, status := range statusList {
+		views = append(views, newNextNodeView(status))
+	}
+	writeJSON(writer, http.StatusOK, views)
+}
+
+func (server *Server) handleReload(writer http.ResponseWriter, request *http.Request) {
+	if !allowMethod(writer, request, http.MethodPost) {
+		return
+	}
+
+	if err := server.reload(); err != nil {
+		writeError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) userManager(writer http.ResponseWriter, tag string) (userManager, bool) {
+	listener, ok := server.node.InboundListener(tag)
+	if !ok {
+		writeError(writer, http.StatusNotFound, "no inbound "+tag)
+		return nil, false
+	}
+	manager, ok := listener.(userManager)
+	if !ok {
+		writeError(writer, http.StatusBadRequest, "inbound "+tag+" can't change users at runtime")
+		return nil, false
+	}
+	return manager, true
+}
+
+func toUser(id string) (account.User, error) {
+	userID, err := account.NewID(id)
+	if err != nil {
+		return account.User{}, errors.New("illegal user id " + id)
+	}
+	return account.User{Id: userID}, nil
+}
+
+func fromLoopback(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// host of url, with or without port
+func isLoopbackHost(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = strings.Trim(hostPort, "[]")
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *Server) authorized(request *http.Request) bool {
+	if server.token == "" {
+		return true
+	}
+	token := request.Header.Get(tokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(server.token)) == 1
+}
+
+func isJSON(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// reply 405 if method is not allowed
+func allowMethod(writer http.ResponseWriter, request *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if request.Method == method {
+			return true
+		}
+	}
+	writer.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(writer, http.StatusMethodNotAllowed, "method "+request.Method+" is not allowed")
+	return false
+}
+
+func writeJSON(writer http.ResponseWriter, statusCode int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		log.Warning("Err in writing admin api response: %v", err)
+	}
+}
+
+func writeError(writer http.ResponseWriter, statusCode int, message string) {
+	writeJSON(writer, statusCode, errorView{Error: message})
+}
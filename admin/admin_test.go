@@ -0,0 +1,267 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"masker/account"
+	"masker/core"
+	"masker/network"
+)
+
+const testUserID = "a90779d4-f0e8-456a-8a12-a84387c58b4d"
+
+// fakeListener keeps users in a map
+type fakeListener struct {
+	users map[string]account.User
+}
+
+func (listener *fakeListener) Listen(port uint16) error {
+	return nil
+}
+
+func (listener *fakeListener) Close() error {
+	return nil
+}
+
+func (listener *fakeListener) AddUser(user account.User) error {
+	if _, ok := listener.users[user.Id.Text]; ok {
+		return errors.New("user exists")
+	}
+	listener.users[user.Id.Text] = user
+	return nil
+}
+
+func (listener *fakeListener) RemoveUser(user account.User) error {
+	if _, ok := listener.users[user.Id.Text]; !ok {
+		return errors.New("no such user")
+	}
+	delete(listener.users, user.Id.Text)
+	return nil
+}
+
+func (listener *fakeListener) ListUsers() []account.User {
+	userList := make([]account.User, 0, len(listener.users))
+	for _, user := range listener.users {
+		userList = append(userList, user)
+	}
+	return userList
+}
+
+type fakeListenerConstructor struct{}
+
+func (fakeListenerConstructor) Create(node *core.Node, tag string, configFile string) (core.Listener, error) {
+	return &fakeListener{users: make(map[string]account.User)}, nil
+}
+
+// fakeCaller has a healthy next node and an unhealthy one
+type fakeCaller struct{}
+
+func (fakeCaller) Call(ctx context.Context, session *core.Session, channel core.FullDuplexChannel) error {
+	return nil
+}
+
+func (fakeCaller) Close() error {
+	return nil
+}
+
+func (fakeCaller) NextNodes() []core.NextNodeStatus {
+	return []core.NextNodeStatus{
+		{Address: "10.0.0.1:4444", Users: 1, Healthy: true},
+		{Address: "10.0.0.2:4444", Users: 1, ConsecutiveFailures: 3, LastError: errors.New("connection refused")},
+	}
+}
+
+type fakeCallerConstructor struct{}
+
+func (fakeCallerConstructor) Create(configFile string) (core.Caller, error) {
+	return fakeCaller{}, nil
+}
+
+func init() {
+	core.RegisterListenerConstructor("admin-fake", fakeListenerConstructor{})
+	core.RegisterCallerConstructor("admin-fake", fakeCallerConstructor{})
+}
+
+func newTestServer(t *testing.T) (*Server, *core.Node, *int) {
+	node, err := core.NewNode(core.NodeConfig{
+		Inbounds:  []core.InboundConfig{{Tag: "in", Port: 1, ConnectionConfig: core.ConnectionConfig{Protocol: "admin-fake"}}},
+		Outbounds: []core.OutboundConfig{{Tag: "out", ConnectionConfig: core.ConnectionConfig{Protocol: "admin-fake"}}},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+
+	reloaded := new(int)
+	server := NewServer(node, "", func() error {
+		*reloaded++
+		return nil
+	})
+	return server, node, reloaded
+}
+
+// request of a local client, like curl
+func newLocalRequest(method string, path string, body string) *http.Request {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.RemoteAddr = "127.0.0.1:52110"
+	request.Host = "127.0.0.1:9090"
+	request.Header.Set("Content-Type", "application/json")
+	return request
+}
+
+func serveRequest(server *Server, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func serve(server *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	return serveRequest(server, newLocalRequest(method, path, body))
+}
+
+func TestConnections(t *testing.T) {
+	server, node, _ := newTestServer(t)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	session := node.NewSession("in", conn)
+	session.User = "alice"
+	session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 443))
+	if _, err := node.NewConnectionAccept(context.Background(), session); err != nil {
+		t.Fatalf("Err in accepting connection: %v", err)
+	}
+
+	recorder := serve(server, http.MethodGet, "/connections", "")
+	var views []connectionView
+	if err := json.NewDecoder(recorder.Body).Decode(&views); err != nil {
+		t.Fatalf("Err in decoding connections: %v", err)
+	}
+	if len(views) != 1 || views[0].ID != session.ID || views[0].User != "alice" ||
+		views[0].Destination != "example.com:443" || views[0].Inbound != "in" || views[0].Outbound != "out" {
+		t.Errorf("Unexpected connections: %+v", views)
+	}
+
+	path := "/connections/" + strconv.FormatUint(session.ID, 10)
+	if recorder = serve(server, http.MethodDelete, path, ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("Kill connection get status %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+	if recorder = serve(server, http.MethodDelete, "/connections/0", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("Kill unknown connection get status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	body := `{"id": "` + testUserID + `"}`
+	if recorder := serve(server, http.MethodPost, "/inbounds/in/users", body); recorder.Code != http.StatusCreated {
+		t.Fatalf("Add user get status %d, want %d", recorder.Code, http.StatusCreated)
+	}
+	if recorder := serve(server, http.MethodPost, "/inbounds/in/users", body); recorder.Code != http.StatusConflict {
+		t.Errorf("Add user twice get status %d, want %d", recorder.Code, http.StatusConflict)
+	}
+	if recorder := serve(server, http.MethodPost, "/inbounds/in/users", `{"id": "bad"}`); recorder.Code != http.StatusBadRequest {
+		t.Errorf("Add illegal user get status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	var views []userView
+	json.NewDecoder(serve(server, http.MethodGet, "/inbounds/in/users", "").Body).Decode(&views)
+	if len(views) != 1 || views[0].ID != testUserID {
+		t.Errorf("Unexpected users: %+v", views)
+	}
+
+	if recorder := serve(server, http.MethodDelete, "/inbounds/in/users/"+testUserID, ""); recorder.Code != http.StatusNoContent {
+		t.Errorf("Remove user get status %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+	if recorder := serve(server, http.MethodGet, "/inbounds/unknown/users", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("List users of unknown inbound get status %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestNextNodesAndReload(t *testing.T) {
+	server, _, reloaded := newTestServer(t)
+
+	var views []nextNodeView
+	json.NewDecoder(serve(server, http.MethodGet, "/outbounds/out/next_nodes", "").Body).Decode(&views)
+	if len(views) != 2 || !views[0].Healthy || views[1].Healthy || views[1].LastError != "connection refused" {
+		t.Errorf("Unexpected next nodes: %+v", views)
+	}
+
+	if recorder := serve(server, http.MethodGet, "/reload", ""); recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Reload by GET get status %d, want %d", recorder.Code, http.StatusMethodNotAllowed)
+	}
+	if recorder := serve(server, http.MethodPost, "/reload", ""); recorder.Code != http.StatusNoContent || *reloaded != 1 {
+		t.Errorf("Reload get status %d and reloads %d times", recorder.Code, *reloaded)
+	}
+}
+
+func TestRemoteClientForbidden(t *testing.T) {
+	server, _, _ := newTestServer(t)
+
+	request := httptest.NewRequest(http.MethodGet, "/connections", nil)
+	request.RemoteAddr = "10.0.0.1:52110"
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Remote client get status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+}
+
+// requests a page in browser is able to make by csrf or dns rebinding
+func TestBrowserRequestForbidden(t *testing.T) {
+	server, _, reloaded := newTestServer(t)
+
+	rebinding := newLocalRequest(http.MethodPost, "/reload", "")
+	rebinding.Host = "attacker.example.com:9090"
+	if recorder := serveRequest(server, rebinding); recorder.Code != http.StatusForbidden {
+		t.Errorf("Request to host %s get status %d, want %d", rebinding.Host, recorder.Code, http.StatusForbidden)
+	}
+
+	crossOrigin := newLocalRequest(http.MethodPost, "/reload", "")
+	crossOrigin.Header.Set("Origin", "http://attacker.example.com")
+	if recorder := serveRequest(server, crossOrigin); recorder.Code != http.StatusForbidden {
+		t.Errorf("Request with origin get status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+
+	form := newLocalRequest(http.MethodPost, "/reload", "a=b")
+	form.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if recorder := serveRequest(server, form); recorder.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Post of form get status %d, want %d", recorder.Code, http.StatusUnsupportedMediaType)
+	}
+
+	if *reloaded != 0 {
+		t.Errorf("Config is reloaded %d times by requests forbidden", *reloaded)
+	}
+	localhost := newLocalRequest(http.MethodGet, "/connections", "")
+	localhost.Host = "localhost"
+	if recorder := serveRequest(server, localhost); recorder.Code != http.StatusOK {
+		t.Errorf("Request to localhost get status %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestToken(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	server.token = "secret"
+
+	if recorder := serve(server, http.MethodGet, "/connections", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Request without token get status %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	request := newLocalRequest(http.MethodGet, "/connections", "")
+	request.Header.Set(tokenHeader, "guess")
+	if recorder := serveRequest(server, request); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Request with wrong token get status %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+
+	request.Header.Set(tokenHeader, "secret")
+	if recorder := serveRequest(server, request); recorder.Code != http.StatusOK {
+		t.Errorf("Request with token get status %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
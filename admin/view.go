@@ -0,0 +1,90 @@
+package admin
+
+import (
+	"time"
+
+	"masker/account"
+	"masker/core"
+)
+
+// json forms of what admin api replies
+
+type errorView struct {
+	Error string `json:"error"`
+}
+
+type connectionView struct {
+	ID            uint64    `json:"id"`
+	Source        string    `json:"source"`
+	Destination   string    `json:"destination"`
+	User          string    `json:"user,omitempty"`
+	Inbound       string    `json:"inbound"`
+	Protocol      string    `json:"protocol"`
+	Outbound      string    `json:"outbound"`
+	UplinkBytes   int64     `json:"uplink_bytes"`
+	DownlinkBytes int64     `json:"downlink_bytes"`
+	StartTime     time.Time `json:"start_time"`
+	Age           string    `json:"age"`
+}
+
+func newConnectionView(session *core.Session) connectionView {
+	view := connectionView{
+		ID:            session.ID,
+		User:          session.User,
+		Inbound:       session.InboundTag,
+		Protocol:      session.Protocol,
+		Outbound:      session.OutboundTag,
+		UplinkBytes:   session.Uplink(),
+		DownlinkBytes: session.Downlink(),
+		StartTime:     session.StartTime,
+		Age:           session.Age().Round(time.Second).String(),
+	}
+	if session.Source != nil {
+		view.Source = session.Source.String()
+	}
+	if session.Destination != nil {
+		view.Destination = session.Destination.String()
+	}
+	return view
+}
+
+// policy fields are inline, like in mask listener config
+type userView struct {
+	ID string `json:"id"`
+	account.Policy
+}
+
+type nextNodeView struct {
+	Address             string     `json:"address"`
+	Users               int        `json:"users"`
+	Healthy             bool       `json:"healthy"`
+	ActiveConnections   int64      `json:"active_connections"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	Latency             string     `json:"latency,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+}
+
+func newNextNodeView(status core.NextNodeStatus) nextNodeView {
+	view := nextNodeView{
+		Address:             status.Address,
+		Users:               status.Users,
+		Healthy:             status.Healthy,
+		ActiveConnections:   status.ActiveConnections,
+		ConsecutiveFailures: status.ConsecutiveFailures,
+	}
+	if status.LastError != nil {
+		view.LastError = status.LastError.Error()
+	}
+	if status.Latency > 0 {
+		view.Latency = status.Latency.String()
+	}
+	if !status.LastSuccess.IsZero() {
+		view.LastSuccess = &status.LastSuccess
+	}
+	if !status.LastFailure.IsZero() {
+		view.LastFailure = &status.LastFailure
+	}
+	return view
+}
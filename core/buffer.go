@@ -0,0 +1,136 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// BufferPool hands out buffers of the same size, and keeps at most maxIdleBuffers of them for reuse
+type BufferPool struct {
+	size int
+	idle chan []byte
+}
+
+const maxIdleBuffers = 1024
+
+func NewBufferPool(size int) *BufferPool {
+	return &BufferPool{
+		size: size,
+		idle: make(chan []byte, maxIdleBuffers),
+	}
+}
+
+func (bufferPool *BufferPool) Size() int {
+	return bufferPool.size
+}
+
+func (bufferPool *BufferPool) Get() []byte {
+	select {
+	case buffer := <-bufferPool.idle:
+		return buffer
+	default:
+		return make([]byte, bufferPool.size)
+	}
+}
+
+// buffers not from this pool are dropped, so are those beyond maxIdleBuffers
+func (bufferPool *BufferPool) Put(buffer []byte) {
+	if cap(buffer) != bufferPool.size {
+		return
+	}
+
+	select {
+	case bufferPool.idle <- buffer[:bufferPool.size]:
+	default:
+	}
+}
+
+/**
+ * byteBudget limits how many bytes are held at the same time
+ * acquire blocks until enough bytes are released, waiters are served in order
+ * a nil budget has no limit
+ *
+ */
+type byteBudget struct {
+	mutex   sync.Mutex
+	limit   int64
+	used    int64
+	waiters list.List // of *budgetWaiter
+}
+
+type budgetWaiter struct {
+	nBytes int64
+	ready  chan bool
+}
+
+func newByteBudget(limit int64) *byteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &byteBudget{
+		limit: limit,
+	}
+}
+
+// nBytes larger than limit is cut to limit, otherwise it would never be satisfied
+func (budget *byteBudget) acquire(ctx context.Context, nBytes int64) (int64, error) {
+	if budget == nil {
+		return nBytes, nil
+	}
+	if nBytes > budget.limit {
+		nBytes = budget.limit
+	}
+
+	budget.mutex.Lock()
+	if budget.waiters.Len() == 0 && budget.used+nBytes <= budget.limit {
+		budget.used += nBytes
+		budget.mutex.Unlock()
+		return nBytes, nil
+	}
+	waiter := &budgetWaiter{nBytes: nBytes, ready: make(chan bool)}
+	element := budget.waiters.PushBack(waiter)
+	budget.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nBytes, nil
+	case <-ctx.Done():
+		budget.mutex.Lock()
+		select {
+		case <-waiter.ready:
+			// acquired just now, give it back
+			budget.mutex.Unlock()
+			budget.release(nBytes)
+		default:
+			budget.waiters.Remove(element)
+			budget.notifyWaiters()
+			budget.mutex.Unlock()
+		}
+		return 0, ctx.Err()
+	}
+}
+
+func (budget *byteBudget) release(nBytes int64) {
+	if budget == nil || nBytes == 0 {
+		return
+	}
+
+	budget.mutex.Lock()
+	budget.used -= nBytes
+	budget.notifyWaiters()
+	budget.mutex.Unlock()
+}
+
+// must hold the mutex
+func (budget *byteBudget) notifyWaiters() {
+	for element := budget.waiters.Front(); element != nil; element = budget.waiters.Front() {
+		waiter := element.Value.(*budgetWaiter)
+		if budget.used+waiter.nBytes > budget.limit {
+			return
+		}
+		budget.used += waiter.nBytes
+		budget.waiters.Remove(element)
+		close(waiter.ready)
+	}
+}
@@ -1,15 +1,19 @@
 package core
 
 import (
+	"context"
 	"io"
+	"sync/atomic"
 	"time"
 
 	"masker/log"
+	"masker/metrics"
 )
 
 const (
-	channelSize = 100
-	bufferSize  = 1024 * 4
+	defaultQueueLength      = 100
+	defaultBufferSize       = 1024 * 4
+	defaultConnectionBudget = 1024 * 256
 )
 
 const (
@@ -21,107 +25,350 @@ var (
 	timeoutSec = 120 * time.Second
 )
 
+// relayOptions are shared by channels created under the same buffer config
+type relayOptions struct {
+	bufferPool       *BufferPool
+	queueLength      int
+	connectionBudget int64
+	globalBudget     *byteBudget
+	timeoutSec       time.Duration
+}
+
+func newRelayOptions(config BufferConfig) *relayOptions {
+	options := &relayOptions{
+		bufferPool:       NewBufferPool(defaultBufferSize),
+		queueLength:      defaultQueueLength,
+		connectionBudget: defaultConnectionBudget,
+		globalBudget:     newByteBudget(config.GlobalBudget),
+		timeoutSec:       timeoutSec,
+	}
+	if config.Size > 0 {
+		options.bufferPool = NewBufferPool(config.Size)
+	}
+	if config.QueueLength > 0 {
+		options.queueLength = config.QueueLength
+	}
+	if config.ConnectionBudget > 0 {
+		options.connectionBudget = config.ConnectionBudget
+	}
+	return options
+}
+
+var defaultRelayOptions = newRelayOptions(BufferConfig{})
+
 type FullDuplexChannel struct {
 	ForwardChannel  HalfDuplexChannel
 	BackwardChannel HalfDuplexChannel
+	Session         *Session
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+/**
+ * Data flows in by Input and out by Output, each of them runs in its own goroutine
+ * - Input reaching EOF or failing ends the stream, Output ends after writing all data before it
+ * - after a stream ending by EOF, Output half-closes the writer if it is able to, see writeCloser
+ * - Output failing closes the channel, because data has nowhere to go
+ * - Close drops data in channel and stops both Input and Output at once
+ * - idle timeout comes from read and write deadlines, see NewTimedReader and NewTimedWriter
+ *
+ */
 type HalfDuplexChannel interface {
 	Pop() ([]byte, bool)
-	Push([]byte)
 	Input(io.Reader, chan<- bool)
 	Output(io.Writer, chan<- bool)
 	State() bool
 	Close()
+	AddCounter(*metrics.Counter) // count bytes written by Output, must be called before Output starts
+	AddLimiter(*RateLimiter)     // limit bytes written by Output, must be called before Output starts
 }
 
-func NewFullDuplexChannel() FullDuplexChannel {
+// both directions are closed once ctx is done
+// bytes written by Output are counted into uplink (forward) and downlink (backward) of session
+func NewFullDuplexChannel(ctx context.Context, session *Session) FullDuplexChannel {
+	return newFullDuplexChannel(ctx, session, defaultRelayOptions)
+}
+
+func newFullDuplexChannel(ctx context.Context, session *Session, options *relayOptions) FullDuplexChannel {
+	ctx, cancel := context.WithCancel(ctx)
+	forwardChannel := newTimedHalfDuplexChannel(ctx, options)
+	forwardChannel.AddCounter(&session.uplink)
+	backwardChannel := newTimedHalfDuplexChannel(ctx, options)
+	backwardChannel.AddCounter(&session.downlink)
 	return FullDuplexChannel{
-		ForwardChannel:  newTimedHalfDuplexChannel(channelSize, timeoutSec),
-		BackwardChannel: newTimedHalfDuplexChannel(channelSize, timeoutSec),
+		ForwardChannel:  forwardChannel,
+		BackwardChannel: backwardChannel,
+		Session:         session,
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 }
 
-// timedHalfDuplexChannel implement interface HalfDuplexChannel
+// close both directions
+func (channel FullDuplexChannel) Close() {
+	channel.cancel()
+}
+
+// add counters of bytes relayed in both directions, must be called before relaying
+func (channel FullDuplexChannel) AddCounters(uplink *metrics.Counter, downlink *metrics.Counter) {
+	channel.ForwardChannel.AddCounter(uplink)
+	channel.BackwardChannel.AddCounter(downlink)
+}
+
+// add limiters of bytes relayed in both directions, must be called before relaying
+// nil limiters are ignored
+func (channel FullDuplexChannel) AddLimiters(uplink *RateLimiter, downlink *RateLimiter) {
+	channel.ForwardChannel.AddLimiter(uplink)
+	channel.BackwardChannel.AddLimiter(downlink)
+}
+
+// closed once the channel is closed, connections should be closed then, so that blocking io returns
+func (channel FullDuplexChannel) Done() <-chan struct{} {
+	return channel.ctx.Done()
+}
+
+const (
+	stateActive = int32(iota)
+	stateClosed
+)
+
+/**
+ * timedHalfDuplexChannel implement interface HalfDuplexChannel
+ * buffers come from a pool and go back after written
+ * bytes queued are limited by a budget of its own and a global one, Input waits for both before reading
+ *
+ */
 type timedHalfDuplexChannel struct {
-	data       chan []byte
-	timeoutSec time.Duration
-	state      bool
+	data         chan []byte // only Input sends to it, and closes it when input ends
+	timeoutSec   time.Duration
+	state        int32
+	inputEOF     int32              // set by Input before closing data if input reaches EOF
+	counters     []*metrics.Counter // of bytes written by Output
+	limiters     []*RateLimiter     // Output waits for all of them before writing
+	bufferPool   *BufferPool
+	budget       *byteBudget
+	globalBudget *byteBudget
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
-func newTimedHalfDuplexChannel(channelSize int, timeoutSec time.Duration) *timedHalfDuplexChannel {
+func newTimedHalfDuplexChannel(ctx context.Context, options *relayOptions) *timedHalfDuplexChannel {
+	ctx, cancel := context.WithCancel(ctx)
 	return &timedHalfDuplexChannel{
-		data:       make(chan []byte, channelSize),
-		timeoutSec: timeoutSec,
-		state:      Active,
+		data:         make(chan []byte, options.queueLength),
+		timeoutSec:   options.timeoutSec,
+		state:        stateActive,
+		bufferPool:   options.bufferPool,
+		budget:       newByteBudget(options.connectionBudget),
+		globalBudget: options.globalBudget,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+// wait for data no longer than timeoutSec
+// the buffer popped is owned by the caller
 func (ch *timedHalfDuplexChannel) Pop() ([]byte, bool) {
+	timer := time.NewTimer(ch.timeoutSec)
+	defer timer.Stop()
+
 	select {
 	case data, ok := <-ch.data:
+		if ok {
+			ch.releaseBudget(int64(len(data)))
+		}
 		return data, ok
-	case <-time.After(ch.timeoutSec):
+	case <-ch.ctx.Done():
+		return nil, Closed
+	case <-timer.C:
 		return nil, Closed
-	}
-}
-
-func (ch *timedHalfDuplexChannel) Push(data []byte) {
-	if ch.state == Active {
-		go func() {
-			ch.data <- data
-		}()
 	}
 }
 
 // data flow: reader -> channel
 func (ch *timedHalfDuplexChannel) Input(reader io.Reader, finish chan<- bool) {
-	defer ch.Close()
+	defer ch.endInput()
 
 	reader = NewTimedReader(reader, ch.timeoutSec)
-	for ch.state == Active {
-		buffer := make([]byte, bufferSize)
-		nBytes, err := reader.Read(buffer)
+	for ch.State() == Active {
+		// wait for budget before reading, so that a slow writer slows down the reader
+		acquired, err := ch.acquireBudget(int64(ch.bufferPool.Size()))
+		if err != nil {
+			break
+		}
+
+		buffer := ch.bufferPool.Get()
+		nBytes, err := reader.Read(buffer[:acquired])
+		ch.releaseBudget(acquired - int64(nBytes))
 		if nBytes > 0 {
-			ch.data <- buffer[:nBytes]
+			select {
+			case ch.data <- buffer[:nBytes]:
+			case <-ch.ctx.Done():
+				ch.free(buffer[:nBytes])
+			}
+		} else {
+			ch.bufferPool.Put(buffer)
 		}
+
 		if err == io.EOF {
-			break
+			atomic.StoreInt32(&ch.inputEOF, 1)
+			finish <- true
+			return
 		} else if err != nil {
+			// stream is cut, not ended, the other side sees it by the channel closed
 			log.Warning("Err in channel Input(): %v", err)
+			ch.Close()
 			finish <- false
 			return
 		}
 	}
-	finish <- true
+	// closed
+	finish <- false
+}
+
+// end the stream, data left behind by a closed channel is freed
+func (ch *timedHalfDuplexChannel) endInput() {
+	close(ch.data)
+	if ch.ctx.Err() != nil {
+		for buffer := range ch.data {
+			ch.free(buffer)
+		}
+	}
+}
+
+// net.TCPConn, and writers of protocols able to end a stream but keep reading, like mask
+type writeCloser interface {
+	CloseWrite() error
 }
 
 // data flow: channel -> writer
 func (ch *timedHalfDuplexChannel) Output(writer io.Writer, finish chan<- bool) {
+	closer, _ := writer.(writeCloser)
 	writer = NewTimedWriter(writer, ch.timeoutSec)
-	for buf := range ch.data {
-		_, err := writer.Write(buf)
-		if err != nil {
-			log.Warning("Err in channel Output(): %v", err)
+	for {
+		select {
+		case buf, ok := <-ch.data:
+			if !ok {
+				// input may end because the channel is closed, then the stream is cut, not ended
+				finish <- ch.ctx.Err() == nil && ch.endOutput(closer)
+				return
+			}
+
+			if err := ch.waitLimiters(len(buf)); err != nil {
+				ch.free(buf)
+				ch.drain()
+				finish <- false
+				return
+			}
+
+			nBytes, err := writer.Write(buf)
+			ch.free(buf)
+			for _, counter := range ch.counters {
+				counter.Add(uint64(nBytes))
+			}
+			if err != nil {
+				log.Warning("Err in channel Output(): %v", err)
+				ch.Close()
+				finish <- false
+				return
+			}
+		case <-ch.ctx.Done():
+			ch.drain()
 			finish <- false
 			return
 		}
 	}
-	finish <- true
 }
 
-func (ch *timedHalfDuplexChannel) Close() {
-	if ch.state == Active {
-		ch.state = Closed
-		<-time.After(ch.timeoutSec + 5*time.Second)
+// pass the end of stream on to the other side, false if input does not reach EOF
+func (ch *timedHalfDuplexChannel) endOutput(closer writeCloser) bool {
+	if atomic.LoadInt32(&ch.inputEOF) == 0 {
+		return false
+	}
+	if closer == nil {
+		return true
+	}
+
+	if setter, ok := closer.(writeDeadlineSetter); ok {
+		setter.SetWriteDeadline(time.Now().Add(ch.timeoutSec))
+	}
+	if err := closer.CloseWrite(); err != nil {
+		log.Warning("Err in channel Output() closing write: %v", err)
+		return false
+	}
+	return true
+}
+
+// free data queued in a closed channel, Input frees what it pushes later
+func (ch *timedHalfDuplexChannel) drain() {
+	for {
+		select {
+		case buffer, ok := <-ch.data:
+			if !ok {
+				return
+			}
+			ch.free(buffer)
+		default:
+			return
+		}
+	}
+}
 
-		defer func() {
-			recover()
-		}()
-		close(ch.data)
+func (ch *timedHalfDuplexChannel) acquireBudget(nBytes int64) (int64, error) {
+	acquired, err := ch.budget.acquire(ch.ctx, nBytes)
+	if err != nil {
+		return 0, err
 	}
+
+	globalAcquired, err := ch.globalBudget.acquire(ch.ctx, acquired)
+	if err != nil {
+		ch.budget.release(acquired)
+		return 0, err
+	}
+	ch.budget.release(acquired - globalAcquired)
+	return globalAcquired, nil
+}
+
+func (ch *timedHalfDuplexChannel) releaseBudget(nBytes int64) {
+	ch.budget.release(nBytes)
+	ch.globalBudget.release(nBytes)
+}
+
+// give back budget and buffer
+func (ch *timedHalfDuplexChannel) free(buffer []byte) {
+	ch.releaseBudget(int64(len(buffer)))
+	ch.bufferPool.Put(buffer)
+}
+
+func (ch *timedHalfDuplexChannel) AddCounter(counter *metrics.Counter) {
+	ch.counters = append(ch.counters, counter)
+}
+
+func (ch *timedHalfDuplexChannel) AddLimiter(limiter *RateLimiter) {
+	if limiter != nil {
+		ch.limiters = append(ch.limiters, limiter)
+	}
+}
+
+// fails only if the channel is closed
+func (ch *timedHalfDuplexChannel) waitLimiters(nBytes int) error {
+	for _, limiter := range ch.limiters {
+		if err := limiter.Wait(ch.ctx, nBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ch *timedHalfDuplexChannel) Close() {
+	atomic.StoreInt32(&ch.state, stateClosed)
+	ch.cancel()
 }
 
 func (ch *timedHalfDuplexChannel) State() bool {
-	return ch.state
+	if atomic.LoadInt32(&ch.state) == stateActive && ch.ctx.Err() == nil {
+		return Active
+	}
+	return Closed
 }
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func waitFinish(t *testing.T, finish <-chan bool, want bool, what string) {
+	select {
+	case ok := <-finish:
+		if ok != want {
+			t.Errorf("%s finishes with %v, want %v", what, ok, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s does not finish", what)
+	}
+}
+
+func optionsWithTimeout(timeout time.Duration) *relayOptions {
+	options := newRelayOptions(BufferConfig{})
+	options.timeoutSec = timeout
+	return options
+}
+
+func TestChannelRelay(t *testing.T) {
+	ch := newTimedHalfDuplexChannel(context.Background(), optionsWithTimeout(time.Second))
+	client, server := net.Pipe()
+
+	inputFinish := make(chan bool, 1)
+	go ch.Input(server, inputFinish)
+	var output bytes.Buffer
+	outputFinish := make(chan bool, 1)
+	go ch.Output(&output, outputFinish)
+
+	payload := bytes.Repeat([]byte("masker"), defaultBufferSize)
+	client.Write(payload)
+	client.Close()
+
+	waitFinish(t, inputFinish, true, "Input")
+	waitFinish(t, outputFinish, true, "Output")
+	if !bytes.Equal(output.Bytes(), payload) {
+		t.Errorf("Output get %d bytes, want %d bytes", output.Len(), len(payload))
+	}
+}
+
+type halfClosedBuffer struct {
+	bytes.Buffer
+	writeClosed bool
+}
+
+func (buffer *halfClosedBuffer) CloseWrite() error {
+	buffer.writeClosed = true
+	return nil
+}
+
+func TestChannelHalfClose(t *testing.T) {
+	// input reaching EOF half-closes the writer
+	ch := newTimedHalfDuplexChannel(context.Background(), optionsWithTimeout(time.Second))
+	inputFinish := make(chan bool, 1)
+	go ch.Input(bytes.NewReader([]byte("request")), inputFinish)
+	var output halfClosedBuffer
+	outputFinish := make(chan bool, 1)
+	go ch.Output(&output, outputFinish)
+
+	waitFinish(t, inputFinish, true, "Input")
+	waitFinish(t, outputFinish, true, "Output")
+	if output.String() != "request" || !output.writeClosed {
+		t.Errorf("Output get %q, write closed %v, want %q and closed", output.String(), output.writeClosed, "request")
+	}
+
+	// failed input does not
+	ch = newTimedHalfDuplexChannel(context.Background(), optionsWithTimeout(50*time.Millisecond))
+	client, server := net.Pipe()
+	defer client.Close()
+	go ch.Input(server, inputFinish)
+	output = halfClosedBuffer{}
+	go ch.Output(&output, outputFinish)
+
+	waitFinish(t, inputFinish, false, "Input")
+	waitFinish(t, outputFinish, false, "Output")
+	if output.writeClosed {
+		t.Errorf("Write should not be closed after input fails")
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(data []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestChannelInputError(t *testing.T) {
+	// failed input cuts the stream at once, not after idle timeout
+	ch := newTimedHalfDuplexChannel(context.Background(), optionsWithTimeout(time.Minute))
+	inputFinish := make(chan bool, 1)
+	go ch.Input(failingReader{}, inputFinish)
+	outputFinish := make(chan bool, 1)
+	go ch.Output(&halfClosedBuffer{}, outputFinish)
+
+	waitFinish(t, inputFinish, false, "Input")
+	waitFinish(t, outputFinish, false, "Output")
+	if ch.State() != Closed {
+		t.Errorf("Channel should be closed after input fails")
+	}
+}
+
+func TestChannelIdleTimeout(t *testing.T) {
+	ch := newTimedHalfDuplexChannel(context.Background(), optionsWithTimeout(50*time.Millisecond))
+	client, server := net.Pipe()
+	defer client.Close()
+
+	inputFinish := make(chan bool, 1)
+	go ch.Input(server, inputFinish)
+	outputFinish := make(chan bool, 1)
+	go ch.Output(&bytes.Buffer{}, outputFinish)
+
+	// idle input cuts the stream, like any other read error
+	waitFinish(t, inputFinish, false, "Input")
+	waitFinish(t, outputFinish, false, "Output")
+}
+
+func TestChannelClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	channel := NewFullDuplexChannel(ctx, &Session{})
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// input blocks in reading, output blocks in waiting for data
+	inputFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Input(server, inputFinish)
+	outputFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Output(&bytes.Buffer{}, outputFinish)
+
+	// cancelling parent context closes the channel
+	cancel()
+	waitFinish(t, outputFinish, false, "Output")
+
+	// input notices closing after its read returns, if it has started reading
+	client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	client.Write([]byte("data"))
+	waitFinish(t, inputFinish, false, "Input")
+
+	if channel.ForwardChannel.State() != Closed || channel.BackwardChannel.State() != Closed {
+		t.Errorf("Both directions should be closed")
+	}
+	if _, ok := channel.BackwardChannel.Pop(); ok {
+		t.Errorf("Pop from a closed channel should fail")
+	}
+}
+
+// relay b.N MB through one direction of a channel
+func BenchmarkChannelRelay(b *testing.B) {
+	payload := bytes.Repeat([]byte{0x55}, 1024*1024)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		channel := NewFullDuplexChannel(context.Background(), &Session{})
+
+		inputFinish := make(chan bool, 1)
+		go channel.ForwardChannel.Input(bytes.NewReader(payload), inputFinish)
+		outputFinish := make(chan bool, 1)
+		go channel.ForwardChannel.Output(io.Discard, outputFinish)
+
+		<-inputFinish
+		<-outputFinish
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	budget := newByteBudget(10)
+
+	if acquired, _ := budget.acquire(context.Background(), 100); acquired != 10 {
+		t.Fatalf("acquire more than limit get %d bytes, want 10", acquired)
+	}
+
+	// budget is used up, the waiter gets it after release
+	acquired := make(chan int64, 1)
+	go func() {
+		nBytes, _ := budget.acquire(context.Background(), 4)
+		acquired <- nBytes
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("acquire should wait when budget is used up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.release(10)
+	select {
+	case nBytes := <-acquired:
+		if nBytes != 4 {
+			t.Errorf("waiter get %d bytes, want 4", nBytes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("waiter is not woken up by release")
+	}
+
+	// cancelled waiter gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := budget.acquire(ctx, 10); err == nil {
+		t.Errorf("acquire with a cancelled context should fail")
+	}
+}
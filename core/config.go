@@ -2,14 +2,72 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
+
+	"masker/router"
 )
 
 // the config for a node
 type NodeConfig struct {
-	ListenEndConfig ConnectionConfig `json:"listener"`
-	CallEndConfig   ConnectionConfig `json:"caller"`
-	Port            uint16           `json:"port"`
+	Inbounds  []InboundConfig  `json:"inbounds"`
+	Outbounds []OutboundConfig `json:"outbounds"`
+	Routing   router.Config    `json:"routing"`
+	Buffer    BufferConfig     `json:"buffer"`
+	Admin     AdminConfig      `json:"admin"`
+	Metrics   MetricsConfig    `json:"metrics"`
+	Traffic   TrafficConfig    `json:"traffic"`
+	RateLimit RateLimitConfig  `json:"rate_limit"`
+
+	// single listener and caller, the format before inbounds and outbounds exist
+	// still accepted, and turned into one inbound and one outbound tagged by protocol
+	ListenEndConfig *ConnectionConfig `json:"listener,omitempty"`
+	CallEndConfig   *ConnectionConfig `json:"caller,omitempty"`
+	Port            uint16            `json:"port,omitempty"`
+}
+
+// zero value of a field means its default
+type BufferConfig struct {
+	Size             int   `json:"size"`              // bytes of one buffer, default 4 KiB
+	QueueLength      int   `json:"queue"`             // buffers queued in one direction of a connection, default 100
+	ConnectionBudget int64 `json:"connection_budget"` // bytes queued in one direction of a connection, default 256 KiB
+	GlobalBudget     int64 `json:"global_budget"`     // bytes queued in all connections, default no limit
+}
+
+// admin api is off unless listen is set, and only listens on loopback addresses
+// it is not changed by reloading
+type AdminConfig struct {
+	Listen string `json:"listen"` // like "127.0.0.1:9090"
+	Token  string `json:"token"`  // required in X-Admin-Token header of requests if set
+}
+
+// metrics are served at /metrics in prometheus format, off unless listen is set
+// they contain user ids, listen on a public address with care
+// it is not changed by reloading
+type MetricsConfig struct {
+	Listen string `json:"listen"` // like "127.0.0.1:9100"
+}
+
+// traffic of users is kept in state file, counted in memory only if it is not set
+// it is not changed by reloading
+type TrafficConfig struct {
+	StateFile     string `json:"state_file"`
+	FlushInterval int    `json:"flush_interval"` // seconds, default 60
+}
+
+// bytes per second, 0 for no limit
+type RateConfig struct {
+	Uplink   int64 `json:"uplink"`   // from client to destination
+	Downlink int64 `json:"downlink"` // from destination to client
+}
+
+// limit of all connections of node, and of each user
+// limit of an inbound is set in its InboundConfig
+// connections keep the limits they start with after reloading
+type RateLimitConfig struct {
+	RateConfig
+	Users map[string]RateConfig `json:"users"` // key: mask user id or socks username
 }
 
 type ConnectionConfig struct {
@@ -17,6 +75,18 @@ type ConnectionConfig struct {
 	ConfigFile string `json:"config"`
 }
 
+type InboundConfig struct {
+	Tag       string     `json:"tag"`
+	Port      uint16     `json:"port"`
+	RateLimit RateConfig `json:"rate_limit"`
+	ConnectionConfig
+}
+
+type OutboundConfig struct {
+	Tag string `json:"tag"`
+	ConnectionConfig
+}
+
 func LoadConfig(configFile string) (config NodeConfig, err error) {
 	rawData, err := ioutil.ReadFile(configFile)
 	if err != nil {
@@ -24,5 +94,74 @@ func LoadConfig(configFile string) (config NodeConfig, err error) {
 	}
 
 	err = json.Unmarshal(rawData, &config)
+	if err != nil {
+		return
+	}
+
+	err = config.normalize()
 	return
 }
+
+func (config *NodeConfig) normalize() error {
+	if config.ListenEndConfig != nil {
+		config.Inbounds = append(config.Inbounds, InboundConfig{
+			Tag:              config.ListenEndConfig.Protocol,
+			Port:             config.Port,
+			ConnectionConfig: *config.ListenEndConfig,
+		})
+		config.ListenEndConfig = nil
+	}
+	if config.CallEndConfig != nil {
+		config.Outbounds = append(config.Outbounds, OutboundConfig{
+			Tag:              config.CallEndConfig.Protocol,
+			ConnectionConfig: *config.CallEndConfig,
+		})
+		config.CallEndConfig = nil
+	}
+
+	if len(config.Inbounds) == 0 {
+		return fmt.Errorf("no inbound is configured")
+	}
+	if len(config.Outbounds) == 0 {
+		return fmt.Errorf("no outbound is configured")
+	}
+
+	inboundTags := make(map[string]bool)
+	for _, inbound := range config.Inbounds {
+		if inbound.Tag == "" {
+			return fmt.Errorf("inbound on port %d has no tag", inbound.Port)
+		}
+		if inboundTags[inbound.Tag] {
+			return fmt.Errorf("duplicated inbound tag: %s", inbound.Tag)
+		}
+		inboundTags[inbound.Tag] = true
+	}
+
+	outboundTags := make(map[string]bool)
+	for _, outbound := range config.Outbounds {
+		if outbound.Tag == "" {
+			return fmt.Errorf("outbound with protocol %s has no tag", outbound.Protocol)
+		}
+		if outboundTags[outbound.Tag] {
+			return fmt.Errorf("duplicated outbound tag: %s", outbound.Tag)
+		}
+		outboundTags[outbound.Tag] = true
+	}
+
+	if config.Admin.Listen != "" && !isLoopbackAddress(config.Admin.Listen) {
+		return fmt.Errorf("admin api must listen on a loopback address, not %s", config.Admin.Listen)
+	}
+	return nil
+}
+
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
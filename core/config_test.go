@@ -0,0 +1,60 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestNormalizeLegacyConfig(t *testing.T) {
+	config := NodeConfig{
+		ListenEndConfig: &ConnectionConfig{Protocol: "socks", ConfigFile: "socks_config.json"},
+		CallEndConfig:   &ConnectionConfig{Protocol: "mask", ConfigFile: "mask_caller.json"},
+		Port:            3333,
+	}
+	if err := config.normalize(); err != nil {
+		t.Fatalf("Err in normalizing legacy config: %v", err)
+	}
+
+	if len(config.Inbounds) != 1 || config.Inbounds[0].Tag != "socks" || config.Inbounds[0].Port != 3333 {
+		t.Errorf("Unexpected inbounds from legacy config: %+v", config.Inbounds)
+	}
+	if len(config.Outbounds) != 1 || config.Outbounds[0].Tag != "mask" {
+		t.Errorf("Unexpected outbounds from legacy config: %+v", config.Outbounds)
+	}
+}
+
+func TestNormalizeDuplicatedTag(t *testing.T) {
+	config := NodeConfig{
+		Inbounds: []InboundConfig{
+			{Tag: "in", Port: 1, ConnectionConfig: ConnectionConfig{Protocol: "socks"}},
+			{Tag: "in", Port: 2, ConnectionConfig: ConnectionConfig{Protocol: "mask"}},
+		},
+		Outbounds: []OutboundConfig{
+			{Tag: "out", ConnectionConfig: ConnectionConfig{Protocol: "identical"}},
+		},
+	}
+	if err := config.normalize(); err == nil {
+		t.Errorf("Duplicated inbound tag is accepted by mistake")
+	}
+}
+
+func TestNormalizeAdminAddress(t *testing.T) {
+	testCases := map[string]bool{
+		"":               true,
+		"127.0.0.1:9090": true,
+		"localhost:9090": true,
+		"[::1]:9090":     true,
+		"0.0.0.0:9090":   false,
+		":9090":          false,
+		"10.0.0.1:9090":  false,
+	}
+	for listen, legal := range testCases {
+		config := NodeConfig{
+			Inbounds:  []InboundConfig{{Tag: "in", Port: 1, ConnectionConfig: ConnectionConfig{Protocol: "socks"}}},
+			Outbounds: []OutboundConfig{{Tag: "out", ConnectionConfig: ConnectionConfig{Protocol: "identical"}}},
+			Admin:     AdminConfig{Listen: listen},
+		}
+		if err := config.normalize(); (err == nil) != legal {
+			t.Errorf("Admin address %q is legal: %v, but normalize returns %v", listen, legal, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"masker/metrics"
+	"masker/network"
+)
+
+var (
+	inboundConnectionsTotal   = metrics.NewCounterVec("masker_inbound_connections_total", "Connections accepted by each inbound.", "inbound")
+	inboundConnectionsActive  = metrics.NewGaugeVec("masker_inbound_connections_active", "Connections open on each inbound.", "inbound")
+	outboundConnectionsTotal  = metrics.NewCounterVec("masker_outbound_connections_total", "Connections made by each outbound.", "outbound")
+	outboundConnectionsActive = metrics.NewGaugeVec("masker_outbound_connections_active", "Connections relaying data on each outbound.", "outbound")
+	userBytes                 = metrics.NewCounterVec("masker_user_bytes_total", "Bytes relayed for each user, up is from client to destination.", "user", "direction")
+	handshakeFailures         = metrics.NewCounterVec("masker_handshake_failures_total", "Handshakes failed on each inbound, by reason.", "inbound", "reason")
+	dialDuration              = metrics.NewHistogramVec("masker_dial_duration_seconds", "Time for each outbound to connect destinations, by result.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "outbound", "result")
+)
+
+// reasons of handshake failure shared by protocols, protocols may have their own
+const (
+	HandshakeReadError          = "read_error" // connection broken or timeout during handshake
+	HandshakeInvalidUser        = "invalid_user"
+	HandshakeUnsupportedAddress = "unsupported_address"
+)
+
+// listeners call it when a client fails in handshake
+func RecordHandshakeFailure(inboundTag string, reason string) {
+	handshakeFailures.WithLabelValues(inboundTag, reason).Inc()
+}
+
+// callers call it when connecting a destination, or a next node, finishes
+func ObserveDial(outboundTag string, duration time.Duration, err error) {
+	dialDuration.WithLabelValues(outboundTag, dialResult(err)).Observe(duration.Seconds())
+}
+
+func dialResult(err error) string {
+	switch {
+	case err == nil:
+		return "succeed"
+	case errors.Is(err, network.ErrConnectionRefused):
+		return "connection_refused"
+	case errors.Is(err, network.ErrHostUnreachable):
+		return "host_unreachable"
+	case errors.Is(err, network.ErrNetworkUnreachable):
+		return "network_unreachable"
+	case errors.Is(err, network.ErrDialTimeout):
+		return "timeout"
+	case errors.Is(err, network.ErrConnectionNotAllowed):
+		return "not_allowed"
+	default:
+		return "failure"
+	}
+}
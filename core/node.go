@@ -1,27 +1,92 @@
 package core
 
 import (
-	"masker/log"
+	"context"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
 
+	"masker/account"
+	"masker/log"
 	"masker/network"
+	"masker/router"
 )
 
 type Node struct {
-	ListenEnd Listener
-	CallEnd   Caller
+	Inbounds  []*Inbound
+	Outbounds map[string]Caller
+	Router    *router.Router
 	Config    NodeConfig
+
+	mutex            sync.RWMutex           // guard the fields above against reloading
+	stopped          bool                   // node never starts again once stopped
+	retiredOutbounds []Caller               // outbounds removed by reloading, closed when stopping
+	connections      *network.ConnectionSet // connections accepted by inbounds
+	relayOptions     *relayOptions          // for channels of new connections
+	rateLimits       *rateLimits            // for channels of new connections
+
+	sessionMutex sync.Mutex
+	sessions     map[uint64]*Session // sessions relaying data
+
+	traffic              *account.TrafficStore // in memory only if no state file is set
+	trafficFlushInterval time.Duration
+
+	ctx    context.Context // parent of all channels, cancelled to cut them
+	cancel context.CancelFunc
+}
+
+// an inbound is a listener that accepts connections on a port, and is known by its tag
+type Inbound struct {
+	Tag       string
+	Protocol  string
+	Port      uint16
+	ListenEnd Listener
 }
 
+// Close stops accepting new connections, connections already accepted keep running
 type Listener interface {
 	Listen(uint16) error
+	Close() error
 }
 
+/**
+ * Call returns once session.Destination is connected or fails to, then data relays in background
+ * ctx bounds the dialing only, a failure is better classified by network.ClassifyDialError
+ * Close refuses new calls and closes connections still open to destinations
+ *
+ */
 type Caller interface {
-	Call(FullDuplexChannel, network.Destination) error
+	Call(context.Context, *Session, FullDuplexChannel) error
+	Close() error
+}
+
+// callers relaying through next nodes, like mask, implement NextNodeReporter
+type NextNodeReporter interface {
+	NextNodes() []NextNodeStatus
 }
 
+// NextNodeStatus is a snapshot of a next node
+type NextNodeStatus struct {
+	Address             string
+	Users               int
+	Healthy             bool
+	ActiveConnections   int64
+	ConsecutiveFailures int
+	LastError           error
+	Latency             time.Duration // smoothed round trip, 0 if never measured
+	LastSuccess         time.Time     // zero if never
+	LastFailure         time.Time     // zero if never
+}
+
+// time limit for an outbound to connect its destination
+const DialTimeout = 10 * time.Second
+
+const defaultTrafficFlushInterval = 60 * time.Second
+
 type ListenerConstructor interface {
-	Create(*Node, string) (Listener, error)
+	Create(node *Node, tag string, configFile string) (Listener, error)
 }
 
 type CallerConstructor interface {
@@ -29,33 +94,95 @@ type CallerConstructor interface {
 }
 
 func NewNode(config NodeConfig) (*Node, error) {
-	node := new(Node)
-
-	listenerConstructor, ok := listenerConstructorSet[config.ListenEndConfig.Protocol]
-	if !ok {
-		panic(log.Error("No such listener protocol: %v.", config.ListenEndConfig.Protocol))
+	node := &Node{
+		Inbounds:    make([]*Inbound, 0, len(config.Inbounds)),
+		Outbounds:   make(map[string]Caller),
+		connections: network.NewConnectionSet(),
+		sessions:    make(map[uint64]*Session),
 	}
-	listener, err := listenerConstructor.Create(node, config.ListenEndConfig.ConfigFile)
+	node.relayOptions = newRelayOptions(config.Buffer)
+	node.rateLimits = newRateLimits(config)
+	traffic, err := account.NewTrafficStore(config.Traffic.StateFile)
 	if err != nil {
-		return node, log.Error("can't create listener")
+		return node, log.Error("Err in loading traffic state: %v", err)
 	}
-	node.ListenEnd = listener
+	node.traffic = traffic
+	node.trafficFlushInterval = defaultTrafficFlushInterval
+	if config.Traffic.FlushInterval > 0 {
+		node.trafficFlushInterval = time.Duration(config.Traffic.FlushInterval) * time.Second
+	}
+	node.ctx, node.cancel = context.WithCancel(context.Background())
 
-	callerConstructor, ok := callerConstructorSet[config.CallEndConfig.Protocol]
-	if !ok {
-		panic(log.Error("No such caller protocol: %v.", config.CallEndConfig.Protocol))
+	for _, inboundConfig := range config.Inbounds {
+		inbound, err := node.createInbound(inboundConfig)
+		if err != nil {
+			return node, err
+		}
+		node.Inbounds = append(node.Inbounds, inbound)
 	}
-	caller, err := callerConstructor.Create(config.CallEndConfig.ConfigFile)
+
+	for _, outboundConfig := range config.Outbounds {
+		caller, err := createOutbound(outboundConfig)
+		if err != nil {
+			return node, err
+		}
+		node.Outbounds[outboundConfig.Tag] = caller
+	}
+
+	nodeRouter, err := createRouter(config, node.Outbounds)
 	if err != nil {
-		return node, log.Error("can't create caller")
+		return node, err
 	}
-	node.CallEnd = caller
+	node.Router = nodeRouter
 
 	node.Config = config
 
 	return node, nil
 }
 
+func (node *Node) createInbound(config InboundConfig) (*Inbound, error) {
+	listenerConstructor, ok := listenerConstructorSet[config.Protocol]
+	if !ok {
+		return nil, log.Error("No such listener protocol: %v.", config.Protocol)
+	}
+	listener, err := listenerConstructor.Create(node, config.Tag, config.ConfigFile)
+	if err != nil {
+		return nil, log.Error("can't create listener of inbound %s", config.Tag)
+	}
+	return &Inbound{
+		Tag:       config.Tag,
+		Protocol:  config.Protocol,
+		Port:      config.Port,
+		ListenEnd: listener,
+	}, nil
+}
+
+func createOutbound(config OutboundConfig) (Caller, error) {
+	callerConstructor, ok := callerConstructorSet[config.Protocol]
+	if !ok {
+		return nil, log.Error("No such caller protocol: %v.", config.Protocol)
+	}
+	caller, err := callerConstructor.Create(config.ConfigFile)
+	if err != nil {
+		return nil, log.Error("can't create caller of outbound %s", config.Tag)
+	}
+	return caller, nil
+}
+
+// connections that match no rule go to the first outbound
+func createRouter(config NodeConfig, outbounds map[string]Caller) (*router.Router, error) {
+	nodeRouter, err := router.NewRouter(config.Routing, config.Outbounds[0].Tag)
+	if err != nil {
+		return nil, log.Error("Err in creating router: %v", err)
+	}
+	for _, outboundTag := range nodeRouter.Outbounds() {
+		if _, ok := outbounds[outboundTag]; !ok {
+			return nil, log.Error("Routing refers to an unknown outbound: %s", outboundTag)
+		}
+	}
+	return nodeRouter, nil
+}
+
 var (
 	listenerConstructorSet = make(map[string]ListenerConstructor)
 	callerConstructorSet   = make(map[string]CallerConstructor)
@@ -70,11 +197,201 @@ func RegisterCallerConstructor(protocol string, constructor CallerConstructor) {
 }
 
 func (node *Node) Start() error {
-	return node.ListenEnd.Listen(node.Config.Port)
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	for _, inbound := range node.Inbounds {
+		err := inbound.ListenEnd.Listen(inbound.Port)
+		if err != nil {
+			return log.Error("Err in starting inbound %s: %v", inbound.Tag, err)
+		}
+		log.Info("Inbound %s started.", inbound.Tag)
+	}
+
+	go node.traffic.FlushEvery(node.trafficFlushInterval, node.ctx.Done())
+	return nil
 }
 
-func (node *Node) NewConnectionAccept(dest network.Destination) (FullDuplexChannel, error) {
-	channel := NewFullDuplexChannel()
-	go node.CallEnd.Call(channel, dest)
+/**
+ * Stop accepting, wait for in-flight connections to finish, then close outbounds
+ * connections still alive when ctx is done are cut, and ctx.Err() is returned
+ *
+ */
+func (node *Node) Stop(ctx context.Context) (err error) {
+	node.mutex.Lock()
+	node.stopped = true
+	node.connections.Close()
+	for _, inbound := range node.Inbounds {
+		if closeErr := inbound.ListenEnd.Close(); closeErr != nil {
+			log.Warning("Err in closing inbound %s: %v", inbound.Tag, closeErr)
+		}
+	}
+	node.mutex.Unlock()
+	log.Info("Stop accepting, waiting for %d connections to finish.", node.connections.Len())
+
+	// don't hold the lock here, connections still need to be routed
+	err = node.connections.Wait(ctx)
+	if err != nil {
+		log.Warning("Cut %d connections unfinished: %v", node.connections.Len(), err)
+		node.cancel()
+		node.connections.CloseAll()
+	}
+
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	for tag, caller := range node.Outbounds {
+		if closeErr := caller.Close(); closeErr != nil {
+			log.Warning("Err in closing outbound %s: %v", tag, closeErr)
+		}
+	}
+	for _, caller := range node.retiredOutbounds {
+		caller.Close()
+	}
+	node.cancel()
+
+	if flushErr := node.traffic.Flush(); flushErr != nil {
+		log.Error("Err in flushing traffic: %v", flushErr)
+	}
+	return
+}
+
+// listener of the inbound with tag, false if there is no such inbound
+func (node *Node) InboundListener(tag string) (Listener, bool) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	for _, inbound := range node.Inbounds {
+		if inbound.Tag == tag {
+			return inbound.ListenEnd, true
+		}
+	}
+	return nil, false
+}
+
+// caller of the outbound with tag, false if there is no such outbound
+func (node *Node) OutboundCaller(tag string) (Caller, bool) {
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+
+	caller, ok := node.Outbounds[tag]
+	return caller, ok
+}
+
+// listeners register every accepted connection, so that node can wait for it when stopping
+// return false if node is stopping, then the connection should be closed at once
+func (node *Node) AddConnection(conn io.Closer) bool {
+	return node.connections.Add(conn)
+}
+
+func (node *Node) RemoveConnection(conn io.Closer) {
+	node.connections.Remove(conn)
+}
+
+// every connection accepted gets a session, which should be ended by EndSession when the connection closes
+func (node *Node) NewSession(inboundTag string, conn net.Conn) *Session {
+	protocol := ""
+	node.mutex.RLock()
+	for _, inbound := range node.Inbounds {
+		if inbound.Tag == inboundTag {
+			protocol = inbound.Protocol
+			break
+		}
+	}
+	node.mutex.RUnlock()
+
+	inboundConnectionsTotal.WithLabelValues(inboundTag).Inc()
+	inboundConnectionsActive.WithLabelValues(inboundTag).Inc()
+	return newSession(inboundTag, protocol, conn)
+}
+
+func (node *Node) EndSession(session *Session) {
+	inboundConnectionsActive.WithLabelValues(session.InboundTag).Dec()
+
+	node.sessionMutex.Lock()
+	_, relaying := node.sessions[session.ID]
+	delete(node.sessions, session.ID)
+	node.sessionMutex.Unlock()
+	if relaying {
+		outboundConnectionsActive.WithLabelValues(session.OutboundTag).Dec()
+	}
+
+	if session.Destination == nil {
+		log.Debug("Session %v on inbound %s ends before calling.", session, session.InboundTag)
+		return
+	}
+	log.Info("Session %v ends after %v, %s -> %s via %s, %d bytes up, %d bytes down.",
+		session, session.Age().Round(time.Millisecond), session.InboundTag, session.Destination.String(),
+		session.OutboundTag, session.Uplink(), session.Downlink())
+}
+
+/**
+ * Route the session to an outbound, then let the outbound call session.Destination
+ * return the dial error if the destination can't be connected
+ *
+ * ctx: bound the dialing, see Caller
+ *
+ */
+func (node *Node) NewConnectionAccept(ctx context.Context, session *Session) (FullDuplexChannel, error) {
+	node.mutex.RLock()
+	outboundTag := node.Router.PickOutbound(routingContext{session})
+	caller := node.Outbounds[outboundTag]
+	options := node.relayOptions
+	limits := node.rateLimits
+	node.mutex.RUnlock()
+	session.OutboundTag = outboundTag
+	log.Debug("Routing session %v to %s from inbound %s to outbound %s.", session, session.Destination.String(), session.InboundTag, outboundTag)
+
+	channel := newFullDuplexChannel(node.ctx, session, options)
+	if session.User != "" {
+		channel.AddCounters(userBytes.WithLabelValues(session.User, "up"), userBytes.WithLabelValues(session.User, "down"))
+		channel.AddCounters(node.traffic.Counters(session.User))
+	}
+	limits.apply(channel, session)
+	err := caller.Call(ctx, session, channel)
+	if err != nil {
+		channel.Close()
+		return channel, err
+	}
+
+	outboundConnectionsTotal.WithLabelValues(outboundTag).Inc()
+	outboundConnectionsActive.WithLabelValues(outboundTag).Inc()
+	session.channel = channel
+	node.sessionMutex.Lock()
+	node.sessions[session.ID] = session
+	node.sessionMutex.Unlock()
 	return channel, nil
 }
+
+// sessions relaying data, in the order they start
+func (node *Node) Sessions() []*Session {
+	node.sessionMutex.Lock()
+	sessions := make([]*Session, 0, len(node.sessions))
+	for _, session := range node.sessions {
+		sessions = append(sessions, session)
+	}
+	node.sessionMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// cut the session with id, return false if there is no such session
+func (node *Node) KillSession(id uint64) bool {
+	node.sessionMutex.Lock()
+	session, ok := node.sessions[id]
+	node.sessionMutex.Unlock()
+	if !ok {
+		return false
+	}
+
+	log.Info("Session %v is killed.", session)
+	session.kill()
+	return true
+}
+
+// bytes relayed for user in this month, for quota
+func (node *Node) MonthlyUsage(user string) uint64 {
+	return node.traffic.MonthlyUsage(user)
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/**
+ * RateLimiter is a token bucket of bytes, filled at rate bytes per second and holding at most one second of them
+ * bytes are reserved in the order of waiting, the bucket goes negative when reserved ahead,
+ * so that a large write can't be starved by small ones
+ * a nil limiter has no limit
+ *
+ */
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// rate: bytes per second, no limit if it is not positive
+func NewRateLimiter(rate int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// block until nBytes can pass, or ctx is done
+func (limiter *RateLimiter) Wait(ctx context.Context, nBytes int) error {
+	if limiter == nil {
+		return nil
+	}
+
+	delay := limiter.reserve(nBytes)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take nBytes tokens, return how long to wait until they are filled
+func (limiter *RateLimiter) reserve(nBytes int) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+	limiter.tokens -= float64(nBytes)
+	if limiter.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+type rateLimiterPair struct {
+	uplink   *RateLimiter
+	downlink *RateLimiter
+}
+
+func newRateLimiterPair(config RateConfig) rateLimiterPair {
+	return rateLimiterPair{
+		uplink:   NewRateLimiter(config.Uplink),
+		downlink: NewRateLimiter(config.Downlink),
+	}
+}
+
+/**
+ * rateLimits holds limiters shared by connections of the node, of an inbound and of a user
+ * a connection passes all limiters it comes under, so one user can't starve the others
+ *
+ */
+type rateLimits struct {
+	global   rateLimiterPair
+	inbounds map[string]rateLimiterPair // key: inbound tag
+	users    map[string]rateLimiterPair // key: session.User
+}
+
+func newRateLimits(config NodeConfig) *rateLimits {
+	limits := &rateLimits{
+		global:   newRateLimiterPair(config.RateLimit.RateConfig),
+		inbounds: make(map[string]rateLimiterPair),
+		users:    make(map[string]rateLimiterPair, len(config.RateLimit.Users)),
+	}
+	for _, inbound := range config.Inbounds {
+		limits.inbounds[inbound.Tag] = newRateLimiterPair(inbound.RateLimit)
+	}
+	for user, rate := range config.RateLimit.Users {
+		limits.users[user] = newRateLimiterPair(rate)
+	}
+	return limits
+}
+
+func (limits *rateLimits) apply(channel FullDuplexChannel, session *Session) {
+	if pair, ok := limits.users[session.User]; ok && session.User != "" {
+		channel.AddLimiters(pair.uplink, pair.downlink)
+	}
+	if pair, ok := limits.inbounds[session.InboundTag]; ok {
+		channel.AddLimiters(pair.uplink, pair.downlink)
+	}
+	channel.AddLimiters(limits.global.uplink, limits.global.downlink)
+}
+
+// limiters are rebuilt only if limits change, so that reloading does not refill buckets
+func rateLimitsChanged(oldConfig NodeConfig, newConfig NodeConfig) bool {
+	if !reflect.DeepEqual(oldConfig.RateLimit, newConfig.RateLimit) || len(oldConfig.Inbounds) != len(newConfig.Inbounds) {
+		return true
+	}
+	oldRates := make(map[string]RateConfig, len(oldConfig.Inbounds))
+	for _, inbound := range oldConfig.Inbounds {
+		oldRates[inbound.Tag] = inbound.RateLimit
+	}
+	for _, inbound := range newConfig.Inbounds {
+		if rate, ok := oldRates[inbound.Tag]; !ok || rate != inbound.RateLimit {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"masker/network"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	ctx := context.Background()
+
+	// a full bucket passes at once
+	start := time.Now()
+	if err := limiter.Wait(ctx, 1000); err != nil {
+		t.Fatalf("Err in waiting limiter: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Full bucket waits %v", elapsed)
+	}
+
+	// then bytes pass at rate
+	if err := limiter.Wait(ctx, 200); err != nil {
+		t.Fatalf("Err in waiting limiter: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("200 bytes pass %v after emptying the bucket, want about 200ms", elapsed)
+	}
+
+	// waiting stops when ctx is done
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limiter.Wait(cancelled, 1000); err == nil {
+		t.Errorf("Waiting with a cancelled ctx should fail")
+	}
+
+	if err := (*RateLimiter)(nil).Wait(ctx, 1<<30); err != nil {
+		t.Errorf("Nil limiter should have no limit: %v", err)
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("in", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+		RateLimit: RateLimitConfig{
+			Users: map[string]RateConfig{"alice": {Uplink: 64 * 1024}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+
+	relay := func(user string) time.Duration {
+		conn := &addrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5555}}
+		session := node.NewSession("in", conn)
+		session.User = user
+		session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+		channel, err := node.NewConnectionAccept(context.Background(), session)
+		if err != nil {
+			t.Fatalf("Err in accepting connection: %v", err)
+		}
+		defer node.EndSession(session)
+
+		start := time.Now()
+		finish := make(chan bool, 2)
+		go channel.ForwardChannel.Input(bytes.NewReader(make([]byte, 96*1024)), finish)
+		go channel.ForwardChannel.Output(io.Discard, finish)
+		<-finish
+		<-finish
+		return time.Since(start)
+	}
+
+	// a bucket of 64 KiB, then 32 KiB at 64 KiB/s
+	if elapsed := relay("alice"); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Alice uploads 96 KiB in %v, want about 500ms", elapsed)
+	}
+	if elapsed := relay("bob"); elapsed > 200*time.Millisecond {
+		t.Errorf("Bob without limit uploads 96 KiB in %v", elapsed)
+	}
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"masker/log"
+)
+
+// listeners and callers that can apply a changed config file in place implement Reloader
+// those do not are replaced by new ones on reloading
+type Reloader interface {
+	Reload(configFile string) error
+}
+
+/**
+ * Apply a new node config without stopping the node
+ * - outbounds and inbounds are matched by tag, unchanged ones reload their config files in place
+ * - removed or replaced inbounds stop accepting, connections already accepted keep running
+ * - removed or replaced outbounds keep serving their connections, but get no new one
+ * - router is replaced as a whole
+ * - buffer config and rate limits apply to new connections
+ *
+ * if an error occurs, parts applied before it are kept and recorded in node.Config, the next reload compares against them
+ * callers created for outbounds not applied are closed
+ *
+ */
+func (node *Node) Reload(config NodeConfig) error {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	if node.stopped {
+		return log.Error("Node is stopped, skip reloading.")
+	}
+
+	outbounds, retiredOutbounds, err := node.reloadOutbounds(config.Outbounds)
+	if err != nil {
+		return err
+	}
+	nodeRouter, err := createRouter(config, outbounds)
+	if err != nil {
+		node.closeCreated(outbounds)
+		return err
+	}
+	node.Outbounds = outbounds
+	node.retiredOutbounds = append(node.retiredOutbounds, retiredOutbounds...)
+	node.Router = nodeRouter
+	if config.Buffer != node.Config.Buffer {
+		node.relayOptions = newRelayOptions(config.Buffer)
+	}
+	if rateLimitsChanged(node.Config, config) {
+		node.rateLimits = newRateLimits(config)
+	}
+	node.Config.Outbounds = config.Outbounds
+	node.Config.Routing = config.Routing
+	node.Config.Buffer = config.Buffer
+	node.Config.RateLimit = config.RateLimit
+
+	// inbounds running are recorded by it, even if it fails
+	err = node.reloadInbounds(config.Inbounds)
+	if err != nil {
+		return err
+	}
+
+	node.Config = config
+	return nil
+}
+
+// close callers in outbounds that are not in node.Outbounds, must hold the mutex
+func (node *Node) closeCreated(outbounds map[string]Caller) {
+	for tag, caller := range outbounds {
+		if node.Outbounds[tag] != caller {
+			caller.Close()
+		}
+	}
+}
+
+func (node *Node) reloadOutbounds(configs []OutboundConfig) (outbounds map[string]Caller, retired []Caller, err error) {
+	oldConfigs := make(map[string]OutboundConfig)
+	for _, oldConfig := range node.Config.Outbounds {
+		oldConfigs[oldConfig.Tag] = oldConfig
+	}
+
+	outbounds = make(map[string]Caller)
+	defer func() {
+		if err != nil {
+			node.closeCreated(outbounds)
+		}
+	}()
+	for _, config := range configs {
+		oldCaller, existed := node.Outbounds[config.Tag]
+		if existed && oldConfigs[config.Tag].Protocol == config.Protocol {
+			if reloader, ok := oldCaller.(Reloader); ok {
+				if err = reloader.Reload(config.ConfigFile); err != nil {
+					err = log.Error("Err in reloading outbound %s: %v", config.Tag, err)
+					return
+				}
+				outbounds[config.Tag] = oldCaller
+				log.Info("Outbound %s reloaded.", config.Tag)
+				continue
+			}
+		}
+
+		var caller Caller
+		caller, err = createOutbound(config)
+		if err != nil {
+			return
+		}
+		outbounds[config.Tag] = caller
+		log.Info("Outbound %s created.", config.Tag)
+	}
+
+	for tag, oldCaller := range node.Outbounds {
+		if outbounds[tag] != oldCaller {
+			retired = append(retired, oldCaller)
+			log.Info("Outbound %s retired.", tag)
+		}
+	}
+	return
+}
+
+func (node *Node) reloadInbounds(configs []InboundConfig) error {
+	oldConfigs := make(map[string]InboundConfig)
+	for _, oldConfig := range node.Config.Inbounds {
+		oldConfigs[oldConfig.Tag] = oldConfig
+	}
+	oldInbounds := make(map[string]*Inbound)
+	for _, oldInbound := range node.Inbounds {
+		oldInbounds[oldInbound.Tag] = oldInbound
+	}
+
+	inbounds := make([]*Inbound, 0, len(configs))
+	inboundConfigs := make([]InboundConfig, 0, len(configs)) // of inbounds
+	// old inbounds left in the map are still running, keep them so that they are closed when stopping
+	defer func() {
+		node.Inbounds = inbounds
+		node.Config.Inbounds = inboundConfigs
+		for tag, oldInbound := range oldInbounds {
+			node.Inbounds = append(node.Inbounds, oldInbound)
+			node.Config.Inbounds = append(node.Config.Inbounds, oldConfigs[tag])
+		}
+	}()
+
+	for _, config := range configs {
+		oldInbound, existed := oldInbounds[config.Tag]
+		oldConfig := oldConfigs[config.Tag]
+		if existed && oldConfig.Protocol == config.Protocol && oldConfig.Port == config.Port {
+			if reloader, ok := oldInbound.ListenEnd.(Reloader); ok {
+				if err := reloader.Reload(config.ConfigFile); err != nil {
+					return log.Error("Err in reloading inbound %s: %v", config.Tag, err)
+				}
+				delete(oldInbounds, config.Tag)
+				inbounds = append(inbounds, oldInbound)
+				inboundConfigs = append(inboundConfigs, config)
+				log.Info("Inbound %s reloaded.", config.Tag)
+				continue
+			}
+		}
+
+		inbound, err := node.createInbound(config)
+		if err != nil {
+			return err
+		}
+		// release the port before listening again if it is not changed, otherwise the old inbound runs until the new one listens
+		samePort := existed && oldConfig.Port == config.Port
+		if samePort {
+			oldInbound.ListenEnd.Close()
+			delete(oldInbounds, config.Tag)
+		}
+		if err = inbound.ListenEnd.Listen(inbound.Port); err != nil {
+			inbound.ListenEnd.Close()
+			if samePort {
+				node.restoreInbound(oldConfig, oldInbounds)
+			}
+			return log.Error("Err in starting inbound %s: %v", inbound.Tag, err)
+		}
+		if existed && !samePort {
+			oldInbound.ListenEnd.Close()
+			delete(oldInbounds, config.Tag)
+		}
+		inbounds = append(inbounds, inbound)
+		inboundConfigs = append(inboundConfigs, config)
+		log.Info("Inbound %s started.", config.Tag)
+	}
+
+	for tag, oldInbound := range oldInbounds {
+		oldInbound.ListenEnd.Close()
+		delete(oldInbounds, tag)
+		log.Info("Inbound %s closed.", tag)
+	}
+	return nil
+}
+
+// a closed listener may not listen again, so the inbound is created anew from its old config
+func (node *Node) restoreInbound(config InboundConfig, oldInbounds map[string]*Inbound) {
+	inbound, err := node.createInbound(config)
+	if err != nil {
+		log.Error("Err in restoring inbound %s: %v", config.Tag, err)
+		return
+	}
+	if err = inbound.ListenEnd.Listen(inbound.Port); err != nil {
+		inbound.ListenEnd.Close()
+		log.Error("Err in restoring inbound %s on port %d: %v", config.Tag, config.Port, err)
+		return
+	}
+	oldInbounds[config.Tag] = inbound
+	log.Info("Inbound %s restored.", config.Tag)
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"masker/router"
+)
+
+// fakeListener fails to listen on failingPort
+const failingPort = 9
+
+type fakeListener struct {
+	port     uint16
+	reloaded int
+	closed   bool
+}
+
+func (listener *fakeListener) Listen(port uint16) error {
+	if port == failingPort {
+		return errors.New("port is in use")
+	}
+	listener.port = port
+	return nil
+}
+
+func (listener *fakeListener) Close() error {
+	listener.closed = true
+	return nil
+}
+
+func (listener *fakeListener) Reload(configFile string) error {
+	listener.reloaded++
+	return nil
+}
+
+// tcpListener binds its port for real, it fails to listen with brokenConfig
+const brokenConfig = "broken"
+
+type tcpListener struct {
+	configFile string
+	ln         net.Listener
+}
+
+func (listener *tcpListener) Listen(port uint16) error {
+	if listener.configFile == brokenConfig {
+		return errors.New("broken config")
+	}
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
+	if err != nil {
+		return err
+	}
+	listener.ln = ln
+	return nil
+}
+
+func (listener *tcpListener) Close() error {
+	if listener.ln == nil {
+		return nil
+	}
+	return listener.ln.Close()
+}
+
+type tcpListenerConstructor struct{}
+
+func (tcpListenerConstructor) Create(node *Node, tag string, configFile string) (Listener, error) {
+	return &tcpListener{configFile: configFile}, nil
+}
+
+type fakeListenerConstructor struct{}
+
+func (fakeListenerConstructor) Create(node *Node, tag string, configFile string) (Listener, error) {
+	return &fakeListener{}, nil
+}
+
+// fakeCaller can not reload, so it is replaced on reloading
+type fakeCaller struct {
+	closed  bool
+	session *Session // of the last call
+}
+
+func (caller *fakeCaller) Call(ctx context.Context, session *Session, channel FullDuplexChannel) error {
+	caller.session = session
+	return nil
+}
+
+func (caller *fakeCaller) Close() error {
+	caller.closed = true
+	return nil
+}
+
+type fakeCallerConstructor struct{}
+
+func (fakeCallerConstructor) Create(configFile string) (Caller, error) {
+	return &fakeCaller{}, nil
+}
+
+func init() {
+	RegisterListenerConstructor("fake", fakeListenerConstructor{})
+	RegisterListenerConstructor("tcp", tcpListenerConstructor{})
+	RegisterCallerConstructor("fake", fakeCallerConstructor{})
+}
+
+func fakeInbound(tag string, port uint16) InboundConfig {
+	return InboundConfig{Tag: tag, Port: port, ConnectionConfig: ConnectionConfig{Protocol: "fake"}}
+}
+
+func fakeOutbound(tag string) OutboundConfig {
+	return OutboundConfig{Tag: tag, ConnectionConfig: ConnectionConfig{Protocol: "fake"}}
+}
+
+func TestReload(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1), fakeInbound("moved", 2), fakeInbound("removed", 3)},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+	if err = node.Start(); err != nil {
+		t.Fatalf("Err in starting node: %v", err)
+	}
+	kept := node.Inbounds[0].ListenEnd.(*fakeListener)
+	moved := node.Inbounds[1].ListenEnd.(*fakeListener)
+	removed := node.Inbounds[2].ListenEnd.(*fakeListener)
+	oldCaller := node.Outbounds["out"].(*fakeCaller)
+
+	err = node.Reload(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1), fakeInbound("moved", 4), fakeInbound("added", 5)},
+		Outbounds: []OutboundConfig{fakeOutbound("out"), fakeOutbound("new")},
+	})
+	if err != nil {
+		t.Fatalf("Err in reloading node: %v", err)
+	}
+
+	if node.Inbounds[0].ListenEnd != kept || kept.reloaded != 1 || kept.closed {
+		t.Errorf("Unchanged inbound should be reloaded in place")
+	}
+	if !moved.closed || node.Inbounds[1].ListenEnd.(*fakeListener).port != 4 {
+		t.Errorf("Inbound with a new port should be replaced")
+	}
+	if !removed.closed || len(node.Inbounds) != 3 || node.Inbounds[2].Tag != "added" {
+		t.Errorf("Removed inbound should be closed and added inbound should be started")
+	}
+	if node.Outbounds["out"] == oldCaller || oldCaller.closed || node.Outbounds["new"] == nil {
+		t.Errorf("Outbound unable to reload should be replaced without being closed")
+	}
+
+	err = node.Reload(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+		Routing:   router.Config{DefaultOutbound: "unknown"},
+	})
+	if err == nil {
+		t.Errorf("Routing to an unknown outbound is accepted by mistake")
+	}
+}
+
+// parts applied before an error are recorded, the next reload goes on from them
+func TestReloadPartialFailure(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+	if err = node.Start(); err != nil {
+		t.Fatalf("Err in starting node: %v", err)
+	}
+
+	// router fails, outbounds created for it are closed
+	oldCaller := node.Outbounds["out"]
+	err = node.Reload(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out"), fakeOutbound("new")},
+		Routing:   router.Config{DefaultOutbound: "unknown"},
+	})
+	if err == nil {
+		t.Fatalf("Routing to an unknown outbound is accepted by mistake")
+	}
+	if node.Outbounds["out"] != oldCaller || node.Outbounds["new"] != nil || len(node.Config.Outbounds) != 1 {
+		t.Errorf("Outbounds should be kept when router fails")
+	}
+
+	// an inbound fails to listen, outbounds and router are applied already
+	config := NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("kept", 1), fakeInbound("broken", failingPort)},
+		Outbounds: []OutboundConfig{fakeOutbound("out"), fakeOutbound("new")},
+		Routing:   router.Config{DefaultOutbound: "new"},
+	}
+	if err = node.Reload(config); err == nil {
+		t.Fatalf("Inbound failing to listen is accepted by mistake")
+	}
+	if node.Outbounds["new"] == nil || len(node.Config.Outbounds) != 2 || node.Config.Routing.DefaultOutbound != "new" {
+		t.Errorf("Outbounds and router applied should be recorded, get config %+v", node.Config)
+	}
+	if len(node.Inbounds) != 1 || len(node.Config.Inbounds) != 1 || node.Config.Inbounds[0].Tag != "kept" {
+		t.Errorf("Only inbounds running should be recorded, get %+v", node.Config.Inbounds)
+	}
+
+	// fixed, the broken inbound is started
+	config.Inbounds[1].Port = 6
+	if err = node.Reload(config); err != nil {
+		t.Fatalf("Err in reloading node: %v", err)
+	}
+	if len(node.Inbounds) != 2 || len(node.Config.Inbounds) != 2 || node.Inbounds[1].ListenEnd.(*fakeListener).port != 6 {
+		t.Errorf("Inbound fixed should be started, get %+v", node.Config.Inbounds)
+	}
+}
+
+// inbound failing to listen leaves the old one serving on its port
+func TestReloadInboundFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in finding a free port: %v", err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	tcpInbound := func(port uint16, configFile string) InboundConfig {
+		return InboundConfig{Tag: "in", Port: port, ConnectionConfig: ConnectionConfig{Protocol: "tcp", ConfigFile: configFile}}
+	}
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{tcpInbound(port, "")},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+	if err = node.Start(); err != nil {
+		t.Fatalf("Err in starting node: %v", err)
+	}
+	defer node.Stop(context.Background())
+
+	for _, config := range []InboundConfig{tcpInbound(port, brokenConfig), tcpInbound(failingPort, brokenConfig)} {
+		err = node.Reload(NodeConfig{
+			Inbounds:  []InboundConfig{config},
+			Outbounds: []OutboundConfig{fakeOutbound("out")},
+		})
+		if err == nil {
+			t.Fatalf("Inbound failing to listen on port %d is accepted by mistake", config.Port)
+		}
+
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+		if err != nil {
+			t.Fatalf("Old port should still accept connections after reloading with port %d: %v", config.Port, err)
+		}
+		conn.Close()
+		if len(node.Inbounds) != 1 || len(node.Config.Inbounds) != 1 || node.Config.Inbounds[0] != tcpInbound(port, "") {
+			t.Errorf("Old inbound should be recorded, get %+v", node.Config.Inbounds)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"masker/account"
+	"masker/metrics"
+	"masker/network"
+)
+
+var lastSessionID uint64
+
+/**
+ * Session describes one relayed connection, from accepting to closing
+ * listener creates it by Node.NewSession, fills in what it learns from the handshake,
+ * then passes it to Node.NewConnectionAccept, which hands it on to the caller
+ * fields are not changed any more once the destination is connected, see Node.Sessions
+ *
+ */
+type Session struct {
+	ID          uint64   // unique among all sessions of the process
+	Source      net.Addr // address of the client
+	InboundTag  string
+	Protocol    string              // protocol of the inbound
+	User        string              // authenticated user, socks username or mask user id, empty if none
+	Account     *account.ID         // authenticated mask user, nil for other protocols
+	Destination network.Destination // set by listener before calling
+	OutboundTag string              // set by node once routed
+	StartTime   time.Time
+
+	uplink   metrics.Counter // bytes relayed from client to destination
+	downlink metrics.Counter // bytes relayed from destination to client
+
+	conn    io.Closer         // the accepted connection
+	channel FullDuplexChannel // set once the destination is connected
+}
+
+func newSession(inboundTag string, protocol string, conn net.Conn) *Session {
+	return &Session{
+		ID:         atomic.AddUint64(&lastSessionID, 1),
+		Source:     conn.RemoteAddr(),
+		InboundTag: inboundTag,
+		Protocol:   protocol,
+		StartTime:  time.Now(),
+		conn:       conn,
+	}
+}
+
+func (session *Session) Uplink() int64 {
+	return int64(session.uplink.Value())
+}
+
+func (session *Session) Downlink() int64 {
+	return int64(session.downlink.Value())
+}
+
+func (session *Session) Age() time.Duration {
+	return time.Since(session.StartTime)
+}
+
+// cut both the accepted connection and the one to destination
+func (session *Session) kill() {
+	session.channel.Close()
+	session.conn.Close()
+}
+
+// short form for logs, like "#12 127.0.0.1:52110"
+func (session *Session) String() string {
+	return fmt.Sprintf("#%d %v", session.ID, session.Source)
+}
+
+// routingContext implement interface router.Context
+type routingContext struct {
+	session *Session
+}
+
+func (ctx routingContext) Destination() network.Destination {
+	return ctx.session.Destination
+}
+
+func (ctx routingContext) InboundTag() string {
+	return ctx.session.InboundTag
+}
+
+func (ctx routingContext) User() string {
+	return ctx.session.User
+}
+
+func (ctx routingContext) Source() net.IP {
+	if addr, ok := ctx.session.Source.(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
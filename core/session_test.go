@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"masker/network"
+	"masker/router"
+)
+
+// a connection from the given address
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	closed     bool
+}
+
+func (conn *addrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *addrConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("in", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out"), fakeOutbound("lan")},
+		Routing: router.Config{
+			Rules: []router.RuleConfig{{Source: []string{"192.168.0.0/16"}, Outbound: "lan"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+
+	conn := &addrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 5555}}
+	session := node.NewSession("in", conn)
+	if other := node.NewSession("in", conn); other.ID == session.ID {
+		t.Errorf("Sessions should have unique IDs, both get %d", session.ID)
+	}
+	if session.Protocol != "fake" {
+		t.Errorf("Session protocol is %q, want %q", session.Protocol, "fake")
+	}
+
+	// routed by source, and passed on to the caller
+	session.User = "alice"
+	session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+	channel, err := node.NewConnectionAccept(context.Background(), session)
+	if err != nil {
+		t.Fatalf("Err in accepting connection: %v", err)
+	}
+	if session.OutboundTag != "lan" {
+		t.Errorf("Session is routed to %s, want lan", session.OutboundTag)
+	}
+	if caller := node.Outbounds["lan"].(*fakeCaller); caller.session != session {
+		t.Errorf("Caller should get the session of the connection")
+	}
+
+	// bytes relayed are counted by direction
+	finish := make(chan bool, 4)
+	go channel.ForwardChannel.Input(bytes.NewReader([]byte("request")), finish)
+	go channel.ForwardChannel.Output(io.Discard, finish)
+	go channel.BackwardChannel.Input(bytes.NewReader([]byte("response!")), finish)
+	go channel.BackwardChannel.Output(io.Discard, finish)
+	for i := 0; i < 4; i++ {
+		waitFinish(t, finish, true, "Relay")
+	}
+	if session.Uplink() != 7 || session.Downlink() != 9 {
+		t.Errorf("Session relays %d bytes up and %d bytes down, want 7 and 9", session.Uplink(), session.Downlink())
+	}
+	node.EndSession(session)
+	if len(node.Sessions()) != 0 {
+		t.Errorf("Ended session should be removed from node")
+	}
+}
+
+func TestKillSession(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("in", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("out")},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+
+	conn := &addrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5555}}
+	session := node.NewSession("in", conn)
+	session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+	channel, err := node.NewConnectionAccept(context.Background(), session)
+	if err != nil {
+		t.Fatalf("Err in accepting connection: %v", err)
+	}
+	if sessions := node.Sessions(); len(sessions) != 1 || sessions[0] != session {
+		t.Fatalf("Node should list the session relaying data, get %v", sessions)
+	}
+
+	if node.KillSession(session.ID + 1) {
+		t.Errorf("Kill an unknown session should fail")
+	}
+	if !node.KillSession(session.ID) {
+		t.Fatalf("Err in killing session %d", session.ID)
+	}
+	select {
+	case <-channel.Done():
+	default:
+		t.Errorf("Channel of a killed session should be closed")
+	}
+	if !conn.closed {
+		t.Errorf("Connection of a killed session should be closed")
+	}
+}
+
+func TestSessionMetrics(t *testing.T) {
+	node, err := NewNode(NodeConfig{
+		Inbounds:  []InboundConfig{fakeInbound("metrics-in", 1)},
+		Outbounds: []OutboundConfig{fakeOutbound("metrics-out")},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+
+	conn := &addrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5555}}
+	session := node.NewSession("metrics-in", conn)
+	session.User = "metrics-user"
+	session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+	channel, err := node.NewConnectionAccept(context.Background(), session)
+	if err != nil {
+		t.Fatalf("Err in accepting connection: %v", err)
+	}
+	if active := outboundConnectionsActive.WithLabelValues("metrics-out").Value(); active != 1 {
+		t.Errorf("Active connections of outbound is %d, want 1", active)
+	}
+
+	finish := make(chan bool, 2)
+	go channel.ForwardChannel.Input(bytes.NewReader([]byte("request")), finish)
+	go channel.ForwardChannel.Output(io.Discard, finish)
+	waitFinish(t, finish, true, "Input")
+	waitFinish(t, finish, true, "Output")
+	if up := userBytes.WithLabelValues("metrics-user", "up").Value(); up != 7 {
+		t.Errorf("Bytes up of user is %d, want 7", up)
+	}
+
+	node.EndSession(session)
+	if total := inboundConnectionsTotal.WithLabelValues("metrics-in").Value(); total != 1 {
+		t.Errorf("Total connections of inbound is %d, want 1", total)
+	}
+	if active := inboundConnectionsActive.WithLabelValues("metrics-in").Value(); active != 0 {
+		t.Errorf("Active connections of inbound is %d, want 0", active)
+	}
+	if active := outboundConnectionsActive.WithLabelValues("metrics-out").Value(); active != 0 {
+		t.Errorf("Active connections of outbound is %d, want 0", active)
+	}
+}
@@ -3,7 +3,10 @@ package core
 import (
 	"errors"
 	"io"
+	"os"
 	"time"
+
+	"masker/log"
 )
 
 var (
@@ -11,56 +14,127 @@ var (
 	ErrWriteTimeout = errors.New("writing time out")
 )
 
+// net.Conn, and readers or writers wrapping one, like those in package cryption
+type readDeadlineSetter interface {
+	SetReadDeadline(time.Time) error
+}
+
+type writeDeadlineSetter interface {
+	SetWriteDeadline(time.Time) error
+}
+
 type timedReader struct {
 	reader     io.Reader
+	setter     readDeadlineSetter // nil once it fails, then closer is closed on timeout instead
+	closer     io.Closer
 	timeoutSec time.Duration
 }
 
+// every Read must finish within timeoutSec by read deadline
+// reader unable to set read deadline, like wrappers of package cryption over a reader without deadline, is closed on timeout
+// reader able to do neither is returned as it is, without timeout
 func NewTimedReader(reader io.Reader, timeoutSec time.Duration) io.Reader {
+	setter, _ := reader.(readDeadlineSetter)
+	closer, _ := reader.(io.Closer)
+	if setter == nil && closer == nil {
+		log.Debug("%T can neither set read deadline nor be closed, read without timeout.", reader)
+		return reader
+	}
+
 	return &timedReader{
 		reader:     reader,
+		setter:     setter,
+		closer:     closer,
 		timeoutSec: timeoutSec,
 	}
 }
 
 func (reader *timedReader) Read(buf []byte) (nBytes int, err error) {
-	ch := make(chan bool)
-	go func() {
-		nBytes, err = reader.reader.Read(buf)
-		ch <- true
-	}()
+	if reader.setter != nil {
+		if err = reader.setter.SetReadDeadline(time.Now().Add(reader.timeoutSec)); err != nil {
+			if reader.closer == nil {
+				return 0, err
+			}
+			log.Debug("Err in setting read deadline of %T: %v, close it on timeout instead.", reader.reader, err)
+			reader.setter = nil
+		}
+	}
 
-	select {
-	case <-ch:
+	if reader.setter == nil {
+		closed := closeOnTimeout(reader.closer, reader.timeoutSec)
+		nBytes, err = reader.reader.Read(buf)
+		if closed() && err != nil {
+			err = ErrReadTimeout
+		}
 		return
-	case <-time.After(reader.timeoutSec):
-		return 0, ErrReadTimeout
 	}
+
+	nBytes, err = reader.reader.Read(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrReadTimeout
+	}
+	return
 }
 
 type timedWriter struct {
 	writer     io.Writer
+	setter     writeDeadlineSetter // nil once it fails, then closer is closed on timeout instead
+	closer     io.Closer
 	timeoutSec time.Duration
 }
 
+// every Write must finish within timeoutSec by write deadline
+// writer unable to set write deadline is closed on timeout, the same as NewTimedReader
+// writer able to do neither is returned as it is, without timeout
 func NewTimedWriter(writer io.Writer, timeoutSec time.Duration) io.Writer {
+	setter, _ := writer.(writeDeadlineSetter)
+	closer, _ := writer.(io.Closer)
+	if setter == nil && closer == nil {
+		log.Debug("%T can neither set write deadline nor be closed, write without timeout.", writer)
+		return writer
+	}
+
 	return &timedWriter{
 		writer:     writer,
+		setter:     setter,
+		closer:     closer,
 		timeoutSec: timeoutSec,
 	}
 }
 
 func (writer *timedWriter) Write(buf []byte) (nBytes int, err error) {
-	ch := make(chan bool)
-	go func() {
-		nBytes, err = writer.writer.Write(buf)
-		ch <- true
-	}()
+	if writer.setter != nil {
+		if err = writer.setter.SetWriteDeadline(time.Now().Add(writer.timeoutSec)); err != nil {
+			if writer.closer == nil {
+				return 0, err
+			}
+			log.Debug("Err in setting write deadline of %T: %v, close it on timeout instead.", writer.writer, err)
+			writer.setter = nil
+		}
+	}
 
-	select {
-	case <-ch:
+	if writer.setter == nil {
+		closed := closeOnTimeout(writer.closer, writer.timeoutSec)
+		nBytes, err = writer.writer.Write(buf)
+		if closed() && err != nil {
+			err = ErrWriteTimeout
+		}
 		return
-	case <-time.After(writer.timeoutSec):
-		return 0, ErrWriteTimeout
+	}
+
+	nBytes, err = writer.writer.Write(buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = ErrWriteTimeout
+	}
+	return
+}
+
+// close closer unless stopped within timeout, stop reports whether it is closed
+func closeOnTimeout(closer io.Closer, timeout time.Duration) (stop func() bool) {
+	timer := time.AfterFunc(timeout, func() {
+		closer.Close()
+	})
+	return func() bool {
+		return !timer.Stop()
 	}
 }
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var errNoDeadline = errors.New("deadline is not supported")
+
+// wrapper of a conn, unable to pass deadlines on like those of package cryption over a plain reader
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (conn noDeadlineConn) SetReadDeadline(time.Time) error {
+	return errNoDeadline
+}
+
+func (conn noDeadlineConn) SetWriteDeadline(time.Time) error {
+	return errNoDeadline
+}
+
+func TestTimedReaderWithoutDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	reader := NewTimedReader(noDeadlineConn{server}, 50*time.Millisecond)
+	if _, err := reader.Read(make([]byte, 8)); err != ErrReadTimeout {
+		t.Errorf("Read without data get %v, want %v", err, ErrReadTimeout)
+	}
+	if _, err := client.Write([]byte("masker")); err == nil {
+		t.Errorf("Conn should be closed on read timeout")
+	}
+}
+
+func TestTimedWriterWithoutDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	writer := NewTimedWriter(noDeadlineConn{server}, 50*time.Millisecond)
+	if _, err := writer.Write([]byte("masker")); err != ErrWriteTimeout {
+		t.Errorf("Write without reader get %v, want %v", err, ErrWriteTimeout)
+	}
+
+	// data read in time is not cut
+	client, server = net.Pipe()
+	defer client.Close()
+	writer = NewTimedWriter(noDeadlineConn{server}, time.Second)
+	go io.Copy(io.Discard, client)
+	if _, err := writer.Write([]byte("masker")); err != nil {
+		t.Errorf("Err in writing in time: %v", err)
+	}
+}
+
+// setter failing without a way to close, the error is returned instead of reading without timeout
+type noDeadlineReader struct{}
+
+func (noDeadlineReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (noDeadlineReader) SetReadDeadline(time.Time) error {
+	return errNoDeadline
+}
+
+func TestTimedReaderDeadlineError(t *testing.T) {
+	if _, err := NewTimedReader(noDeadlineReader{}, time.Second).Read(make([]byte, 8)); err != errNoDeadline {
+		t.Errorf("Read get %v, want %v", err, errNoDeadline)
+	}
+}
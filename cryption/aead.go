@@ -0,0 +1,216 @@
+package cryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("message authentication failed")
+)
+
+const (
+	chunkLengthLen  = 2
+	maxChunkDataLen = 0x3FFF
+)
+
+// key of aead is derived from key and iv given, so that ciphers of any key size work with 16 bytes of them
+func newAEAD(cipherName string, key []byte, iv []byte) (cipher.AEAD, error) {
+	var keySize int
+	switch cipherName {
+	case CipherAES128GCM:
+		keySize = 16
+	case CipherChaCha20Poly1305:
+		keySize = chacha20poly1305.KeySize
+	default:
+		return nil, fmt.Errorf("unknown aead cipher: %s", cipherName)
+	}
+
+	derivedKey := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, iv, []byte("masker "+cipherName)), derivedKey); err != nil {
+		return nil, err
+	}
+
+	if cipherName == CipherChaCha20Poly1305 {
+		return chacha20poly1305.New(derivedKey)
+	}
+	block, err := aes.NewCipher(derivedKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// little endian counter, increased after each seal or open
+type chunkNonce []byte
+
+func (nonce chunkNonce) increase() {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+/**
+ * AEADEncryptWriter seals data in chunks, each of them authenticated on its own
+ * - chunk: sealed length (2 bytes, big endian, with tag) | sealed data (with tag)
+ * - length and data take a nonce each, nonces count up from zero, keys are never reused across connections
+ * - data longer than maxChunkDataLen is cut into several chunks
+ *
+ */
+type AEADEncryptWriter struct {
+	aead   cipher.AEAD
+	nonce  chunkNonce
+	writer io.Writer
+	buffer []byte // a sealed chunk, written by one Write
+}
+
+func NewAEADEncryptWriter(writer io.Writer, cipherName string, key []byte, iv []byte) (*AEADEncryptWriter, error) {
+	aead, err := newAEAD(cipherName, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &AEADEncryptWriter{
+		aead:   aead,
+		nonce:  make(chunkNonce, aead.NonceSize()),
+		writer: writer,
+		buffer: make([]byte, 0, chunkLengthLen+maxChunkDataLen+2*aead.Overhead()),
+	}, nil
+}
+
+// implement io.Writer interface
+func (encryptWriter *AEADEncryptWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunkDataLen := len(data)
+		if chunkDataLen > maxChunkDataLen {
+			chunkDataLen = maxChunkDataLen
+		}
+
+		var length [chunkLengthLen]byte
+		binary.BigEndian.PutUint16(length[:], uint16(chunkDataLen))
+		chunk := encryptWriter.seal(encryptWriter.buffer[:0], length[:])
+		chunk = encryptWriter.seal(chunk, data[:chunkDataLen])
+		if _, err := encryptWriter.writer.Write(chunk); err != nil {
+			return written, err
+		}
+		written += chunkDataLen
+		data = data[chunkDataLen:]
+	}
+	return written, nil
+}
+
+func (encryptWriter *AEADEncryptWriter) seal(dst []byte, plaintext []byte) []byte {
+	sealed := encryptWriter.aead.Seal(dst, encryptWriter.nonce, plaintext, nil)
+	encryptWriter.nonce.increase()
+	return sealed
+}
+
+// pass write deadline to the underlying writer, so that timeout works through encryption
+func (encryptWriter *AEADEncryptWriter) SetWriteDeadline(t time.Time) error {
+	if setter, ok := encryptWriter.writer.(writeDeadlineSetter); ok {
+		return setter.SetWriteDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
+/**
+ * AEADDecryptReader opens chunks sealed by AEADEncryptWriter
+ * a chunk failing authentication fails all reads after it with ErrAuthenticationFailed
+ * connection closed inside a chunk is an unexpected EOF
+ *
+ */
+type AEADDecryptReader struct {
+	aead    cipher.AEAD
+	nonce   chunkNonce
+	reader  io.Reader
+	buffer  []byte
+	pending []byte // opened data not read yet, in buffer
+	err     error  // sticky
+}
+
+func NewAEADDecryptReader(reader io.Reader, cipherName string, key []byte, iv []byte) (*AEADDecryptReader, error) {
+	aead, err := newAEAD(cipherName, key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &AEADDecryptReader{
+		aead:   aead,
+		nonce:  make(chunkNonce, aead.NonceSize()),
+		reader: reader,
+		buffer: make([]byte, maxChunkDataLen+aead.Overhead()),
+	}, nil
+}
+
+// implement io.Reader interface
+func (decryptReader *AEADDecryptReader) Read(data []byte) (int, error) {
+	if len(decryptReader.pending) == 0 {
+		if decryptReader.err != nil {
+			return 0, decryptReader.err
+		}
+		if err := decryptReader.readChunk(); err != nil {
+			decryptReader.err = err
+			return 0, err
+		}
+	}
+
+	nBytes := copy(data, decryptReader.pending)
+	decryptReader.pending = decryptReader.pending[nBytes:]
+	return nBytes, nil
+}
+
+func (decryptReader *AEADDecryptReader) readChunk() error {
+	overhead := decryptReader.aead.Overhead()
+
+	sealedLength := decryptReader.buffer[:chunkLengthLen+overhead]
+	if _, err := io.ReadFull(decryptReader.reader, sealedLength); err != nil {
+		return err
+	}
+	length, err := decryptReader.open(sealedLength)
+	if err != nil {
+		return err
+	}
+	chunkDataLen := int(binary.BigEndian.Uint16(length))
+	if chunkDataLen > maxChunkDataLen {
+		return fmt.Errorf("%w: chunk of %d bytes", ErrAuthenticationFailed, chunkDataLen)
+	}
+
+	sealedData := decryptReader.buffer[:chunkDataLen+overhead]
+	if _, err = io.ReadFull(decryptReader.reader, sealedData); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	decryptReader.pending, err = decryptReader.open(sealedData)
+	return err
+}
+
+// open in place
+func (decryptReader *AEADDecryptReader) open(sealed []byte) ([]byte, error) {
+	plaintext, err := decryptReader.aead.Open(sealed[:0], decryptReader.nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	decryptReader.nonce.increase()
+	return plaintext, nil
+}
+
+// pass read deadline to the underlying reader, so that timeout works through decryption
+func (decryptReader *AEADDecryptReader) SetReadDeadline(t time.Time) error {
+	if setter, ok := decryptReader.reader.(readDeadlineSetter); ok {
+		return setter.SetReadDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
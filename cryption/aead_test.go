@@ -0,0 +1,75 @@
+package cryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+var (
+	testKey = []byte("0123456789abcdef")
+	testIV  = []byte("fedcba9876543210")
+)
+
+func TestAEADStream(t *testing.T) {
+	payload := bytes.Repeat([]byte("masker"), maxChunkDataLen/2)
+
+	for _, cipherName := range []string{CipherAES128GCM, CipherChaCha20Poly1305} {
+		var conn bytes.Buffer
+		encryptWriter, err := NewEncryptWriter(cipherName, &conn, testKey, testIV)
+		if err != nil {
+			t.Fatalf("Err in creating %s writer: %v", cipherName, err)
+		}
+		encryptWriter.Write(payload)
+		encryptWriter.Write([]byte("tail"))
+
+		decryptReader, err := NewDecryptReader(cipherName, &conn, testKey, testIV)
+		if err != nil {
+			t.Fatalf("Err in creating %s reader: %v", cipherName, err)
+		}
+		data, err := io.ReadAll(decryptReader)
+		if err != nil {
+			t.Fatalf("Err in reading %s stream: %v", cipherName, err)
+		}
+		if !bytes.Equal(data, append(payload, "tail"...)) {
+			t.Errorf("Read %d bytes of %s stream, want %d bytes", len(data), cipherName, len(payload)+4)
+		}
+	}
+}
+
+func TestAEADStreamTampered(t *testing.T) {
+	var sealed bytes.Buffer
+	encryptWriter, _ := NewAEADEncryptWriter(&sealed, CipherAES128GCM, testKey, testIV)
+	encryptWriter.Write([]byte("first chunk"))
+	encryptWriter.Write([]byte("second chunk"))
+
+	// flip a bit in the second chunk, the first one is still read
+	tampered := sealed.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	decryptReader, _ := NewAEADDecryptReader(bytes.NewReader(tampered), CipherAES128GCM, testKey, testIV)
+	data, err := io.ReadAll(decryptReader)
+	if !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Read tampered stream get %v, want %v", err, ErrAuthenticationFailed)
+	}
+	if string(data) != "first chunk" {
+		t.Errorf("Read %q before the tampered chunk, want %q", data, "first chunk")
+	}
+
+	// chunks reordered
+	var first, second bytes.Buffer
+	encryptWriter, _ = NewAEADEncryptWriter(&first, CipherAES128GCM, testKey, testIV)
+	encryptWriter.Write([]byte("first"))
+	encryptWriter.writer = &second
+	encryptWriter.Write([]byte("second"))
+	decryptReader, _ = NewAEADDecryptReader(io.MultiReader(&second, &first), CipherAES128GCM, testKey, testIV)
+	if _, err = io.ReadAll(decryptReader); !errors.Is(err, ErrAuthenticationFailed) {
+		t.Errorf("Read reordered stream get %v, want %v", err, ErrAuthenticationFailed)
+	}
+
+	// truncated inside a chunk
+	decryptReader, _ = NewAEADDecryptReader(bytes.NewReader(tampered[:len(tampered)-1]), CipherAES128GCM, testKey, testIV)
+	if _, err = io.ReadAll(decryptReader); err != io.ErrUnexpectedEOF {
+		t.Errorf("Read truncated stream get %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
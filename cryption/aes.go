@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"io"
+	"time"
 
 	"masker/log"
 )
@@ -44,6 +45,14 @@ func (encrytWriter *AESEncryptWriter) Write(blocks []byte) (int, error) {
 	return encrytWriter.writer.Write(blocks)
 }
 
+// pass write deadline to the underlying writer, so that timeout works through encryption
+func (encrytWriter *AESEncryptWriter) SetWriteDeadline(t time.Time) error {
+	if setter, ok := encrytWriter.writer.(writeDeadlineSetter); ok {
+		return setter.SetWriteDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
 type AESDecryptReader struct {
 	stream cipher.Stream
 	reader io.Reader
@@ -84,3 +93,11 @@ func (decryptReader *AESDecryptReader) Read(blocks []byte) (int, error) {
 	}
 	return nBytes, err
 }
+
+// pass read deadline to the underlying reader, so that timeout works through decryption
+func (decryptReader *AESDecryptReader) SetReadDeadline(t time.Time) error {
+	if setter, ok := decryptReader.reader.(readDeadlineSetter); ok {
+		return setter.SetReadDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
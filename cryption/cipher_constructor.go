@@ -0,0 +1,45 @@
+package cryption
+
+import (
+	"io"
+)
+
+type AESCFBConstructor struct{}
+
+func (AESCFBConstructor) NewEncryptWriter(writer io.Writer, key []byte, iv []byte) (EncryptWriter, error) {
+	return NewAESEncryptWriter(writer, key, iv)
+}
+
+func (AESCFBConstructor) NewDecryptReader(reader io.Reader, key []byte, iv []byte) (DecryptReader, error) {
+	return NewAESDecryptReader(reader, key, iv)
+}
+
+// Cipher: one of the aead ciphers, see newAEAD
+type AEADConstructor struct {
+	Cipher string
+}
+
+func (constructor AEADConstructor) NewEncryptWriter(writer io.Writer, key []byte, iv []byte) (EncryptWriter, error) {
+	return NewAEADEncryptWriter(writer, constructor.Cipher, key, iv)
+}
+
+func (constructor AEADConstructor) NewDecryptReader(reader io.Reader, key []byte, iv []byte) (DecryptReader, error) {
+	return NewAEADDecryptReader(reader, constructor.Cipher, key, iv)
+}
+
+type NoneConstructor struct{}
+
+func (NoneConstructor) NewEncryptWriter(writer io.Writer, key []byte, iv []byte) (EncryptWriter, error) {
+	return NewPlainWriter(writer), nil
+}
+
+func (NoneConstructor) NewDecryptReader(reader io.Reader, key []byte, iv []byte) (DecryptReader, error) {
+	return NewPlainReader(reader), nil
+}
+
+func init() {
+	RegisterCipherConstructor(CipherAES128CFB, AESCFBConstructor{})
+	RegisterCipherConstructor(CipherAES128GCM, AEADConstructor{CipherAES128GCM})
+	RegisterCipherConstructor(CipherChaCha20Poly1305, AEADConstructor{CipherChaCha20Poly1305})
+	RegisterCipherConstructor(CipherNone, NoneConstructor{})
+}
@@ -0,0 +1,34 @@
+package cryption
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCipherRegistry(t *testing.T) {
+	for _, cipherName := range []string{CipherAES128CFB, CipherAES128GCM, CipherChaCha20Poly1305, CipherNone} {
+		if !HasCipher(cipherName) {
+			t.Fatalf("Cipher %s is not registered", cipherName)
+		}
+
+		var conn bytes.Buffer
+		encryptWriter, err := NewEncryptWriter(cipherName, &conn, testKey, testIV)
+		if err != nil {
+			t.Fatalf("Err in creating %s writer: %v", cipherName, err)
+		}
+		encryptWriter.Write([]byte("masker"))
+
+		decryptReader, err := NewDecryptReader(cipherName, &conn, testKey, testIV)
+		if err != nil {
+			t.Fatalf("Err in creating %s reader: %v", cipherName, err)
+		}
+		if data, _ := io.ReadAll(decryptReader); string(data) != "masker" {
+			t.Errorf("Read %q with cipher %s, want %q", data, cipherName, "masker")
+		}
+	}
+
+	if _, err := NewEncryptWriter("rot13", io.Discard, testKey, testIV); err == nil {
+		t.Errorf("Unknown cipher should fail")
+	}
+}
@@ -1,11 +1,82 @@
 package cryption
 
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+var (
+	ErrDeadlineNotSupported = errors.New("deadline is not supported by the underlying reader or writer")
+)
+
+type readDeadlineSetter interface {
+	SetReadDeadline(time.Time) error
+}
+
+type writeDeadlineSetter interface {
+	SetWriteDeadline(time.Time) error
+}
+
 type DecryptReader interface {
-	Decrypt([]byte)
 	Read([]byte) (int, error)
+	SetReadDeadline(time.Time) error
 }
 
 type EncryptWriter interface {
-	Encrypt([]byte)
 	Write([]byte) (int, error)
+	SetWriteDeadline(time.Time) error
+}
+
+// ciphers of data stream, key and iv are 16 bytes for all of them
+const (
+	CipherAES128CFB        = "aes-128-cfb" // no authentication, kept for old nodes
+	CipherAES128GCM        = "aes-128-gcm"
+	CipherChaCha20Poly1305 = "chacha20-poly1305"
+	CipherNone             = "none" // no encryption
+)
+
+// both ends of a cipher, see cipher_constructor.go
+type CipherConstructor interface {
+	NewEncryptWriter(writer io.Writer, key []byte, iv []byte) (EncryptWriter, error)
+	NewDecryptReader(reader io.Reader, key []byte, iv []byte) (DecryptReader, error)
+}
+
+var cipherConstructorSet = make(map[string]CipherConstructor)
+
+func RegisterCipherConstructor(name string, constructor CipherConstructor) {
+	cipherConstructorSet[name] = constructor
+}
+
+func HasCipher(name string) bool {
+	_, ok := cipherConstructorSet[name]
+	return ok
+}
+
+// names of ciphers registered, sorted
+func CipherNames() []string {
+	names := make([]string, 0, len(cipherConstructorSet))
+	for name := range cipherConstructorSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func NewEncryptWriter(cipherName string, writer io.Writer, key []byte, iv []byte) (EncryptWriter, error) {
+	constructor, ok := cipherConstructorSet[cipherName]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher: %s", cipherName)
+	}
+	return constructor.NewEncryptWriter(writer, key, iv)
+}
+
+func NewDecryptReader(cipherName string, reader io.Reader, key []byte, iv []byte) (DecryptReader, error) {
+	constructor, ok := cipherConstructorSet[cipherName]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher: %s", cipherName)
+	}
+	return constructor.NewDecryptReader(reader, key, iv)
 }
@@ -3,12 +3,27 @@ package cryption
 import (
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"hash"
 )
 
+// hashes of HMAC-SHA256 are cut to the length of md5, so that both fit in the same place of handshake
+const TimeHMACSHA256Len = md5.Size
+
+// HMAC-MD5 of time, for legacy handshake
 func TimeHMACHash(key []byte, timeSec int64) []byte {
 	return HMACHash(key, int64ToByteSlice(timeSec))
 }
 
+// HMAC-SHA256 of time cut to TimeHMACSHA256Len
+func TimeHMACSHA256Hash(key []byte, timeSec int64) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(int64ToByteSlice(timeSec))
+	return hash.Sum(nil)[:TimeHMACSHA256Len]
+}
+
 func HMACHash(key, data []byte) []byte {
 	hash := hmac.New(md5.New, key)
 	hash.Write(data)
@@ -37,3 +52,94 @@ func Int64Hash(value int64) []byte {
 	md5hash.Write(buffer)
 	return md5hash.Sum(nil)
 }
+
+/**
+ * TimeHMACKey keeps hash states of a key after its inner and outer pads,
+ * so that TimeHMACHasher hashes time with it at the cost of two blocks, instead of four
+ * it is read only, and shared by goroutines
+ *
+ */
+type TimeHMACKey struct {
+	inner []byte // marshaled hash state
+	outer []byte
+}
+
+// key of HMAC-MD5, for hashers of NewTimeHMACHasher
+func NewTimeHMACKey(key []byte) *TimeHMACKey {
+	return newTimeHMACKey(md5.New, key)
+}
+
+// key of HMAC-SHA256, for hashers of NewTimeHMACSHA256Hasher
+func NewTimeHMACSHA256Key(key []byte) *TimeHMACKey {
+	return newTimeHMACKey(sha256.New, key)
+}
+
+func newTimeHMACKey(newHash func() hash.Hash, key []byte) *TimeHMACKey {
+	blockSize := newHash().BlockSize()
+	if len(key) > blockSize {
+		digest := newHash()
+		digest.Write(key)
+		key = digest.Sum(nil)
+	}
+	innerPad := make([]byte, blockSize)
+	outerPad := make([]byte, blockSize)
+	copy(innerPad, key)
+	copy(outerPad, key)
+	for i := range innerPad {
+		innerPad[i] ^= 0x36
+		outerPad[i] ^= 0x5c
+	}
+
+	marshal := func(pad []byte) []byte {
+		digest := newHash()
+		digest.Write(pad)
+		state, _ := digest.(encoding.BinaryMarshaler).MarshalBinary()
+		return state
+	}
+	return &TimeHMACKey{
+		inner: marshal(innerPad),
+		outer: marshal(outerPad),
+	}
+}
+
+// TimeHMACHasher gives the same hash as TimeHMACHash or TimeHMACSHA256Hash, it is not safe for concurrent use
+// keys must be made for the same hash as the hasher
+type TimeHMACHasher struct {
+	digest hash.Hash
+	size   int // of hash returned
+	input  [8]byte
+	inner  []byte
+	sum    []byte
+}
+
+func NewTimeHMACHasher() *TimeHMACHasher {
+	return newTimeHMACHasher(md5.New(), md5.Size)
+}
+
+func NewTimeHMACSHA256Hasher() *TimeHMACHasher {
+	return newTimeHMACHasher(sha256.New(), TimeHMACSHA256Len)
+}
+
+func newTimeHMACHasher(digest hash.Hash, size int) *TimeHMACHasher {
+	return &TimeHMACHasher{
+		digest: digest,
+		size:   size,
+		inner:  make([]byte, 0, digest.Size()),
+		sum:    make([]byte, 0, digest.Size()),
+	}
+}
+
+// the hash returned is overwritten by the next call
+func (hasher *TimeHMACHasher) Hash(key *TimeHMACKey, timeSec int64) []byte {
+	binary.BigEndian.PutUint64(hasher.input[:], uint64(timeSec))
+	unmarshaler := hasher.digest.(encoding.BinaryUnmarshaler)
+
+	unmarshaler.UnmarshalBinary(key.inner)
+	hasher.digest.Write(hasher.input[:])
+	hasher.inner = hasher.digest.Sum(hasher.inner[:0])
+
+	unmarshaler.UnmarshalBinary(key.outer)
+	hasher.digest.Write(hasher.inner)
+	hasher.sum = hasher.digest.Sum(hasher.sum[:0])
+	return hasher.sum[:hasher.size]
+}
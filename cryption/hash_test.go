@@ -0,0 +1,24 @@
+package cryption
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTimeHMACHasher(t *testing.T) {
+	key := []byte("a90779d4-f0e8-456a-8a12-a84387c58b4d")
+	md5Key, sha256Key := NewTimeHMACKey(key), NewTimeHMACSHA256Key(key)
+	md5Hasher, sha256Hasher := NewTimeHMACHasher(), NewTimeHMACSHA256Hasher()
+
+	for _, timeSec := range []int64{0, 1646870400, 1646870401} {
+		if got, want := md5Hasher.Hash(md5Key, timeSec), TimeHMACHash(key, timeSec); !bytes.Equal(got, want) {
+			t.Errorf("Md5 hasher gives %x for %d, want %x", got, timeSec, want)
+		}
+		if got, want := sha256Hasher.Hash(sha256Key, timeSec), TimeHMACSHA256Hash(key, timeSec); !bytes.Equal(got, want) {
+			t.Errorf("Sha256 hasher gives %x for %d, want %x", got, timeSec, want)
+		}
+	}
+	if hash := TimeHMACSHA256Hash(key, 0); len(hash) != TimeHMACSHA256Len || bytes.Equal(hash, TimeHMACHash(key, 0)) {
+		t.Errorf("Unexpected sha256 hash %x", hash)
+	}
+}
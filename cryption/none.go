@@ -0,0 +1,54 @@
+package cryption
+
+import (
+	"io"
+	"time"
+)
+
+// PlainWriter writes data as it is, for cipher none
+type PlainWriter struct {
+	writer io.Writer
+}
+
+func NewPlainWriter(writer io.Writer) *PlainWriter {
+	return &PlainWriter{
+		writer: writer,
+	}
+}
+
+// implement io.Writer interface
+func (plainWriter *PlainWriter) Write(data []byte) (int, error) {
+	return plainWriter.writer.Write(data)
+}
+
+// pass write deadline to the underlying writer
+func (plainWriter *PlainWriter) SetWriteDeadline(t time.Time) error {
+	if setter, ok := plainWriter.writer.(writeDeadlineSetter); ok {
+		return setter.SetWriteDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
+
+// PlainReader reads data as it is, for cipher none
+type PlainReader struct {
+	reader io.Reader
+}
+
+func NewPlainReader(reader io.Reader) *PlainReader {
+	return &PlainReader{
+		reader: reader,
+	}
+}
+
+// implement io.Reader interface
+func (plainReader *PlainReader) Read(data []byte) (int, error) {
+	return plainReader.reader.Read(data)
+}
+
+// pass read deadline to the underlying reader
+func (plainReader *PlainReader) SetReadDeadline(t time.Time) error {
+	if setter, ok := plainReader.reader.(readDeadlineSetter); ok {
+		return setter.SetReadDeadline(t)
+	}
+	return ErrDeadlineNotSupported
+}
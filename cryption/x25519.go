@@ -0,0 +1,34 @@
+package cryption
+
+import (
+	"crypto/rand"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const X25519KeyLen = curve25519.PointSize
+
+// X25519Key is an ephemeral key pair, used for one key exchange then dropped
+type X25519Key struct {
+	private [X25519KeyLen]byte
+	Public  [X25519KeyLen]byte
+}
+
+func NewX25519Key() (*X25519Key, error) {
+	key := new(X25519Key)
+	if _, err := rand.Read(key.private[:]); err != nil {
+		return nil, err
+	}
+
+	public, err := curve25519.X25519(key.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(key.Public[:], public)
+	return key, nil
+}
+
+// shared secret with the public key of the other side, error if the public key is of low order
+func (key *X25519Key) SharedKey(peerPublic []byte) ([]byte, error) {
+	return curve25519.X25519(key.private[:], peerPublic)
+}
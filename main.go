@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"masker/admin"
 	"masker/core"
 	"masker/log"
+	"masker/metrics"
 
 	_ "masker/proxy/identical"
 	_ "masker/proxy/masker"
@@ -12,16 +19,21 @@ import (
 )
 
 var (
-	configFile string
-	logLevel   string
+	configFile      string
+	logLevel        string
+	shutdownTimeout time.Duration
 )
 
 func init() {
 	flag.StringVar(&configFile, "config_file", "server_config.json", "Node config file.")
 	flag.StringVar(&logLevel, "log_level", "info", "Level of log info to be printed to console, available value: debug, info, warning, error.")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", 30*time.Second, "Time to wait for in-flight connections when stopping.")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "traffic" {
+		os.Exit(runTrafficCommand(os.Args[2:]))
+	}
 	flag.Parse()
 
 	switch logLevel {
@@ -53,6 +65,64 @@ func main() {
 	}
 	log.Info("Node starting...")
 
-	exit := make(chan bool)
-	<-exit
+	if config.Admin.Listen != "" {
+		adminServer := admin.NewServer(node, config.Admin.Token, func() error {
+			return reloadConfig(node)
+		})
+		err = adminServer.Listen(config.Admin.Listen)
+		if err != nil {
+			panic(log.Error("Err in starting admin api: %v.", err))
+		}
+		defer adminServer.Close()
+	}
+
+	if config.Metrics.Listen != "" {
+		metricsServer, err := metrics.Listen(config.Metrics.Listen)
+		if err != nil {
+			panic(log.Error("Err in starting metrics: %v.", err))
+		}
+		defer metricsServer.Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Info("Receive signal %v, stopping node...", sig)
+			break
+		}
+
+		log.Info("Receive signal %v, reloading config...", sig)
+		reloadConfig(node)
+	}
+
+	// a second signal stops waiting for connections
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	err = node.Stop(ctx)
+	if err != nil {
+		log.Warning("Node stopped before all connections finish: %v.", err)
+	} else {
+		log.Info("Node stopped.")
+	}
+}
+
+// a broken config is reported and ignored, node keeps running with what has been applied
+func reloadConfig(node *core.Node) error {
+	config, err := core.LoadConfig(configFile)
+	if err != nil {
+		return log.Error("Err in reloading config: %v.", err)
+	}
+
+	err = node.Reload(config)
+	if err != nil {
+		return log.Error("Err in applying reloaded config: %v.", err)
+	}
+	log.Info("Succeed reloading config.")
+	return nil
 }
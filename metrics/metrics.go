@@ -0,0 +1,319 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"masker/log"
+)
+
+// Counter only goes up, the zero value is ready to use
+type Counter struct {
+	value uint64
+}
+
+func (counter *Counter) Add(n uint64) {
+	atomic.AddUint64(&counter.value, n)
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Value() uint64 {
+	return atomic.LoadUint64(&counter.value)
+}
+
+// Gauge goes up and down, the zero value is ready to use
+type Gauge struct {
+	value int64
+}
+
+func (gauge *Gauge) Add(n int64) {
+	atomic.AddInt64(&gauge.value, n)
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.Add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.Add(-1)
+}
+
+func (gauge *Gauge) Value() int64 {
+	return atomic.LoadInt64(&gauge.value)
+}
+
+// Histogram counts observations in buckets of upper bounds
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // counts[i] for upperBounds[i], the last one for +Inf
+	count       uint64
+	sumBits     uint64 // float64 bits of sum
+}
+
+func newHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	index := sort.SearchFloat64s(histogram.upperBounds, value)
+	atomic.AddUint64(&histogram.counts[index], 1)
+	atomic.AddUint64(&histogram.count, 1)
+	for {
+		oldBits := atomic.LoadUint64(&histogram.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + value)
+		if atomic.CompareAndSwapUint64(&histogram.sumBits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+/**
+ * a vector holds one child for each combination of label values
+ * children are created on first use and never removed
+ *
+ */
+type vector struct {
+	name       string
+	help       string
+	kind       string // counter, gauge or histogram
+	labelNames []string
+
+	mutex    sync.RWMutex
+	children map[string]*child // key: label values joined
+}
+
+type child struct {
+	labelValues []string
+	metric      interface{} // *Counter, *Gauge or *Histogram
+}
+
+func newVector(name string, help string, kind string, labelNames []string) *vector {
+	return &vector{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		children:   make(map[string]*child),
+	}
+}
+
+func (vec *vector) get(labelValues []string, create func() interface{}) interface{} {
+	if len(labelValues) != len(vec.labelNames) {
+		panic(fmt.Sprintf("metric %s wants %d label values, get %d", vec.name, len(vec.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	vec.mutex.RLock()
+	c, ok := vec.children[key]
+	vec.mutex.RUnlock()
+	if ok {
+		return c.metric
+	}
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	if c, ok = vec.children[key]; !ok {
+		c = &child{
+			labelValues: append([]string(nil), labelValues...),
+			metric:      create(),
+		}
+		vec.children[key] = c
+	}
+	return c.metric
+}
+
+type CounterVec struct {
+	*vector
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	vec := &CounterVec{newVector(name, help, "counter", labelNames)}
+	defaultRegistry.register(vec.vector)
+	return vec
+}
+
+func (vec *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return vec.get(labelValues, func() interface{} { return new(Counter) }).(*Counter)
+}
+
+type GaugeVec struct {
+	*vector
+}
+
+func NewGaugeVec(name string, help string, labelNames ...string) *GaugeVec {
+	vec := &GaugeVec{newVector(name, help, "gauge", labelNames)}
+	defaultRegistry.register(vec.vector)
+	return vec
+}
+
+func (vec *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return vec.get(labelValues, func() interface{} { return new(Gauge) }).(*Gauge)
+}
+
+type HistogramVec struct {
+	*vector
+	upperBounds []float64
+}
+
+// upperBounds: in increasing order, +Inf is added implicitly
+func NewHistogramVec(name string, help string, upperBounds []float64, labelNames ...string) *HistogramVec {
+	vec := &HistogramVec{newVector(name, help, "histogram", labelNames), upperBounds}
+	defaultRegistry.register(vec.vector)
+	return vec
+}
+
+func (vec *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return vec.get(labelValues, func() interface{} { return newHistogram(vec.upperBounds) }).(*Histogram)
+}
+
+type registry struct {
+	mutex   sync.Mutex
+	vectors map[string]*vector
+}
+
+var defaultRegistry = &registry{
+	vectors: make(map[string]*vector),
+}
+
+// metric names are unique, registering one twice is a bug
+func (reg *registry) register(vec *vector) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.vectors[vec.name]; ok {
+		panic("duplicated metric " + vec.name)
+	}
+	reg.vectors[vec.name] = vec
+}
+
+// write all metrics in prometheus text format, sorted by name
+func WriteText(writer io.Writer) error {
+	defaultRegistry.mutex.Lock()
+	vectors := make([]*vector, 0, len(defaultRegistry.vectors))
+	for _, vec := range defaultRegistry.vectors {
+		vectors = append(vectors, vec)
+	}
+	defaultRegistry.mutex.Unlock()
+	sort.Slice(vectors, func(i, j int) bool {
+		return vectors[i].name < vectors[j].name
+	})
+
+	var builder strings.Builder
+	for _, vec := range vectors {
+		vec.writeText(&builder)
+	}
+	_, err := io.WriteString(writer, builder.String())
+	return err
+}
+
+// serve metrics at /metrics on address, until the returned server is closed
+func Listen(address string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Metrics listening on %v...", ln.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Err in serving metrics: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// serve metrics to prometheus
+func Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(writer)
+	})
+}
+
+func (vec *vector) writeText(builder *strings.Builder) {
+	fmt.Fprintf(builder, "# HELP %s %s\n", vec.name, vec.help)
+	fmt.Fprintf(builder, "# TYPE %s %s\n", vec.name, vec.kind)
+
+	vec.mutex.RLock()
+	children := make([]*child, 0, len(vec.children))
+	for _, c := range vec.children {
+		children = append(children, c)
+	}
+	vec.mutex.RUnlock()
+	sort.Slice(children, func(i, j int) bool {
+		return strings.Join(children[i].labelValues, "\xff") < strings.Join(children[j].labelValues, "\xff")
+	})
+
+	for _, c := range children {
+		labels := formatLabels(vec.labelNames, c.labelValues)
+		switch metric := c.metric.(type) {
+		case *Counter:
+			fmt.Fprintf(builder, "%s%s %d\n", vec.name, wrapLabels(labels), metric.Value())
+		case *Gauge:
+			fmt.Fprintf(builder, "%s%s %d\n", vec.name, wrapLabels(labels), metric.Value())
+		case *Histogram:
+			writeHistogram(builder, vec.name, labels, metric)
+		}
+	}
+}
+
+func writeHistogram(builder *strings.Builder, name string, labels string, histogram *Histogram) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+
+	cumulative := uint64(0)
+	for i, upperBound := range histogram.upperBounds {
+		cumulative += atomic.LoadUint64(&histogram.counts[i])
+		fmt.Fprintf(builder, "%s_bucket{%s%sle=\"%s\"} %d\n",
+			name, labels, separator, strconv.FormatFloat(upperBound, 'g', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&histogram.counts[len(histogram.upperBounds)])
+	fmt.Fprintf(builder, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, cumulative)
+
+	sum := math.Float64frombits(atomic.LoadUint64(&histogram.sumBits))
+	fmt.Fprintf(builder, "%s_sum%s %s\n", name, wrapLabels(labels), strconv.FormatFloat(sum, 'g', -1, 64))
+	fmt.Fprintf(builder, "%s_count%s %d\n", name, wrapLabels(labels), atomic.LoadUint64(&histogram.count))
+}
+
+// like `a="1",b="2"`
+func formatLabels(labelNames []string, labelValues []string) string {
+	pairs := make([]string, 0, len(labelNames))
+	for i, labelName := range labelNames {
+		pairs = append(pairs, labelName+"=\""+escapeLabelValue(labelValues[i])+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
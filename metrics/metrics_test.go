@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Requests handled.", "path")
+	requests.WithLabelValues("/a").Inc()
+	requests.WithLabelValues("/a").Add(2)
+	requests.WithLabelValues(`say "hi"`).Inc()
+
+	active := NewGaugeVec("test_active", "Active things.")
+	active.WithLabelValues().Inc()
+	active.WithLabelValues().Inc()
+	active.WithLabelValues().Dec()
+
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "result")
+	latency.WithLabelValues("ok").Observe(0.05)
+	latency.WithLabelValues("ok").Observe(0.1)
+	latency.WithLabelValues("ok").Observe(5)
+
+	var builder strings.Builder
+	if err := WriteText(&builder); err != nil {
+		t.Fatalf("Err in writing metrics: %v", err)
+	}
+	text := builder.String()
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{path="/a"} 3`,
+		`test_requests_total{path="say \"hi\""} 1`,
+		"# TYPE test_active gauge",
+		"test_active 1",
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{result="ok",le="0.1"} 2`,
+		`test_latency_seconds_bucket{result="ok",le="1"} 2`,
+		`test_latency_seconds_bucket{result="ok",le="+Inf"} 3`,
+		`test_latency_seconds_sum{result="ok"} 5.15`,
+		`test_latency_seconds_count{result="ok"} 3`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics text has no line %q:\n%s", line, text)
+		}
+	}
+
+	// metrics are sorted by name
+	if strings.Index(text, "test_active") > strings.Index(text, "test_latency_seconds") {
+		t.Errorf("Metrics are not sorted by name:\n%s", text)
+	}
+}
+
+func TestDuplicatedMetric(t *testing.T) {
+	NewCounterVec("test_duplicated_total", "Duplicated.")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a metric twice should panic")
+		}
+	}()
+	NewGaugeVec("test_duplicated_total", "Duplicated.")
+}
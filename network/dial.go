@@ -0,0 +1,77 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// reasons of dial failure that proxy protocols are able to report to clients
+var (
+	ErrConnectionRefused    = errors.New("connection refused")
+	ErrHostUnreachable      = errors.New("host unreachable")
+	ErrNetworkUnreachable   = errors.New("network unreachable")
+	ErrDialTimeout          = errors.New("dial timeout")
+	ErrConnectionNotAllowed = errors.New("connection not allowed")
+)
+
+// wrap err with the reason it belongs to, so that errors.Is works on it
+// err is returned as it is if the reason is unknown
+func ClassifyDialError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var reason error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrConnectionRefused), errors.Is(err, ErrHostUnreachable), errors.Is(err, ErrNetworkUnreachable),
+		errors.Is(err, ErrDialTimeout), errors.Is(err, ErrConnectionNotAllowed):
+		return err
+	case errors.Is(err, syscall.ECONNREFUSED):
+		reason = ErrConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		reason = ErrHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		reason = ErrNetworkUnreachable
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		reason = ErrConnectionNotAllowed
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		reason = ErrDialTimeout
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %v", reason, err)
+}
+
+/**
+ * Make blocking io on conn follow ctx until stop is called
+ * deadline of ctx becomes deadline of conn, and cancelling ctx interrupts io at once
+ *
+ */
+func BindContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,37 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClassifyDialError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in reserving a port: %v", err)
+	}
+	closedAddress := ln.Addr().String()
+	ln.Close()
+
+	_, err = net.Dial("tcp", closedAddress)
+	if err = ClassifyDialError(err); !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("Dialing a closed port, want %v but get %v", ErrConnectionRefused, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	var dialer net.Dialer
+	_, err = dialer.DialContext(ctx, "tcp", closedAddress)
+	if err = ClassifyDialError(err); !errors.Is(err, ErrDialTimeout) {
+		t.Errorf("Dialing with an expired context, want %v but get %v", ErrDialTimeout, err)
+	}
+
+	unknownErr := errors.New("unknown")
+	if ClassifyDialError(unknownErr) != unknownErr {
+		t.Errorf("Unknown error should be returned as it is")
+	}
+}
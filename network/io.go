@@ -1,11 +1,106 @@
 package network
 
 import (
+	"context"
 	"io"
+	"sync"
 )
 
-func CloseConnection(closer io.Closer, readFinish <-chan bool, writeFinish <-chan bool) {
-	<-readFinish
-	<-writeFinish
+// close closer after both directions finish, or at once when cut is closed
+// return only after both directions finish
+func CloseConnection(closer io.Closer, readFinish <-chan bool, writeFinish <-chan bool, cut <-chan struct{}) {
+	for readFinish != nil || writeFinish != nil {
+		select {
+		case <-readFinish:
+			readFinish = nil
+		case <-writeFinish:
+			writeFinish = nil
+		case <-cut:
+			closer.Close()
+			cut = nil
+		}
+	}
 	closer.Close()
 }
+
+// ConnectionSet keeps track of live connections, so that they can be waited for or closed together
+type ConnectionSet struct {
+	mutex       sync.Mutex
+	connections map[io.Closer]bool
+	closed      bool
+	waitGroup   sync.WaitGroup
+}
+
+func NewConnectionSet() *ConnectionSet {
+	return &ConnectionSet{
+		connections: make(map[io.Closer]bool),
+	}
+}
+
+// return false if the set has been closed, the connection is not added then
+func (set *ConnectionSet) Add(conn io.Closer) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.closed {
+		return false
+	}
+	set.connections[conn] = true
+	set.waitGroup.Add(1)
+	return true
+}
+
+func (set *ConnectionSet) Remove(conn io.Closer) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	if set.connections[conn] {
+		delete(set.connections, conn)
+		set.waitGroup.Done()
+	}
+}
+
+func (set *ConnectionSet) Len() int {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	return len(set.connections)
+}
+
+// stop accepting new connections, live connections are not affected
+func (set *ConnectionSet) Close() {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	set.closed = true
+}
+
+// wait until all connections are removed or ctx is done
+func (set *ConnectionSet) Wait(ctx context.Context) error {
+	drained := make(chan bool)
+	go func() {
+		set.waitGroup.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close every live connection, they are removed by their owners as usual
+func (set *ConnectionSet) CloseAll() {
+	set.mutex.Lock()
+	connections := make([]io.Closer, 0, len(set.connections))
+	for conn := range set.connections {
+		connections = append(connections, conn)
+	}
+	set.mutex.Unlock()
+
+	for _, conn := range connections {
+		conn.Close()
+	}
+}
@@ -0,0 +1,75 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	closed bool
+}
+
+func (conn *fakeConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+func TestConnectionSet(t *testing.T) {
+	set := NewConnectionSet()
+	connA, connB := &fakeConn{}, &fakeConn{}
+	if !set.Add(connA) || !set.Add(connB) {
+		t.Fatalf("Connection is denied by an open set")
+	}
+
+	set.Close()
+	if set.Add(&fakeConn{}) {
+		t.Errorf("Connection is accepted by a closed set")
+	}
+
+	set.Remove(connA)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := set.Wait(ctx); err == nil {
+		t.Errorf("Wait returns before all connections are removed")
+	}
+
+	set.CloseAll()
+	if connA.closed || !connB.closed {
+		t.Errorf("CloseAll should close live connections only, closed: %v, %v", connA.closed, connB.closed)
+	}
+
+	set.Remove(connB)
+	if err := set.Wait(context.Background()); err != nil {
+		t.Errorf("Err in waiting for an empty set: %v", err)
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	conn := &fakeConn{}
+	readFinish, writeFinish := make(chan bool, 1), make(chan bool, 1)
+	cut := make(chan struct{})
+	returned := make(chan bool)
+	go func() {
+		CloseConnection(conn, readFinish, writeFinish, cut)
+		close(returned)
+	}()
+
+	readFinish <- true
+	close(cut)
+	select {
+	case <-returned:
+		t.Fatalf("CloseConnection returns before write finishes")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	writeFinish <- true
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("CloseConnection does not return after both directions finish")
+	}
+	if !conn.closed {
+		t.Errorf("Connection should be closed")
+	}
+}
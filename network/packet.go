@@ -0,0 +1,108 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	packetHeaderLen = 2
+	maxPacketLen    = 0xFFFF
+)
+
+// how long a udp session lives without any datagram, like a mapping of NAT
+const UDPIdleTimeout = 60 * time.Second
+
+/**
+ * PacketStream carries datagrams of a udp conn as a byte stream, so that they go through channels and mask streams
+ * - frame: datagram length (2 bytes, big endian) | datagram
+ * - Read gives frames of datagrams received, Write sends a datagram for each frame written
+ * - Read returns io.EOF once no datagram is sent or received within idleTimeout
+ * - port unreachable reported back for a datagram does not end the stream, like a mapping of NAT
+ *
+ */
+type PacketStream struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	lastActive  int64 // unix nano, of the last datagram sent or received
+
+	readBuffer  []byte
+	pending     []byte // frame not read yet, in readBuffer
+	writeBuffer []byte // frames not complete yet
+}
+
+func NewPacketStream(conn net.Conn, idleTimeout time.Duration) *PacketStream {
+	stream := &PacketStream{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		readBuffer:  make([]byte, packetHeaderLen+maxPacketLen),
+	}
+	stream.touch()
+	return stream
+}
+
+func (stream *PacketStream) touch() {
+	atomic.StoreInt64(&stream.lastActive, time.Now().UnixNano())
+}
+
+func (stream *PacketStream) idleUntil() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&stream.lastActive)).Add(stream.idleTimeout)
+}
+
+// implement io.Reader interface
+func (stream *PacketStream) Read(data []byte) (int, error) {
+	for len(stream.pending) == 0 {
+		deadline := stream.idleUntil()
+		if !time.Now().Before(deadline) {
+			return 0, io.EOF
+		}
+		stream.conn.SetReadDeadline(deadline)
+
+		nBytes, err := stream.conn.Read(stream.readBuffer[packetHeaderLen:])
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// datagrams sent meanwhile keep it alive
+			continue
+		} else if errors.Is(err, syscall.ECONNREFUSED) {
+			// the peer may come back, or the idle timeout ends the stream
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		stream.touch()
+		binary.BigEndian.PutUint16(stream.readBuffer, uint16(nBytes))
+		stream.pending = stream.readBuffer[:packetHeaderLen+nBytes]
+	}
+
+	nBytes := copy(data, stream.pending)
+	stream.pending = stream.pending[nBytes:]
+	return nBytes, nil
+}
+
+// implement io.Writer interface, frames may be split across writes
+func (stream *PacketStream) Write(data []byte) (int, error) {
+	stream.writeBuffer = append(stream.writeBuffer, data...)
+
+	frames := stream.writeBuffer
+	for len(frames) >= packetHeaderLen {
+		frameLen := packetHeaderLen + int(binary.BigEndian.Uint16(frames))
+		if len(frames) < frameLen {
+			break
+		}
+		_, err := stream.conn.Write(frames[packetHeaderLen:frameLen])
+		if err != nil && !errors.Is(err, syscall.ECONNREFUSED) {
+			return 0, err
+		}
+		stream.touch()
+		frames = frames[frameLen:]
+	}
+
+	// keep what is left at the beginning, so that the buffer does not grow
+	stream.writeBuffer = stream.writeBuffer[:copy(stream.writeBuffer, frames)]
+	return len(data), nil
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echo datagrams back until closed
+func startUDPEcho(t *testing.T) net.PacketConn {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in listening udp: %v", err)
+	}
+	go func() {
+		buffer := make([]byte, maxPacketLen)
+		for {
+			nBytes, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buffer[:nBytes], addr)
+		}
+	}()
+	return server
+}
+
+func TestPacketStream(t *testing.T) {
+	server := startUDPEcho(t)
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Err in dialing udp: %v", err)
+	}
+	defer conn.Close()
+	stream := NewPacketStream(conn, 200*time.Millisecond)
+
+	// two frames, split in the middle of the second one
+	frames := []byte{0, 3, 'd', 'n', 's', 0, 4, 'q', 'u'}
+	stream.Write(frames)
+	stream.Write([]byte{'i', 'c'})
+
+	echo := make([]byte, 11)
+	if _, err = io.ReadFull(stream, echo); err != nil {
+		t.Fatalf("Err in reading echo: %v", err)
+	}
+	if want := []byte{0, 3, 'd', 'n', 's', 0, 4, 'q', 'u', 'i', 'c'}; !bytes.Equal(echo, want) {
+		t.Errorf("Read %v, want %v", echo, want)
+	}
+
+	// nothing more, the session expires
+	startTime := time.Now()
+	if _, err = stream.Read(echo); err != io.EOF {
+		t.Errorf("Read an idle stream get %v, want %v", err, io.EOF)
+	}
+	if idle := time.Since(startTime); idle < 100*time.Millisecond {
+		t.Errorf("Stream expires after %v idle, want 200ms", idle)
+	}
+}
+
+// nobody listens on the port, the stream lives on until idle
+func TestPacketStreamUnreachable(t *testing.T) {
+	server := startUDPEcho(t)
+	address := server.LocalAddr().String()
+	server.Close()
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatalf("Err in dialing udp: %v", err)
+	}
+	defer conn.Close()
+	stream := NewPacketStream(conn, 200*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		if _, err = stream.Write([]byte{0, 3, 'd', 'n', 's'}); err != nil {
+			t.Fatalf("Err in writing to an unreachable port: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err = stream.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("Read an unreachable stream get %v, want %v", err, io.EOF)
+	}
+}
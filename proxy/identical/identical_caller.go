@@ -1,7 +1,10 @@
 package identical
 
 import (
+	"context"
+	"io"
 	"net"
+	"time"
 
 	"masker/core"
 	"masker/log"
@@ -9,31 +12,69 @@ import (
 )
 
 type IdenticalCaller struct {
-	configFile string
+	configFile  string
+	connections *network.ConnectionSet // connections to destinations
 }
 
 func NewIdenticalCaller(configFile string) (*IdenticalCaller, error) {
 	return &IdenticalCaller{
-		configFile: configFile,
+		configFile:  configFile,
+		connections: network.NewConnectionSet(),
 	}, nil
 }
 
-func (caller *IdenticalCaller) Call(channel core.FullDuplexChannel, dest network.Destination) error {
-	conn, err := net.Dial(dest.Network(), dest.String())
+func (caller *IdenticalCaller) Call(ctx context.Context, session *core.Session, channel core.FullDuplexChannel) error {
+	dest := session.Destination
+	startTime := time.Now()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, dest.Network(), dest.String())
+	err = network.ClassifyDialError(err)
+	core.ObserveDial(session.OutboundTag, time.Since(startTime), err)
 	if err != nil {
 		log.Error("Err in opening %s connection: %v.", dest.Network(), err)
 		return err
 	}
-	log.Info("Connecting to %s succeed.", dest.String())
+	if !caller.connections.Add(conn) {
+		conn.Close()
+		return log.Error("Caller is closed, drop connection to %s.", dest.String())
+	}
+	log.Info("Session %v: connecting to %s succeed.", session, dest.String())
+
+	// datagrams of udp go through channel in frames
+	var stream io.ReadWriter = conn
+	if dest.IsUDP() {
+		stream = network.NewPacketStream(conn, network.UDPIdleTimeout)
+	}
 
 	// read request from channel and write in conn
 	writeFinish := make(chan bool, 1)
-	go channel.ForwardChannel.Output(conn, writeFinish)
+	go channel.ForwardChannel.Output(stream, writeFinish)
 
 	// read response from conn and write in channel
 	readFinish := make(chan bool, 1)
-	go channel.BackwardChannel.Input(conn, readFinish)
+	go func() {
+		channel.BackwardChannel.Input(stream, readFinish)
+		// udp has no end of stream, being idle ends the whole session
+		if dest.IsUDP() {
+			channel.Close()
+		}
+	}()
+
+	go func() {
+		network.CloseConnection(conn, readFinish, writeFinish, channel.Done())
+		caller.connections.Remove(conn)
+	}()
+	return nil
+}
+
+// identical caller has nothing to configure
+func (caller *IdenticalCaller) Reload(configFile string) error {
+	caller.configFile = configFile
+	return nil
+}
 
-	go network.CloseConnection(conn, readFinish, writeFinish)
+func (caller *IdenticalCaller) Close() error {
+	caller.connections.Close()
+	caller.connections.CloseAll()
 	return nil
 }
@@ -0,0 +1,208 @@
+package masker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"masker/network"
+)
+
+// strategies of picking a next node for a call, set by "strategy" of mask_caller.json
+const (
+	strategyRandom         = "random" // default
+	strategyRoundRobin     = "round-robin"
+	strategyWeighted       = "weighted"
+	strategyLeastActive    = "least-active-connections"
+	strategyLowestLatency  = "lowest-latency"
+	strategyConsistentHash = "consistent-hash"
+)
+
+// points of a node on the ring of consistent hashing, for each of its weight
+const ringPointsPerWeight = 64
+
+/**
+ * balancer picks one of nodes for a call to dest
+ * available marks nodes to pick from, at least one of them is true, see availableNodes
+ * pick is called concurrently, balancers keeping state guard it by themselves
+ *
+ */
+type balancer interface {
+	pick(nodes []nextNode, available []bool, dest network.Destination) int
+}
+
+func newBalancer(strategy string, nodes []nextNode) (balancer, error) {
+	switch strategy {
+	case "", strategyRandom:
+		return randomBalancer{}, nil
+	case strategyRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case strategyWeighted:
+		return &weightedBalancer{current: make([]int, len(nodes))}, nil
+	case strategyLeastActive:
+		return leastActiveBalancer{}, nil
+	case strategyLowestLatency:
+		return lowestLatencyBalancer{}, nil
+	case strategyConsistentHash:
+		return newHashRing(nodes), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", strategy)
+	}
+}
+
+// unhealthy nodes are left out while any healthy one is left, see nodeHealth.available
+func availableNodes(nodes []nextNode) []bool {
+	available := make([]bool, len(nodes))
+	anyAvailable := false
+	for i, node := range nodes {
+		available[i] = node.health.available()
+		anyAvailable = anyAvailable || available[i]
+	}
+	if !anyAvailable {
+		for i := range available {
+			available[i] = true
+		}
+	}
+	return available
+}
+
+func candidates(available []bool) []int {
+	indexes := make([]int, 0, len(available))
+	for i, ok := range available {
+		if ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	indexes := candidates(available)
+	return indexes[rand.Intn(len(indexes))]
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (balancer *roundRobinBalancer) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	indexes := candidates(available)
+	return indexes[(atomic.AddUint64(&balancer.next, 1)-1)%uint64(len(indexes))]
+}
+
+// smooth weighted round robin, nodes are picked in proportion to weights, and spread out
+type weightedBalancer struct {
+	mutex   sync.Mutex
+	current []int // of each node
+}
+
+func (balancer *weightedBalancer) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+
+	best, total := -1, 0
+	for _, i := range candidates(available) {
+		balancer.current[i] += nodes[i].weight
+		total += nodes[i].weight
+		if best < 0 || balancer.current[i] > balancer.current[best] {
+			best = i
+		}
+	}
+	balancer.current[best] -= total
+	return best
+}
+
+// ties are broken at random, so that idle nodes share calls
+type leastActiveBalancer struct{}
+
+func (leastActiveBalancer) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	return pickLowest(available, func(i int) int64 {
+		return nodes[i].health.activeConnections()
+	})
+}
+
+// nodes with latency never measured are tried first
+type lowestLatencyBalancer struct{}
+
+func (lowestLatencyBalancer) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	return pickLowest(available, func(i int) int64 {
+		return int64(nodes[i].health.latency())
+	})
+}
+
+func pickLowest(available []bool, value func(int) int64) int {
+	var lowest []int
+	var lowestValue int64
+	for _, i := range candidates(available) {
+		v := value(i)
+		if len(lowest) == 0 || v < lowestValue {
+			lowest, lowestValue = lowest[:0], v
+		}
+		if v == lowestValue {
+			lowest = append(lowest, i)
+		}
+	}
+	return lowest[rand.Intn(len(lowest))]
+}
+
+/**
+ * hashRing picks the same node for the same host of destination, whatever the port
+ * each node has points on the ring in proportion to its weight, a host goes to the first point after its hash
+ * a node left out takes only its own hosts away, they go to the next points on the ring
+ *
+ */
+type hashRing struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint32
+	node int
+}
+
+func newHashRing(nodes []nextNode) *hashRing {
+	ring := new(hashRing)
+	for i, node := range nodes {
+		for j := 0; j < ringPointsPerWeight*node.weight; j++ {
+			ring.points = append(ring.points, ringPoint{
+				hash: hashString(node.destination.String() + "#" + strconv.Itoa(j)),
+				node: i,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+func (ring *hashRing) pick(nodes []nextNode, available []bool, dest network.Destination) int {
+	host := dest.Domain()
+	if !dest.IsDomain() {
+		host = dest.IP().String()
+	}
+	hash := hashString(host)
+
+	start := sort.Search(len(ring.points), func(i int) bool {
+		return ring.points[i].hash >= hash
+	})
+	for k := 0; k < len(ring.points); k++ {
+		point := ring.points[(start+k)%len(ring.points)]
+		if available[point.node] {
+			return point.node
+		}
+	}
+	return candidates(available)[0]
+}
+
+func hashString(s string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(s))
+	return hash.Sum32()
+}
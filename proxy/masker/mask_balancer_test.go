@@ -0,0 +1,169 @@
+package masker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"masker/network"
+)
+
+func newTestNodes(weights ...int) []nextNode {
+	nodes := make([]nextNode, len(weights))
+	for i, weight := range weights {
+		addr, _ := network.NewIPv4Address([]byte{10, 0, 0, byte(i + 1)}, 1457)
+		nodes[i] = nextNode{
+			destination: network.NewTCPDestination(addr),
+			weight:      weight,
+			health:      &nodeHealth{},
+		}
+	}
+	return nodes
+}
+
+func countPicks(t *testing.T, strategy string, nodes []nextNode, times int) []int {
+	balancer, err := newBalancer(strategy, nodes)
+	if err != nil {
+		t.Fatalf("Err in creating balancer %s: %v", strategy, err)
+	}
+	counts := make([]int, len(nodes))
+	for i := 0; i < times; i++ {
+		counts[balancer.pick(nodes, availableNodes(nodes), testMuxDestination)]++
+	}
+	return counts
+}
+
+func TestBalancers(t *testing.T) {
+	nodes := newTestNodes(3, 1, 1)
+	for _, test := range []struct {
+		strategy string
+		times    int
+		want     []int
+	}{
+		{strategyRoundRobin, 12, []int{4, 4, 4}},
+		{strategyWeighted, 10, []int{6, 2, 2}},
+	} {
+		counts := countPicks(t, test.strategy, nodes, test.times)
+		for i := range counts {
+			if counts[i] != test.want[i] {
+				t.Errorf("Strategy %s picks %v, want %v", test.strategy, counts, test.want)
+				break
+			}
+		}
+	}
+
+	// least active connections, and lowest latency with unknown one tried first
+	nodes[0].health.succeed()
+	nodes[0].health.observeLatency(30 * time.Millisecond)
+	nodes[1].health.succeed()
+	nodes[1].health.succeed()
+	nodes[1].health.observeLatency(10 * time.Millisecond)
+	nodes[1].health.observeLatency(20 * time.Millisecond)
+	if counts := countPicks(t, strategyLeastActive, nodes, 5); counts[2] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 2", strategyLeastActive, counts)
+	}
+	if counts := countPicks(t, strategyLowestLatency, nodes, 5); counts[2] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 2 never called", strategyLowestLatency, counts)
+	}
+	nodes[2].health.observeLatency(40 * time.Millisecond)
+	if counts := countPicks(t, strategyLowestLatency, nodes, 5); counts[1] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 1", strategyLowestLatency, counts)
+	}
+
+	// unhealthy node is left out
+	for i := 0; i < unhealthyFailures; i++ {
+		nodes[1].health.fail(network.ErrConnectionRefused)
+	}
+	if counts := countPicks(t, strategyLowestLatency, nodes, 5); counts[0] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 0 with node 1 unhealthy", strategyLowestLatency, counts)
+	}
+
+	if _, err := newBalancer("fastest", nodes); err == nil {
+		t.Errorf("Unknown strategy should fail")
+	}
+}
+
+// latency is smoothed, one slow round trip does not outweigh the others
+func TestLowestLatency(t *testing.T) {
+	nodes := newTestNodes(1, 1)
+	for i := 0; i < 5; i++ {
+		nodes[0].health.observeLatency(10 * time.Millisecond)
+		nodes[1].health.observeLatency(40 * time.Millisecond)
+	}
+	nodes[0].health.observeLatency(100 * time.Millisecond)
+	if latency := nodes[0].health.latency(); latency <= 10*time.Millisecond || latency >= 40*time.Millisecond {
+		t.Errorf("Latency after a slow round trip is %v, want between 10ms and 40ms", latency)
+	}
+	if counts := countPicks(t, strategyLowestLatency, nodes, 5); counts[0] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 0 with a slow round trip", strategyLowestLatency, counts)
+	}
+
+	// slower for long, then it is left
+	for i := 0; i < 5; i++ {
+		nodes[0].health.observeLatency(100 * time.Millisecond)
+	}
+	if counts := countPicks(t, strategyLowestLatency, nodes, 5); counts[1] != 5 {
+		t.Errorf("Strategy %s picks %v, want all of node 1 after node 0 slows down", strategyLowestLatency, counts)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	nodes := newTestNodes(1, 1, 1)
+	ring := newHashRing(nodes)
+	all := availableNodes(nodes)
+
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		host := "site" + strconv.Itoa(i) + ".com"
+		node := ring.pick(nodes, all, network.NewTCPDestination(network.NewDomainAddress(host, 443)))
+		if again := ring.pick(nodes, all, network.NewTCPDestination(network.NewDomainAddress(host, 80))); again != node {
+			t.Fatalf("Host %s goes to node %d then %d", host, node, again)
+		}
+		picked[host] = node
+	}
+
+	// only hosts of the node left out move
+	available := []bool{true, false, true}
+	for host, node := range picked {
+		moved := ring.pick(nodes, available, network.NewTCPDestination(network.NewDomainAddress(host, 443)))
+		if node != 1 && moved != node || moved == 1 {
+			t.Errorf("Host %s goes to node %d, then %d with node 1 left out", host, node, moved)
+		}
+	}
+}
+
+// a list of next nodes, as configs of old versions, or an object with strategy
+func TestLoadCallerConfig(t *testing.T) {
+	node := `{"address": "127.0.0.1", "port": 1457, "users": [{"id": "` + testUserID + `"}]}`
+	for _, test := range []struct {
+		config   string
+		strategy string
+	}{
+		{"[" + node + "]", strategyRandom},
+		{`{"strategy": "weighted", "next_nodes": [` + node + `]}`, strategyWeighted},
+		{`{"strategy": "fastest", "next_nodes": [` + node + `]}`, ""},
+	} {
+		configFile := filepath.Join(t.TempDir(), "mask_caller.json")
+		os.WriteFile(configFile, []byte(test.config), 0644)
+
+		caller, err := NewMaskCaller(configFile)
+		if test.strategy == "" {
+			if err == nil {
+				t.Errorf("Config %s should fail", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Err in loading config %s: %v", test.config, err)
+			continue
+		}
+		want, _ := newBalancer(test.strategy, caller.nextNodeList)
+		if fmt.Sprintf("%T", caller.balancer) != fmt.Sprintf("%T", want) {
+			t.Errorf("Config %s gets balancer %T, want %T", test.config, caller.balancer, want)
+		}
+		caller.Close()
+	}
+}
@@ -2,10 +2,13 @@ package masker
 
 import (
 	"bytes"
-	"crypto/md5"
+	"context"
+	"errors"
 	"io"
 	"math/rand"
 	"net"
+	"sync"
+	"time"
 
 	"masker/account"
 	"masker/core"
@@ -15,143 +18,404 @@ import (
 )
 
 type MaskCaller struct {
-	nextNodeList []nextNode // list of nodes can be connected
+	nextNodeList []nextNode             // list of nodes can be connected
+	balancer     balancer               // picks one of nextNodeList for each call
+	mutex        sync.RWMutex           // guard nextNodeList and balancer against reloading
+	connections  *network.ConnectionSet // connections to next nodes
 }
 
 type nextNode struct {
 	destination network.Destination // node ip address
 	userList    []account.User      // users that node allows to access
+	weight      int                 // share of calls, relative to other nodes
+	cipher      string              // of data stream, the node must allow it, unless user sets its own
+	version     byte                // of request header, the node must accept it
+	mux         *muxPool            // nil if calls don't share connections
+	pool        *connPool           // nil if connections are not dialed in advance
+	health      *nodeHealth         // kept across reloading, for the same destination
 }
 
 func NewMaskCaller(configFile string) (*MaskCaller, error) {
-	nextNodeConfigList, err := loadCallerConfig(configFile)
+	nextNodeList, balancer, err := loadNextNodes(configFile)
 	if err != nil {
-		log.Error("Err in loading mask caller config: %v.", err)
 		return nil, err
 	}
 
-	nextNodeList := make([]nextNode, 0, len(nextNodeConfigList))
-	for _, tmpNextNodeConfig := range nextNodeConfigList {
+	startPools(nextNodeList)
+	return &MaskCaller{
+		nextNodeList: nextNodeList,
+		balancer:     balancer,
+		connections:  network.NewConnectionSet(),
+	}, nil
+}
+
+func loadNextNodes(configFile string) ([]nextNode, balancer, error) {
+	config, err := loadCallerConfig(configFile)
+	if err != nil {
+		log.Error("Err in loading mask caller config: %v.", err)
+		return nil, nil, err
+	}
+
+	nextNodeList := make([]nextNode, 0, len(config.NextNodes))
+	for _, tmpNextNodeConfig := range config.NextNodes {
 		if tmpNextNode, ok := tmpNextNodeConfig.toNextNode(); ok {
 			nextNodeList = append(nextNodeList, tmpNextNode)
 		}
 	}
 	if len(nextNodeList) == 0 {
-		return nil, log.Error("Check your config, don't find any accessible node!")
+		return nil, nil, log.Error("Check your config, don't find any accessible node!")
 	}
 
-	return &MaskCaller{
-		nextNodeList: nextNodeList,
-	}, nil
+	balancer, err := newBalancer(config.Strategy, nextNodeList)
+	if err != nil {
+		return nil, nil, log.Error("Check your config: %v", err)
+	}
+	return nextNodeList, balancer, nil
+}
+
+// new calls pick from the new next nodes, connections already built are not affected
+func (caller *MaskCaller) Reload(configFile string) error {
+	nextNodeList, balancer, err := loadNextNodes(configFile)
+	if err != nil {
+		return err
+	}
+
+	caller.mutex.Lock()
+	defer caller.mutex.Unlock()
+
+	healthList := make(map[string]*nodeHealth, len(caller.nextNodeList))
+	for _, node := range caller.nextNodeList {
+		healthList[node.destination.String()] = node.health
+	}
+	for i, node := range nextNodeList {
+		if health, ok := healthList[node.destination.String()]; ok {
+			nextNodeList[i].health = health
+			// pool is not started yet, it reports to the health kept from now on
+			if node.pool != nil {
+				node.pool.onDial = health.observeLatency
+			}
+		}
+	}
+	closePools(caller.nextNodeList)
+	startPools(nextNodeList)
+	caller.nextNodeList = nextNodeList
+	caller.balancer = balancer
+	return nil
+}
+
+func startPools(nextNodeList []nextNode) {
+	for _, node := range nextNodeList {
+		if node.pool != nil {
+			node.pool.start()
+		}
+	}
+}
+
+// idle connections of pools are closed, not the connections taken from them
+func closePools(nextNodeList []nextNode) {
+	for _, node := range nextNodeList {
+		if node.pool != nil {
+			node.pool.close()
+		}
+	}
+}
+
+// status of next nodes, in the order of config, see core.NextNodeReporter
+func (caller *MaskCaller) NextNodes() []core.NextNodeStatus {
+	caller.mutex.RLock()
+	defer caller.mutex.RUnlock()
+
+	statusList := make([]core.NextNodeStatus, 0, len(caller.nextNodeList))
+	for _, node := range caller.nextNodeList {
+		statusList = append(statusList, node.status())
+	}
+	return statusList
 }
 
 /**
  * Build link with next node(not the target address)
+ * wait until next node reports the result of calling dest
  * then encrypt data (read from channel) and transmit it
+ * next node with mux shares connections among calls, each call is a stream of one
  *
- * dest: final target address
+ * session.Destination: final target address
  *
  */
-func (caller *MaskCaller) Call(channel core.FullDuplexChannel, dest network.Destination) error {
-	nextNodeDestination, chosenUser := caller.pickNextNode()
+func (caller *MaskCaller) Call(ctx context.Context, session *core.Session, channel core.FullDuplexChannel) error {
+	chosenNode, chosenUser := caller.pickNextNode(session.Destination)
+	if chosenNode.mux != nil {
+		return caller.callMux(ctx, session, channel, chosenNode, chosenUser)
+	}
 
-	conn, err := net.Dial(nextNodeDestination.Network(), nextNodeDestination.String())
+	startTime := time.Now()
+	conn, encryptWriter, decryptReader, err := caller.connect(ctx, session, chosenNode, func() *maskRequest {
+		return newMaskRequest(chosenUser, session.Destination, chosenNode.cipherOf(chosenUser), chosenNode.version)
+	})
 	if err != nil {
-		log.Error("Err in opening %s connection: %v.", nextNodeDestination.Network(), err)
+		// destination failing is not a fault of next node
+		var remoteErr *remoteCallError
+		if !errors.As(err, &remoteErr) {
+			chosenNode.health.fail(err)
+		}
+		core.ObserveDial(session.OutboundTag, time.Since(startTime), err)
 		return err
 	}
-	log.Info("Connecting to %s succeed.", nextNodeDestination.String())
+	chosenNode.health.succeed()
+	core.ObserveDial(session.OutboundTag, time.Since(startTime), nil)
 
-	request := newMaskRequest(chosenUser, dest)
+	nodeAddress := chosenNode.destination.String()
+	channel.AddCounters(nextNodeBytes.WithLabelValues(nodeAddress, "up"), nextNodeBytes.WithLabelValues(nodeAddress, "down"))
 
+	// read data from channel -> write data to conn
 	writeFinish := make(chan bool, 1)
-	go sendRequest(conn, channel.ForwardChannel, writeFinish, request)
+	go channel.ForwardChannel.Output(newDataWriter(encryptWriter, chosenNode.version), writeFinish)
 
+	// read data from conn -> write data to channel
 	readFinish := make(chan bool, 1)
-	go receiveResponse(conn, channel.BackwardChannel, readFinish, request)
+	go channel.BackwardChannel.Input(newDataReader(newTamperGuard(decryptReader, channel.Close), chosenNode.version), readFinish)
 
-	go network.CloseConnection(conn, readFinish, writeFinish)
+	go func() {
+		network.CloseConnection(conn, readFinish, writeFinish, channel.Done())
+		caller.connections.Remove(conn)
+		chosenNode.health.finish()
+	}()
 	return nil
 }
 
-func (caller *MaskCaller) pickNextNode() (network.Destination, account.User) {
-	nextNodeNum := len(caller.nextNodeList)
-	chosenNode := caller.nextNodeList[rand.Intn(nextNodeNum)]
+// take a pooled connection or dial next node, then handshake, the connection is closed if either fails
+// each attempt sends a request of newRequest, keys of a request sent already would be taken for a replay
+func (caller *MaskCaller) connect(ctx context.Context, session *core.Session, node nextNode, newRequest func() *maskRequest) (net.Conn, cryption.EncryptWriter, cryption.DecryptReader, error) {
+	usePool := node.pool != nil
+	for {
+		conn, pooled, err := caller.dial(ctx, session, node, usePool)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-	userNum := len(chosenNode.userList)
-	chosenUser := chosenNode.userList[rand.Intn(userNum)]
+		encryptWriter, decryptReader, err := handshake(ctx, conn, newRequest())
+		if err == nil {
+			return conn, encryptWriter, decryptReader, nil
+		}
+		conn.Close()
+		caller.connections.Remove(conn)
 
-	return chosenNode.destination, chosenUser
+		// closed while idle, next node may not read the request, so a new one is sent
+		var remoteErr *remoteCallError
+		if !pooled || ctx.Err() != nil || errors.As(err, &remoteErr) {
+			return nil, nil, nil, err
+		}
+		log.Debug("Session %v: pooled connection to %s fails: %v, dial a new one.", session, node.destination.String(), err)
+		usePool = false
+	}
 }
 
-// encrypt request then send to chosen next node
-// read data from channel -> write data to conn
-func sendRequest(writer io.Writer, channel core.HalfDuplexChannel, finish chan<- bool, request *maskRequest) (err error) {
-	defer func() {
+// return whether the connection comes from pool
+func (caller *MaskCaller) dial(ctx context.Context, session *core.Session, node nextNode, usePool bool) (net.Conn, bool, error) {
+	nextNodeDestination := node.destination
+
+	var conn net.Conn
+	if usePool {
+		conn = node.pool.get()
+	}
+	pooled := conn != nil
+	if !pooled {
+		var dialer net.Dialer
+		var err error
+		startTime := time.Now()
+		conn, err = dialer.DialContext(ctx, nextNodeDestination.Network(), nextNodeDestination.String())
 		if err != nil {
-			finish <- false
+			log.Error("Err in opening %s connection: %v.", nextNodeDestination.Network(), err)
+			return nil, false, network.ClassifyDialError(err)
 		}
-	}()
+		// one round trip of tcp handshake, unlike mask response, which waits for next node calling destination
+		node.health.observeLatency(time.Since(startTime))
+	}
+	if !caller.connections.Add(conn) {
+		conn.Close()
+		return nil, false, log.Error("Caller is closed, drop connection to %s.", nextNodeDestination.String())
+	}
 
-	encryptWriter, err := cryption.NewAESEncryptWriter(writer, request.requestKey[:], request.requestIV[:])
+	if pooled {
+		log.Info("Session %v: taking pooled connection to %s.", session, nextNodeDestination.String())
+	} else {
+		log.Info("Session %v: connecting to %s succeed.", session, nextNodeDestination.String())
+	}
+	return conn, pooled, nil
+}
+
+// relay over a stream of a mux connection to node, see mask_mux.go
+func (caller *MaskCaller) callMux(ctx context.Context, session *core.Session, channel core.FullDuplexChannel, node nextNode, user account.User) error {
+	startTime := time.Now()
+	stream, err := caller.openMuxStream(ctx, session, node, user)
 	if err != nil {
-		log.Error("Err in creating encrypt writer: %v", err)
-		return
+		var remoteErr *remoteCallError
+		if !errors.As(err, &remoteErr) {
+			node.health.fail(err)
+		}
+		core.ObserveDial(session.OutboundTag, time.Since(startTime), err)
+		return err
 	}
+	node.health.succeed()
+	core.ObserveDial(session.OutboundTag, time.Since(startTime), nil)
 
-	// send first packet of payload together with request, in favor of small request
-	if payload, ok := channel.Pop(); ok {
-		encryptedRequest, err := request.encryptedByteSlice()
-		if err != nil {
-			log.Error("Err in serializing request: %v", err)
-			return err
+	nodeAddress := node.destination.String()
+	channel.AddCounters(nextNodeBytes.WithLabelValues(nodeAddress, "up"), nextNodeBytes.WithLabelValues(nodeAddress, "down"))
+
+	writeFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Output(stream, writeFinish)
+
+	readFinish := make(chan bool, 1)
+	go channel.BackwardChannel.Input(stream, readFinish)
+
+	go func() {
+		network.CloseConnection(stream, readFinish, writeFinish, channel.Done())
+		node.health.finish()
+	}()
+	return nil
+}
+
+// open on a mux connection with room, or on a new one if none has
+// a connection may be closed or refuse more streams after picked, then a new one is tried once
+func (caller *MaskCaller) openMuxStream(ctx context.Context, session *core.Session, node nextNode, user account.User) (*muxStream, error) {
+	for retried := false; ; retried = true {
+		muxSession := node.mux.pick()
+		if muxSession == nil {
+			var err error
+			if muxSession, err = caller.connectMux(ctx, session, node, user); err != nil {
+				return nil, err
+			}
 		}
-		encryptWriter.Encrypt(payload)
 
-		firstPacket := append(encryptedRequest, payload...)
-		_, err = writer.Write(firstPacket)
-		if err != nil {
-			log.Error("Err in send first packet: %v", err)
-			return err
+		stream, err := muxSession.openStream(ctx, session.Destination)
+		if errors.Is(err, errMuxStreamRefused) {
+			muxSession.refuse()
+		}
+		if retried || !(errors.Is(err, errMuxStreamRefused) || errors.Is(err, errMuxClosed)) {
+			return stream, err
 		}
+	}
+}
 
-		// than send other
-		go channel.Output(encryptWriter, finish)
-	} else {
-		err = log.Error("Can't read first block.")
+func (caller *MaskCaller) connectMux(ctx context.Context, session *core.Session, node nextNode, user account.User) (*muxSession, error) {
+	conn, encryptWriter, decryptReader, err := caller.connect(ctx, session, node, func() *maskRequest {
+		request := newMaskRequest(user, muxHeaderDestination, node.cipherOf(user), node.version)
+		request.mux = true
+		return request
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	muxSession := newMuxSession(conn, decryptReader, encryptWriter, node.mux.maxStreams)
+	muxSession.closeIdle = true
+	muxSession.onPong = node.health.observeLatency
+	muxSession.onClose = func() {
+		caller.connections.Remove(conn)
 	}
-	return
+	go muxSession.run()
+	node.mux.add(muxSession)
+	return muxSession, nil
 }
 
-// decrypt response and send back
-// read data from conn -> write data to channel
-func receiveResponse(reader io.Reader, channel core.HalfDuplexChannel, finish chan<- bool, request *maskRequest) (err error) {
-	defer func() {
-		if err != nil {
-			finish <- false
+// send request and receive response within ctx
+func handshake(ctx context.Context, conn net.Conn, request *maskRequest) (cryption.EncryptWriter, cryption.DecryptReader, error) {
+	stop := network.BindContext(ctx, conn)
+	defer stop()
+
+	if err := sendRequest(conn, request); err != nil {
+		return nil, nil, network.ClassifyDialError(err)
+	}
+
+	decryptReader, err := receiveResponse(conn, request)
+	if err != nil {
+		return nil, nil, network.ClassifyDialError(err)
+	}
+
+	// keys of v2 are known after response
+	key, IV := request.requestKeyIV()
+	encryptWriter, err := cryption.NewEncryptWriter(request.cipher, conn, key, IV)
+	if err != nil {
+		log.Error("Err in creating encrypt writer: %v", err)
+		return nil, nil, err
+	}
+	return encryptWriter, decryptReader, nil
+}
+
+func (caller *MaskCaller) Close() error {
+	caller.mutex.RLock()
+	closePools(caller.nextNodeList)
+	caller.mutex.RUnlock()
+
+	caller.connections.Close()
+	caller.connections.CloseAll()
+	return nil
+}
+
+func (node nextNode) cipherOf(user account.User) string {
+	if user.Cipher != "" {
+		return user.Cipher
+	}
+	return node.cipher
+}
+
+// node by strategy of caller, user at random
+func (caller *MaskCaller) pickNextNode(dest network.Destination) (nextNode, account.User) {
+	caller.mutex.RLock()
+	defer caller.mutex.RUnlock()
+
+	available := availableNodes(caller.nextNodeList)
+	chosenNode := caller.nextNodeList[caller.balancer.pick(caller.nextNodeList, available, dest)]
+
+	userNum := len(chosenNode.userList)
+	chosenUser := chosenNode.userList[rand.Intn(userNum)]
+
+	return chosenNode, chosenUser
+}
+
+// encrypt request then send to chosen next node
+func sendRequest(writer io.Writer, request *maskRequest) error {
+	encryptedRequest, err := request.encryptedByteSlice()
+	if err != nil {
+		log.Error("Err in serializing request: %v", err)
+		return err
+	}
+	_, err = writer.Write(encryptedRequest)
+	if err != nil {
+		log.Error("Err in sending request: %v", err)
+		return err
+	}
+	return nil
+}
+
+// decrypt response and check the result of calling destination
+// return the reader to decrypt data after response
+func receiveResponse(reader io.Reader, request *maskRequest) (cryption.DecryptReader, error) {
+	if request.version == headerV2 {
+		if err := request.receiveExchangeKey(reader); err != nil {
+			log.Error("Err in key exchange: %v", err)
+			return nil, err
 		}
-	}()
+	}
 
-	key := md5.Sum(request.requestKey[:])
-	IV := md5.Sum(request.requestIV[:])
-	decryptReader, err := cryption.NewAESDecryptReader(reader, key[:], IV[:])
+	key, IV := request.responseKeyIV()
+	decryptReader, err := cryption.NewDecryptReader(request.cipher, reader, key, IV)
 	if err != nil {
 		log.Error("Err in creating decrypt reader: %v", err)
-		return
+		return nil, err
 	}
 
 	// check response
-	response := maskResponse{}
-	_, err = decryptReader.Read(response[:])
+	response, err := readMaskResponse(decryptReader, request.version)
 	if err != nil {
 		log.Error("Err in reading mask response: %v", err)
-		return
+		return nil, err
 	}
-	if !bytes.Equal(response[:], request.responseHeader[:]) {
-		err = log.Error("Unexpected response header.")
-		return
+	if !bytes.Equal(response.header[:], request.responseHeader[:]) {
+		return nil, log.Error("Unexpected response header.")
 	}
-
-	go channel.Input(decryptReader, finish)
-	return
+	if err = response.callError(); err != nil {
+		log.Warning("Next node failed to call %s: %v", request.dest.String(), err)
+		return nil, &remoteCallError{err}
+	}
+	return decryptReader, nil
 }
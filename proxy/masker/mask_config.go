@@ -1,39 +1,82 @@
 package masker
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"time"
 
 	"masker/account"
+	"masker/cryption"
 	"masker/log"
 	"masker/network"
 )
 
-func loadCallerConfig(configFile string) (config []nextNodeConfig, err error) {
+// a list of next nodes, as configs of old versions, is taken with the default strategy
+func loadCallerConfig(configFile string) (config callerConfig, err error) {
 	rawData, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return
 	}
 
+	if rawData = bytes.TrimSpace(rawData); len(rawData) > 0 && rawData[0] == '[' {
+		err = json.Unmarshal(rawData, &config.NextNodes)
+		return
+	}
 	err = json.Unmarshal(rawData, &config)
 	return
 }
 
+type callerConfig struct {
+	Strategy  string           `json:"strategy"` // of picking next node, random if not set, see mask_balancer.go
+	NextNodes []nextNodeConfig `json:"next_nodes"`
+}
+
 type nextNodeConfig struct {
 	Address  string       `json:"address"`
 	Port     uint16       `json:"port"`
+	Cipher   string       `json:"cipher"` // aes-128-gcm if not set, aes-128-cfb for nodes of old versions, users may override it
+	Weight   int          `json:"weight"` // 1 if not set, for strategies weighted and consistent-hash
 	UserList []userConfig `json:"users"`
+
+	HeaderVersion *byte       `json:"header_version"` // 1 if not set, 0 for nodes of old versions, 2 for forward secrecy
+	Mux           *muxConfig  `json:"mux"`            // calls share connections if set, see mask_mux.go
+	Pool          *poolConfig `json:"pool"`           // connections are dialed in advance if set, see mask_pool.go
+}
+
+// connections kept idle, and seconds for which each of them is kept, default if not set
+type poolConfig struct {
+	Size    int `json:"size"`
+	IdleTTL int `json:"idle_ttl"`
 }
 
+// streams of a mux connection, default if not set
+type muxConfig struct {
+	MaxStreams int `json:"max_streams"`
+}
+
+func (config *muxConfig) maxStreams(defaultMaxStreams int) int {
+	if config == nil || config.MaxStreams <= 0 {
+		return defaultMaxStreams
+	}
+	return config.MaxStreams
+}
+
+const defaultCipher = cryption.CipherAES128GCM
+
+// policy is only enforced by listeners, except that callers use the cipher of a user
 type userConfig struct {
 	Id string `json:"id"`
+	account.Policy
 }
 
 func (config nextNodeConfig) toNextNode() (nextNode, bool) {
 	ip := net.ParseIP(config.Address)
 	if ip == nil {
-		panic(log.Error("Unable to parse ip: %v", config.Address))
+		log.Error("Unable to parse ip: %v", config.Address)
+		return nextNode{}, false
 	}
 
 	var err error
@@ -43,30 +86,111 @@ func (config nextNodeConfig) toNextNode() (nextNode, bool) {
 		addr, err = network.NewIPv6Address(ip, config.Port)
 	}
 	if err != nil {
-		panic(log.Error("Illegal ip: %v", config.Address))
+		log.Error("Illegal ip: %v", config.Address)
+		return nextNode{}, false
+	}
+
+	headerVersion := headerV1
+	if config.HeaderVersion != nil {
+		headerVersion = *config.HeaderVersion
+	}
+	if !validHeaderVersion(headerVersion) {
+		log.Error("Unsupported header version of node %s: %d", config.Address, headerVersion)
+		return nextNode{}, false
+	}
+
+	cipherName := config.Cipher
+	if cipherName == "" && headerVersion == headerLegacy {
+		cipherName = legacyCipher
+	} else if cipherName == "" {
+		cipherName = defaultCipher
+	}
+	if err = checkCipher(cipherName, headerVersion); err != nil {
+		log.Error("Check cipher of node %s: %v", config.Address, err)
+		return nextNode{}, false
 	}
 
 	users := make([]account.User, 0, len(config.UserList))
 	for _, tmpUserConfig := range config.UserList {
-		if tmpUser, ok := tmpUserConfig.toUser(); ok {
-			users = append(users, tmpUser)
+		tmpUser, ok := tmpUserConfig.toUser()
+		if !ok {
+			continue
+		}
+		if tmpUser.Cipher != "" {
+			if err = checkCipher(tmpUser.Cipher, headerVersion); err != nil {
+				log.Error("Check cipher of user %s to node %s: %v", tmpUser.Id.Text, config.Address, err)
+				continue
+			}
 		}
+		users = append(users, tmpUser)
 	}
 	// if a node has no user can access, discard it
 	if len(users) == 0 {
 		return nextNode{}, false
 	}
 
+	var mux *muxPool
+	if config.Mux != nil && headerVersion == headerLegacy {
+		log.Error("Mux of node %s needs header version 1 or later, old nodes know nothing of it", config.Address)
+		return nextNode{}, false
+	}
+	if config.Mux != nil {
+		mux = newMuxPool(config.Mux.maxStreams(defaultCallerMaxStreams))
+	}
+
+	destination := network.NewTCPDestination(addr)
+	var pool *connPool
+	if config.Pool != nil {
+		pool = config.Pool.newConnPool(destination)
+	}
+
+	weight := config.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	health := &nodeHealth{}
+	if pool != nil {
+		pool.onDial = health.observeLatency
+	}
 	return nextNode{
-		destination: network.NewTCPDestination(addr),
+		destination: destination,
 		userList:    users,
+		weight:      weight,
+		cipher:      cipherName,
+		version:     headerVersion,
+		mux:         mux,
+		pool:        pool,
+		health:      health,
 	}, true
 }
 
+func (config poolConfig) newConnPool(destination network.Destination) *connPool {
+	size := config.Size
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	idleTTL := defaultPoolIdleTTL
+	if config.IdleTTL > 0 {
+		idleTTL = time.Duration(config.IdleTTL) * time.Second
+	}
+	if idleTTL > maxPoolIdleTTL {
+		log.Warning("Idle ttl %v of pool to %s is cut to %v, next node closes connections without a request.", idleTTL, destination.String(), maxPoolIdleTTL)
+		idleTTL = maxPoolIdleTTL
+	}
+	return newConnPool(destination, size, idleTTL)
+}
+
 func (config userConfig) toUser() (account.User, bool) {
+	if config.Cipher != "" && !cryption.HasCipher(config.Cipher) {
+		log.Error("Unknown cipher of user %s: %s", config.Id, config.Cipher)
+		return account.User{}, false
+	}
+
 	userID, err := account.NewID(config.Id)
 	return account.User{
-		Id: userID,
+		Id:     userID,
+		Policy: config.Policy,
 	}, (err == nil)
 }
 
@@ -81,5 +205,56 @@ func loadListenerConfig(configFile string) (config listenerConfig, err error) {
 }
 
 type listenerConfig struct {
-	UserList []userConfig `json:"users"`
+	UserList       []userConfig `json:"users"`
+	Ciphers        []string     `json:"ciphers"`         // ciphers callers may choose, all but none if not set
+	HeaderVersions []int        `json:"header_versions"` // header versions accepted, all if not set
+	Mux            *muxConfig   `json:"mux"`
+}
+
+// what callers may choose in handshake
+type handshakeOptions struct {
+	ciphers    map[string]bool
+	versions   map[byte]bool
+	maxStreams int // of a mux connection
+}
+
+func (config listenerConfig) handshakeOptions() (options handshakeOptions, err error) {
+	names := config.Ciphers
+	if len(names) == 0 {
+		names = defaultListenerCiphers()
+	}
+	options.ciphers = make(map[string]bool, len(names))
+	for _, name := range names {
+		if !cryption.HasCipher(name) {
+			return options, fmt.Errorf("%w: %s", errUnsupportedCipher, name)
+		}
+		options.ciphers[name] = true
+	}
+
+	options.versions = make(map[byte]bool, len(headerVersions))
+	for _, version := range config.HeaderVersions {
+		if version < 0 || version > 0xFF || !validHeaderVersion(byte(version)) {
+			return options, fmt.Errorf("%w: %d", errUnsupportedVersion, version)
+		}
+		options.versions[byte(version)] = true
+	}
+	if len(options.versions) == 0 {
+		for _, version := range headerVersions {
+			options.versions[version] = true
+		}
+	}
+
+	options.maxStreams = config.Mux.maxStreams(defaultListenerMaxStreams)
+	return options, nil
+}
+
+// plain text must be allowed explicitly
+func defaultListenerCiphers() []string {
+	names := make([]string, 0)
+	for _, name := range cryption.CipherNames() {
+		if name != cryption.CipherNone {
+			names = append(names, name)
+		}
+	}
+	return names
 }
@@ -0,0 +1,60 @@
+package masker
+
+import (
+	"fmt"
+	"io"
+
+	"masker/cryption"
+)
+
+/**
+ * Key exchange of v2 header, for forward secrecy
+ * - caller sends its ephemeral x25519 public key in request header
+ * - listener answers its own before response, sealed by aes-128-gcm with request key and IV
+ * - keys of data stream and response derive from the shared key by hkdf-sha256
+ * ephemeral keys are dropped once the connection is built,
+ * so recorded connections can't be decrypted even if user id leaks later
+ *
+ */
+
+// listener side, call once request is read, a bad key of caller fails it before calling destination
+func (r *maskRequest) acceptExchange() (err error) {
+	if r.exchangeKey, err = cryption.NewX25519Key(); err != nil {
+		return
+	}
+	return r.exchange()
+}
+
+// listener side, call before sending response
+func (r *maskRequest) sendExchangeKey(writer io.Writer) error {
+	sealWriter, err := cryption.NewAEADEncryptWriter(writer, cryption.CipherAES128GCM, r.requestKey[:], r.requestIV[:])
+	if err != nil {
+		return err
+	}
+	_, err = sealWriter.Write(r.exchangeKey.Public[:])
+	r.exchangeKey = nil
+	return err
+}
+
+// caller side, call before reading response
+func (r *maskRequest) receiveExchangeKey(reader io.Reader) (err error) {
+	openReader, err := cryption.NewAEADDecryptReader(reader, cryption.CipherAES128GCM, r.requestKey[:], r.requestIV[:])
+	if err != nil {
+		return
+	}
+	if _, err = io.ReadFull(openReader, r.peerKey[:]); err != nil {
+		return
+	}
+	err = r.exchange()
+	r.exchangeKey = nil
+	return
+}
+
+func (r *maskRequest) exchange() error {
+	sharedKey, err := r.exchangeKey.SharedKey(r.peerKey[:])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errBadExchangeKey, err)
+	}
+	r.sharedKey = sharedKey
+	return nil
+}
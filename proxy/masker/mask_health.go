@@ -0,0 +1,110 @@
+package masker
+
+import (
+	"sync"
+	"time"
+
+	"masker/core"
+	"masker/metrics"
+)
+
+var nextNodeBytes = metrics.NewCounterVec("masker_next_node_bytes_total",
+	"Bytes relayed through each next node, up is from client to destination.", "next_node", "direction")
+
+// a next node failing this many times in a row is unhealthy, until it is called successfully again
+const unhealthyFailures = 3
+
+// an unhealthy next node is called again once this long after its last failure, to see if it recovers
+const unhealthyRetryInterval = 30 * time.Second
+
+// a round trip measured weighs 1/latencySmoothing in latency, so that one slow round trip does not flip balancers
+const latencySmoothing = 4
+
+// what a MaskCaller learns about a next node by calling it
+type nodeHealth struct {
+	mutex               sync.Mutex
+	active              int64 // connections relaying data
+	consecutiveFailures int
+	lastError           error
+	smoothedLatency     time.Duration // of round trips to the node, not to destinations it calls, 0 if never measured
+	lastSuccess         time.Time
+	lastFailure         time.Time
+}
+
+func (health *nodeHealth) succeed() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.active++
+	health.consecutiveFailures = 0
+	health.lastSuccess = time.Now()
+}
+
+// rtt: of dialing the node, or of ping on a mux connection to it
+func (health *nodeHealth) observeLatency(rtt time.Duration) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	if health.smoothedLatency == 0 {
+		health.smoothedLatency = rtt
+		return
+	}
+	health.smoothedLatency += (rtt - health.smoothedLatency) / latencySmoothing
+}
+
+func (health *nodeHealth) fail(err error) {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.consecutiveFailures++
+	health.lastError = err
+	health.lastFailure = time.Now()
+}
+
+// a connection counted by succeed is closed
+func (health *nodeHealth) finish() {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	health.active--
+}
+
+// whether balancers may pick the node, see availableNodes
+func (health *nodeHealth) available() bool {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return health.consecutiveFailures < unhealthyFailures || time.Since(health.lastFailure) >= unhealthyRetryInterval
+}
+
+func (health *nodeHealth) activeConnections() int64 {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return health.active
+}
+
+// smoothed round trip, 0 if never measured
+func (health *nodeHealth) latency() time.Duration {
+	health.mutex.Lock()
+	defer health.mutex.Unlock()
+
+	return health.smoothedLatency
+}
+
+func (node nextNode) status() core.NextNodeStatus {
+	node.health.mutex.Lock()
+	defer node.health.mutex.Unlock()
+
+	return core.NextNodeStatus{
+		Address:             node.destination.String(),
+		Users:               len(node.userList),
+		Healthy:             node.health.consecutiveFailures < unhealthyFailures,
+		ActiveConnections:   node.health.active,
+		ConsecutiveFailures: node.health.consecutiveFailures,
+		LastError:           node.health.lastError,
+		Latency:             node.health.smoothedLatency,
+		LastSuccess:         node.health.lastSuccess,
+		LastFailure:         node.health.lastFailure,
+	}
+}
@@ -1,7 +1,11 @@
 package masker
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -9,6 +13,8 @@ import (
 	cryptrand "crypto/rand"
 	mrand "math/rand"
 
+	"golang.org/x/crypto/hkdf"
+
 	"masker/account"
 	"masker/cryption"
 	"masker/network"
@@ -20,18 +26,88 @@ const (
 	addrTypeDomain = byte(0x02)
 )
 
+// commands in the top bits of address type, tcp if not set
+// data stream of udp carries datagrams in frames, see network.PacketStream
+// data stream of mux carries many streams in frames, see mask_mux.go, destination of its header is not used
+const (
+	cmdUDP       = byte(0x80)
+	cmdMux       = byte(0x40)
+	addrTypeMask = byte(0x3F)
+)
+
+// handshake failures told apart, see handshakeFailureReason
+var (
+	errInvalidUser            = errors.New("invalid user")
+	errBadPadding             = errors.New("bad random padding")
+	errUnsupportedAddressType = errors.New("unsupported address type")
+	errReplayedRequest        = errors.New("replayed request")
+	errUnsupportedCipher      = errors.New("unsupported cipher")
+	errUnsupportedVersion     = errors.New("unsupported header version")
+	errBadTimestamp           = errors.New("timestamp not matching user hash")
+	errBadExchangeKey         = errors.New("bad key for key exchange")
+)
+
+// cipher of data stream is signalled by name in sealed header, any cipher registered in package cryption works
+// legacy header signals none, the data stream is aes-128-cfb as old nodes know it
+const legacyCipher = cryption.CipherAES128CFB
+
+// whether header of version can signal the cipher
+func checkCipher(cipherName string, version byte) error {
+	if !cryption.HasCipher(cipherName) {
+		return fmt.Errorf("%w: %s", errUnsupportedCipher, cipherName)
+	}
+	if version == headerLegacy && cipherName != legacyCipher {
+		return fmt.Errorf("%w: %s in legacy header", errUnsupportedCipher, cipherName)
+	}
+	return nil
+}
+
+// formats of request header
+// - legacy: user hash of hmac-md5 | header encrypted by aes-128-cfb, no integrity check, keys derived by md5
+// - v1: version byte masked by the first byte of user hash | user hash of hmac-sha256 | salt | header sealed by aes-128-gcm
+// - v2: v1 with an ephemeral x25519 key, for forward secrecy, see mask_exchange.go
+// user hash of all is only the key to find user, v1 and v2 headers are authenticated with a key derived by hkdf-sha256
+// legacy response and data stream stay as old nodes know them, see maskResponse
+const (
+	headerLegacy = byte(0) // not on the wire
+	headerV1     = byte(1)
+	headerV2     = byte(2)
+)
+
+var headerVersions = []byte{headerLegacy, headerV1, headerV2}
+
+func validHeaderVersion(version byte) bool {
+	return bytes.IndexByte(headerVersions, version) >= 0
+}
+
+const (
+	headerSaltLen    = 16
+	maxSealedDataLen = 512 // big enough for any sealed header
+)
+
 type maskRequest struct {
+	version        byte // of header
 	userID         *account.ID
+	userHash       [account.IDBytesLen]byte // set by readMaskRequest
+	timeSec        int64                    // of user hash, set by readMaskRequest
 	requestKey     [16]byte
 	requestIV      [16]byte
 	responseHeader [4]byte
+	cipher         string // of data stream in both directions
 	dest           network.Destination
+	mux            bool // streams are opened later over the connection, instead of dest
+
+	exchangeKey *cryption.X25519Key         // ephemeral key of this side, v2 only
+	peerKey     [cryption.X25519KeyLen]byte // ephemeral public key of the other side, v2 only
+	sharedKey   []byte                      // result of key exchange, keys of data stream derive from it
 }
 
-func newMaskRequest(u account.User, dest network.Destination) *maskRequest {
+func newMaskRequest(u account.User, dest network.Destination, cipherName string, version byte) *maskRequest {
 	r := &maskRequest{
-		userID: u.Id,
-		dest:   dest,
+		version: version,
+		userID:  u.Id,
+		cipher:  cipherName,
+		dest:    dest,
 	}
 	cryptrand.Read(r.requestKey[:])
 	cryptrand.Read(r.requestIV[:])
@@ -40,210 +116,325 @@ func newMaskRequest(u account.User, dest network.Destination) *maskRequest {
 	return r
 }
 
-func readMaskRequest(reader io.Reader, userSet account.UserSet) (request *maskRequest, err error) {
+// key and IV of the request direction
+func (r *maskRequest) requestKeyIV() ([]byte, []byte) {
+	if r.sharedKey == nil {
+		return r.requestKey[:], r.requestIV[:]
+	}
+	return r.deriveKeyIV(r.sharedKey, "masker request")
+}
+
+// key and IV of the response direction, different from those of request direction
+func (r *maskRequest) responseKeyIV() ([]byte, []byte) {
+	switch {
+	case r.sharedKey != nil:
+		return r.deriveKeyIV(r.sharedKey, "masker response")
+	case r.version == headerLegacy:
+		key := md5.Sum(r.requestKey[:])
+		IV := md5.Sum(r.requestIV[:])
+		return key[:], IV[:]
+	default:
+		return r.deriveKeyIV(r.requestKey[:], "masker response")
+	}
+}
+
+func (r *maskRequest) deriveKeyIV(secret []byte, info string) ([]byte, []byte) {
+	keyIV := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, sealSalt(r.requestKey[:], r.requestIV[:]), []byte(info)), keyIV)
+	return keyIV[:16], keyIV[16:]
+}
+
+/**
+ * Read request header of the versions accepted
+ * a sealed header is told from a legacy one by the version byte, and by whether user hash after it is known
+ * so a legacy user hash beginning with the same byte still works
+ *
+ */
+func readMaskRequest(reader io.Reader, userSet account.UserSet, versions map[byte]bool) (request *maskRequest, err error) {
 	request = new(maskRequest)
-	buffer := make([]byte, 256)
 
-	// user hash
-	nBytes, err := reader.Read(buffer[:account.IDBytesLen])
-	if err != nil {
+	// version and user hash
+	var prefix [1 + account.IDBytesLen]byte
+	if _, err = io.ReadFull(reader, prefix[:]); err != nil {
 		return
 	}
-	if nBytes != account.IDBytesLen {
-		err = fmt.Errorf("Unable read complete user hash, want %d, get %d", account.IDBytesLen, nBytes)
+
+	var user *account.User
+	var timeSec int64
+	err = account.ErrNoSuchUser
+	if version := prefix[0] ^ prefix[1]; version != headerLegacy && versions[version] {
+		request.version = version
+		copy(request.userHash[:], prefix[1:])
+		user, timeSec, err = userSet.GetUser(account.HashSHA256, request.userHash[:])
+	}
+	if errors.Is(err, account.ErrNoSuchUser) && versions[headerLegacy] {
+		request.version = headerLegacy
+		copy(request.userHash[:], prefix[:account.IDBytesLen])
+		user, timeSec, err = userSet.GetUser(account.HashMD5, request.userHash[:])
+		reader = io.MultiReader(bytes.NewReader(prefix[account.IDBytesLen:]), reader)
+	}
+	if errors.Is(err, account.ErrNoSuchUser) {
+		err = errInvalidUser
+		return
+	} else if err != nil {
+		// refused by policy
+		err = fmt.Errorf("user %s: %w", user.Id.Text, err)
 		return
 	}
+	request.userID = user.Id
+	request.timeSec = timeSec
 
-	userHash := buffer[:nBytes]
-	userID, timeSec, ok := userSet.GetUser(userHash)
-	if ok == false {
-		err = fmt.Errorf("invalid user")
-		return
+	if request.version != headerLegacy {
+		err = request.readSealedHeader(reader)
+	} else {
+		err = request.readLegacyHeader(reader)
 	}
-	request.userID = userID
-	decryptReader, err := cryption.NewAESDecryptReader(reader, userID.CmdKey(), cryption.Int64Hash(timeSec))
+	return
+}
+
+func (request *maskRequest) readLegacyHeader(reader io.Reader) (err error) {
+	decryptReader, err := cryption.NewAESDecryptReader(reader, request.userID.CmdKey(), cryption.Int64Hash(request.timeSec))
 	if err != nil {
 		return
 	}
+	buffer := make([]byte, 32)
 
 	// skip random padding
-	skipRandomPadding := func() error {
-		_, err := decryptReader.Read(buffer[:1])
-		if err != nil {
-			return err
-		}
-
-		randomPaddingLen := int(buffer[0])
+	skipRandomPadding := func(paddingLen byte) error {
+		randomPaddingLen := int(paddingLen)
 		if randomPaddingLen <= 0 || randomPaddingLen > 32 {
-			return fmt.Errorf("Unexpected random padding length %d", randomPaddingLen)
+			return fmt.Errorf("%w: unexpected length %d", errBadPadding, randomPaddingLen)
 		}
-		_, err = decryptReader.Read(buffer[:randomPaddingLen])
+		_, err := io.ReadFull(decryptReader, buffer[:randomPaddingLen])
 		return err
 	}
 
-	if err = skipRandomPadding(); err != nil {
+	// random padding
+	if _, err = io.ReadFull(decryptReader, buffer[:1]); err != nil {
 		return
 	}
+	if err = skipRandomPadding(buffer[0]); err != nil {
+		return
+	}
+	request.cipher = legacyCipher
 
-	// key
-	nBytes, err = decryptReader.Read(request.requestKey[:])
-	if err != nil {
+	// key, IV, response header
+	for _, field := range [][]byte{request.requestKey[:], request.requestIV[:], request.responseHeader[:]} {
+		if _, err = io.ReadFull(decryptReader, field); err != nil {
+			return
+		}
+	}
+
+	var command byte
+	if request.dest, command, err = readDestination(decryptReader); err != nil {
 		return
 	}
-	if nBytes != len(request.requestKey) {
-		err = fmt.Errorf("Unable read complete request key, want %d, get %d", len(request.requestKey), nBytes)
+	request.mux = command&cmdMux != 0
+
+	// skip random padding
+	if _, err = io.ReadFull(decryptReader, buffer[:1]); err != nil {
 		return
 	}
+	return skipRandomPadding(buffer[0])
+}
 
-	// IV
-	nBytes, err = decryptReader.Read(request.requestIV[:])
-	if err != nil {
+// header sealed in one chunk: time | key | IV | response header | cipher name | (v2) public key | port | address | random padding
+func (request *maskRequest) readSealedHeader(reader io.Reader) (err error) {
+	salt := make([]byte, headerSaltLen)
+	if _, err = io.ReadFull(reader, salt); err != nil {
 		return
 	}
-	if nBytes != len(request.requestIV) {
-		err = fmt.Errorf("Unable read complete request IV, want %d, get %d", len(request.requestIV), nBytes)
+	decryptReader, err := cryption.NewAEADDecryptReader(reader, cryption.CipherAES128GCM, request.userID.Bytes, sealSalt(request.userHash[:], salt))
+	if err != nil {
 		return
 	}
 
-	// response header
-	nBytes, err = decryptReader.Read(request.responseHeader[:])
+	// a Read gives a whole chunk
+	buffer := make([]byte, maxSealedDataLen)
+	nBytes, err := decryptReader.Read(buffer)
 	if err != nil {
 		return
 	}
-	if nBytes != len(request.responseHeader) {
-		err = fmt.Errorf("Unable read complete response header, want %d, get %d", len(request.responseHeader), nBytes)
+	header := bytes.NewReader(buffer[:nBytes])
+
+	var timeSec int64
+	if err = binary.Read(header, binary.BigEndian, &timeSec); err != nil {
 		return
 	}
+	if timeSec != request.timeSec {
+		return fmt.Errorf("%w: %d in header, %d of user hash", errBadTimestamp, timeSec, request.timeSec)
+	}
 
-	// port
-	nBytes, err = decryptReader.Read(buffer[:2])
+	for _, field := range [][]byte{request.requestKey[:], request.requestIV[:], request.responseHeader[:]} {
+		if _, err = io.ReadFull(header, field); err != nil {
+			return
+		}
+	}
+
+	nameLen, err := header.ReadByte()
 	if err != nil {
 		return
 	}
-	if nBytes != 2 {
-		err = fmt.Errorf("Unable read complete port, want 2, get %d", nBytes)
+	name := make([]byte, nameLen)
+	if _, err = io.ReadFull(header, name); err != nil {
+		return
 	}
-	port := binary.BigEndian.Uint16(buffer[0:2])
-
-	// address
-	_, err = decryptReader.Read(buffer[:1])
-	if err != nil {
+	request.cipher = string(name)
+	if err = checkCipher(request.cipher, request.version); err != nil {
 		return
 	}
-	var addr network.Address
-	switch buffer[0] {
-	case addrTypeIPv4:
-		nBytes, err = decryptReader.Read(buffer[1:5])
-		if err != nil {
-			return
-		}
-		if nBytes != 4 {
-			err = fmt.Errorf("Unable read complete ip, want 4, get %d", nBytes)
+
+	if request.version == headerV2 {
+		if _, err = io.ReadFull(header, request.peerKey[:]); err != nil {
 			return
 		}
+	}
+
+	// padding is authenticated too, no need to check
+	var command byte
+	request.dest, command, err = readDestination(header)
+	request.mux = command&cmdMux != 0
+	return
+}
+
+// key of sealed header is derived from user id, with user hash and random salt, never reused across requests
+// keys of data stream are derived with request key and IV
+func sealSalt(userHash []byte, salt []byte) []byte {
+	return append(append(make([]byte, 0, len(userHash)+len(salt)), userHash...), salt...)
+}
 
-		addr, err = network.NewIPv4Address(buffer[1:5], port)
-		if err != nil {
+// port | address type with command | address
+func readDestination(reader io.Reader) (dest network.Destination, command byte, err error) {
+	buffer := make([]byte, 256)
+
+	// port and address type
+	if _, err = io.ReadFull(reader, buffer[:3]); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(buffer[0:2])
+	addrType := buffer[2]
+	command = addrType &^ addrTypeMask
+
+	var addr network.Address
+	switch addrType & addrTypeMask {
+	case addrTypeIPv4:
+		if _, err = io.ReadFull(reader, buffer[:4]); err != nil {
 			return
 		}
+		addr, err = network.NewIPv4Address(buffer[:4], port)
 	case addrTypeIPv6:
-		nBytes, err = decryptReader.Read(buffer[1:17])
-		if err != nil {
-			return
-		}
-		if nBytes != 16 {
-			err = fmt.Errorf("Unable read complete ip, want 16, get %d", nBytes)
-			return
-		}
-
-		addr, err = network.NewIPv6Address(buffer[1:17], port)
-		if err != nil {
+		if _, err = io.ReadFull(reader, buffer[:16]); err != nil {
 			return
 		}
+		addr, err = network.NewIPv6Address(buffer[:16], port)
 	case addrTypeDomain:
-		_, err = decryptReader.Read(buffer[1:2])
-		if err != nil {
-			return
-		}
-
-		domainLen := int(buffer[1])
-		nBytes, err = decryptReader.Read(buffer[2 : 2+domainLen])
-		if err != nil {
+		if _, err = io.ReadFull(reader, buffer[:1]); err != nil {
 			return
 		}
-		if nBytes != domainLen {
-			err = fmt.Errorf("Unable read complete domain, want %d, get %d", domainLen, nBytes)
+		domainLen := int(buffer[0])
+		if _, err = io.ReadFull(reader, buffer[:domainLen]); err != nil {
 			return
 		}
-		addr = network.NewDomainAddress(string(buffer[2:2+domainLen]), port)
+		addr = network.NewDomainAddress(string(buffer[:domainLen]), port)
 	default:
-		err = fmt.Errorf("Unsupported address type: %v", buffer[0])
-		return
+		err = fmt.Errorf("%w: %v", errUnsupportedAddressType, addrType)
 	}
-	request.dest = network.NewTCPDestination(addr)
-
-	// skip random padding
-	if err = skipRandomPadding(); err != nil {
+	if err != nil {
 		return
 	}
-	return
+	if command&cmdUDP != 0 {
+		return network.NewUDPDestination(addr), command, nil
+	}
+	return network.NewTCPDestination(addr), command, nil
 }
 
 func (r *maskRequest) encryptedByteSlice() ([]byte, error) {
-	buffer := make([]byte, 0, 300)
-
-	// add random padding
-	randomPadding := func() error {
-		randomPaddingLen := mrand.Intn(32) + 1
-		randomPaddingContent := make([]byte, randomPaddingLen)
-		_, err := mrand.Read(randomPaddingContent)
-		if err != nil {
-			return err
-		}
+	if err := checkCipher(r.cipher, r.version); err != nil {
+		return nil, err
+	}
 
-		buffer = append(buffer, byte(randomPaddingLen))
-		buffer = append(buffer, randomPaddingContent...)
-		return nil
+	// random time: +-30s from current time
+	randomTimeSec := time.Now().Unix() - 30 + mrand.Int63n(61)
+
+	// md5 is kept for legacy header only, older listeners know nothing else
+	switch r.version {
+	case headerLegacy:
+		return r.legacyByteSlice(cryption.TimeHMACHash(r.userID.Bytes, randomTimeSec), randomTimeSec)
+	case headerV1, headerV2:
+		return r.sealedByteSlice(cryption.TimeHMACSHA256Hash(r.userID.Bytes, randomTimeSec), randomTimeSec)
+	default:
+		return nil, fmt.Errorf("%w: %d", errUnsupportedVersion, r.version)
 	}
+}
 
-	if err := randomPadding(); err != nil {
+// random padding: length (1..32) | content
+func appendRandomPadding(buffer []byte) ([]byte, error) {
+	randomPaddingLen := mrand.Intn(32) + 1
+	randomPaddingContent := make([]byte, randomPaddingLen)
+	_, err := mrand.Read(randomPaddingContent)
+	if err != nil {
 		return nil, err
 	}
 
-	// add key, IV
-	// TODO: add user hash
+	buffer = append(buffer, byte(randomPaddingLen))
+	return append(buffer, randomPaddingContent...), nil
+}
+
+// key, IV, response header, cipher and destination
+func (r *maskRequest) appendFields(buffer []byte) []byte {
 	buffer = append(buffer, r.requestKey[:]...)
 	buffer = append(buffer, r.requestIV[:]...)
 	buffer = append(buffer, r.responseHeader[:]...)
+	if r.version != headerLegacy {
+		buffer = append(buffer, byte(len(r.cipher)))
+		buffer = append(buffer, r.cipher...)
+	}
+	if r.version == headerV2 {
+		buffer = append(buffer, r.exchangeKey.Public[:]...)
+	}
 
 	// add dest address
-	buffer = append(buffer, r.dest.PortByteSlice()...)
+	command := byte(0)
+	if r.mux {
+		command = cmdMux
+	}
+	return appendDestination(buffer, r.dest, command)
+}
 
+func appendDestination(buffer []byte, dest network.Destination, command byte) []byte {
+	buffer = append(buffer, dest.PortByteSlice()...)
+
+	if dest.IsUDP() {
+		command |= cmdUDP
+	}
 	switch {
-	case r.dest.IsIPv4():
-		buffer = append(buffer, addrTypeIPv4)
-		buffer = append(buffer, r.dest.IP()...)
-	case r.dest.IsIPv6():
-		buffer = append(buffer, addrTypeIPv6)
-		buffer = append(buffer, r.dest.IP()...)
-	case r.dest.IsDomain():
-		buffer = append(buffer, addrTypeDomain)
-		domain := []byte(r.dest.Domain())
+	case dest.IsIPv4():
+		buffer = append(buffer, command|addrTypeIPv4)
+		buffer = append(buffer, dest.IP()...)
+	case dest.IsIPv6():
+		buffer = append(buffer, command|addrTypeIPv6)
+		buffer = append(buffer, dest.IP()...)
+	case dest.IsDomain():
+		buffer = append(buffer, command|addrTypeDomain)
+		domain := []byte(dest.Domain())
 		buffer = append(buffer, byte(len(domain)))
 		buffer = append(buffer, domain...)
 	}
+	return buffer
+}
 
-	// add random padding
-	if err := randomPadding(); err != nil {
+func (r *maskRequest) legacyByteSlice(userHash []byte, timeSec int64) ([]byte, error) {
+	buffer, err := appendRandomPadding(make([]byte, 0, 300))
+	if err != nil {
+		return nil, err
+	}
+	buffer = r.appendFields(buffer)
+	if buffer, err = appendRandomPadding(buffer); err != nil {
 		return nil, err
 	}
 
 	// add user hash and encrypt request header
-	// random time: +-30s from current time
-	randomTimeSec := time.Now().Unix() - 30 + mrand.Int63n(61)
-	userHash := cryption.TimeHMACHash(r.userID.Bytes, randomTimeSec)
-
-	aesEncryptStream, err := cryption.NewAESEncryptStream(r.userID.CmdKey(), cryption.Int64Hash(randomTimeSec))
+	aesEncryptStream, err := cryption.NewAESEncryptStream(r.userID.CmdKey(), cryption.Int64Hash(timeSec))
 	if err != nil {
 		return nil, err
 	}
@@ -253,10 +444,148 @@ func (r *maskRequest) encryptedByteSlice() ([]byte, error) {
 	return buffer, nil
 }
 
-type maskResponse [4]byte
+func (r *maskRequest) sealedByteSlice(userHash []byte, timeSec int64) (_ []byte, err error) {
+	if r.version == headerV2 && r.exchangeKey == nil {
+		if r.exchangeKey, err = cryption.NewX25519Key(); err != nil {
+			return nil, err
+		}
+	}
+
+	header := make([]byte, 8, 300)
+	binary.BigEndian.PutUint64(header, uint64(timeSec))
+	header = r.appendFields(header)
+	header, err = appendRandomPadding(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// version | user hash | salt | sealed header
+	buffer := bytes.NewBuffer(make([]byte, 0, 1+len(userHash)+headerSaltLen+len(header)+64))
+	buffer.WriteByte(r.version ^ userHash[0])
+	buffer.Write(userHash)
+	salt := make([]byte, headerSaltLen)
+	cryptrand.Read(salt)
+	buffer.Write(salt)
+
+	sealWriter, err := cryption.NewAEADEncryptWriter(buffer, cryption.CipherAES128GCM, r.userID.Bytes, sealSalt(userHash, salt))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = sealWriter.Write(header); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// result of calling the destination, carried by mask response
+const (
+	statusSucceed = byte(iota)
+	statusGeneralFailure
+	statusConnectionNotAllowed
+	statusNetworkUnreachable
+	statusHostUnreachable
+	statusConnectionRefused
+	statusTimeout
+)
+
+/**
+ * maskResponse answers a request, encrypted with response key and IV
+ * - legacy: response header, as old nodes know it, a failure of calling destination closes the connection instead
+ * - v1 and v2: response header | status
+ *
+ */
+type maskResponse struct {
+	version byte
+	header  [4]byte // same as responseHeader of request
+	status  byte
+}
 
-func newMaskResponse(request *maskRequest) *maskResponse {
-	response := new(maskResponse)
-	copy(response[:], request.responseHeader[:])
+// callErr: the error of calling the destination, nil means success
+func newMaskResponse(request *maskRequest, callErr error) *maskResponse {
+	response := &maskResponse{
+		version: request.version,
+		status:  statusFromError(callErr),
+	}
+	copy(response.header[:], request.responseHeader[:])
 	return response
 }
+
+func readMaskResponse(reader io.Reader, version byte) (response *maskResponse, err error) {
+	buffer := make([]byte, 5)
+	if version == headerLegacy {
+		buffer = buffer[:4]
+	}
+	_, err = io.ReadFull(reader, buffer)
+	if err != nil {
+		return
+	}
+
+	response = &maskResponse{
+		version: version,
+	}
+	copy(response.header[:], buffer[:4])
+	if version != headerLegacy {
+		response.status = buffer[4]
+	}
+	return
+}
+
+func (r *maskResponse) byteSlice() []byte {
+	if r.version == headerLegacy {
+		return r.header[:]
+	}
+	return append(r.header[:], r.status)
+}
+
+// next node works, but fails to call the destination
+// errors.Is works on it with the reasons in package network
+type remoteCallError struct {
+	err error
+}
+
+func (e *remoteCallError) Error() string {
+	return e.err.Error()
+}
+
+func (e *remoteCallError) Unwrap() error {
+	return e.err
+}
+
+// the error of calling the destination, nil if succeed
+func (r *maskResponse) callError() error {
+	switch r.status {
+	case statusSucceed:
+		return nil
+	case statusConnectionNotAllowed:
+		return network.ErrConnectionNotAllowed
+	case statusNetworkUnreachable:
+		return network.ErrNetworkUnreachable
+	case statusHostUnreachable:
+		return network.ErrHostUnreachable
+	case statusConnectionRefused:
+		return network.ErrConnectionRefused
+	case statusTimeout:
+		return network.ErrDialTimeout
+	default:
+		return fmt.Errorf("next node failed to call destination, status %d", r.status)
+	}
+}
+
+func statusFromError(err error) byte {
+	switch {
+	case err == nil:
+		return statusSucceed
+	case errors.Is(err, network.ErrConnectionNotAllowed):
+		return statusConnectionNotAllowed
+	case errors.Is(err, network.ErrNetworkUnreachable):
+		return statusNetworkUnreachable
+	case errors.Is(err, network.ErrHostUnreachable):
+		return statusHostUnreachable
+	case errors.Is(err, network.ErrConnectionRefused):
+		return statusConnectionRefused
+	case errors.Is(err, network.ErrDialTimeout):
+		return statusTimeout
+	default:
+		return statusGeneralFailure
+	}
+}
@@ -0,0 +1,150 @@
+package masker
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"masker/account"
+	"masker/cryption"
+	"masker/network"
+)
+
+var allHeaderVersions = map[byte]bool{headerLegacy: true, headerV1: true, headerV2: true}
+
+func TestMaskRequestHeader(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	userSet, err := account.NewTimedUserSet(user)
+	if err != nil {
+		t.Fatalf("Err in creating user set: %v", err)
+	}
+	defer userSet.Close()
+	dest := network.NewTCPDestination(network.NewDomainAddress("example.com", 443))
+
+	for _, version := range headerVersions {
+		cipher := cryption.CipherChaCha20Poly1305
+		if version == headerLegacy {
+			cipher = legacyCipher
+		}
+		request := newMaskRequest(user, dest, cipher, version)
+		header, err := request.encryptedByteSlice()
+		if err != nil {
+			t.Fatalf("Err in encrypting request of version %d: %v", version, err)
+		}
+
+		// data after header is left for data stream
+		conn := bytes.NewBuffer(append(header, "data"...))
+		read, err := readMaskRequest(conn, userSet, allHeaderVersions)
+		if err != nil {
+			t.Fatalf("Err in reading request of version %d: %v", version, err)
+		}
+		if read.version != version || read.requestKey != request.requestKey || read.requestIV != request.requestIV ||
+			read.responseHeader != request.responseHeader || read.cipher != request.cipher || read.dest.String() != dest.String() {
+			t.Errorf("Read request of version %d %+v, want %+v", version, read, request)
+		}
+		if conn.String() != "data" {
+			t.Errorf("Reading request of version %d leaves %q, want %q", version, conn.String(), "data")
+		}
+
+		// only other versions are accepted
+		others := make(map[byte]bool)
+		for _, other := range headerVersions {
+			others[other] = other != version
+		}
+		_, err = readMaskRequest(bytes.NewReader(header), userSet, others)
+		if !errors.Is(err, errInvalidUser) {
+			t.Errorf("Reading request of version %d not accepted get %v, want %v", version, err, errInvalidUser)
+		}
+	}
+
+	// udp command
+	udpDest := network.NewUDPDestination(network.NewDomainAddress("dns.google", 53))
+	header, _ := newMaskRequest(user, udpDest, cryption.CipherAES128GCM, headerV1).encryptedByteSlice()
+	read, err := readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if err != nil {
+		t.Fatalf("Err in reading udp request: %v", err)
+	}
+	if !read.dest.IsUDP() || read.dest.String() != udpDest.String() {
+		t.Errorf("Read destination %s %s, want udp %s", read.dest.Network(), read.dest.String(), udpDest.String())
+	}
+
+	// user hash of v1 header is hmac-sha256, md5 is for legacy header only
+	header, _ = newMaskRequest(user, dest, cryption.CipherAES128GCM, headerV1).encryptedByteSlice()
+	userHash := header[1 : 1+account.IDBytesLen]
+	if _, _, err = userSet.GetUser(account.HashSHA256, userHash); err != nil {
+		t.Errorf("Err in getting user by hash of v1 header: %v", err)
+	}
+	if _, _, err = userSet.GetUser(account.HashMD5, userHash); err != account.ErrNoSuchUser {
+		t.Errorf("Hash of v1 header taken as md5 get %v, want %v", err, account.ErrNoSuchUser)
+	}
+
+	// legacy header is not authenticated, so it has no cipher to choose, a flipped bit is not taken for one
+	header, _ = newMaskRequest(user, dest, legacyCipher, headerLegacy).encryptedByteSlice()
+	header[account.IDBytesLen] ^= 0x80
+	_, err = readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if !errors.Is(err, errBadPadding) {
+		t.Errorf("Reading legacy request with a flipped bit get %v, want %v", err, errBadPadding)
+	}
+
+	// v1 header is authenticated
+	header, _ = newMaskRequest(user, dest, cryption.CipherAES128GCM, headerV1).encryptedByteSlice()
+	header[len(header)-1] ^= 1
+	_, err = readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if !errors.Is(err, cryption.ErrAuthenticationFailed) {
+		t.Errorf("Reading tampered request get %v, want %v", err, cryption.ErrAuthenticationFailed)
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	userSet, err := account.NewTimedUserSet(user)
+	if err != nil {
+		t.Fatalf("Err in creating user set: %v", err)
+	}
+	defer userSet.Close()
+
+	request := newMaskRequest(user, network.NewTCPDestination(network.NewDomainAddress("example.com", 443)), cryption.CipherAES128GCM, headerV2)
+	header, err := request.encryptedByteSlice()
+	if err != nil {
+		t.Fatalf("Err in encrypting request: %v", err)
+	}
+	read, err := readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if err != nil {
+		t.Fatalf("Err in reading request: %v", err)
+	}
+
+	var conn bytes.Buffer
+	if err = read.acceptExchange(); err != nil {
+		t.Fatalf("Err in accepting key exchange: %v", err)
+	}
+	if err = read.sendExchangeKey(&conn); err != nil {
+		t.Fatalf("Err in sending exchange key: %v", err)
+	}
+	if err = request.receiveExchangeKey(&conn); err != nil {
+		t.Fatalf("Err in receiving exchange key: %v", err)
+	}
+	if request.exchangeKey != nil || read.exchangeKey != nil {
+		t.Errorf("Ephemeral keys should be dropped after key exchange")
+	}
+
+	// both sides get the same keys, which request header alone can't tell
+	callerKey, callerIV := request.requestKeyIV()
+	listenerKey, listenerIV := read.requestKeyIV()
+	if !bytes.Equal(callerKey, listenerKey) || !bytes.Equal(callerIV, listenerIV) {
+		t.Errorf("Request keys differ between caller and listener")
+	}
+	if bytes.Equal(callerKey, request.requestKey[:]) {
+		t.Errorf("Request key should derive from shared key")
+	}
+	callerKey, _ = request.responseKeyIV()
+	listenerKey, _ = read.responseKeyIV()
+	if !bytes.Equal(callerKey, listenerKey) {
+		t.Errorf("Response keys differ between caller and listener")
+	}
+
+	// a low order point is refused
+	read.peerKey = [cryption.X25519KeyLen]byte{}
+	if err = read.acceptExchange(); !errors.Is(err, errBadExchangeKey) {
+		t.Errorf("Key exchange with zero key get %v, want %v", err, errBadExchangeKey)
+	}
+}
@@ -1,26 +1,79 @@
 package masker
 
 import (
-	"crypto/md5"
+	"context"
+	"errors"
+	"io"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"masker/account"
 	"masker/core"
 	"masker/cryption"
 	"masker/log"
+	"masker/network"
 )
 
 type MaskListener struct {
-	node    *core.Node
-	userSet account.UserSet
+	node        *core.Node
+	tag         string
+	userSet     account.UserSet
+	users       map[string]account.User // users in userSet, key: user id text
+	connections map[string]int          // active connections of users, key: user id text
+	handshake   handshakeOptions        // ciphers and header versions that callers may choose
+	mutex       sync.Mutex              // guard the fields above against reloading and admin api
+	replays     *replayFilter           // requests seen, refused if they come again
+	ln          net.Listener
+	stop        chan struct{} // closed to stop enforcing policy
+	stopOnce    sync.Once
 }
 
-func NewMaskListener(node *core.Node, configFile string) (*MaskListener, error) {
+// how often quota of active sessions is checked
+const policyCheckInterval = time.Second
+
+// connections without a request are closed after it, callers keep them in pool for less, see connPool
+const requestTimeout = 2 * time.Minute
+
+func NewMaskListener(node *core.Node, tag string, configFile string) (*MaskListener, error) {
+	userList, options, err := loadListenerUsers(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	userSet, err := account.NewTimedUserSet(userList...)
+	if err != nil {
+		return nil, log.Error("Err in creating user set: %v", err)
+	}
+
+	users := make(map[string]account.User, len(userList))
+	for _, user := range userList {
+		users[user.Id.Text] = user
+	}
+
+	return &MaskListener{
+		node:        node,
+		tag:         tag,
+		userSet:     userSet,
+		users:       users,
+		connections: make(map[string]int),
+		handshake:   options,
+		replays:     newReplayFilter(),
+		stop:        make(chan struct{}),
+	}, nil
+}
+
+// users allowed, and what they may choose in handshake
+func loadListenerUsers(configFile string) ([]account.User, handshakeOptions, error) {
 	config, err := loadListenerConfig(configFile)
 	if err != nil {
 		log.Error("Err in loading mask listener config: %v.", err)
-		return nil, err
+		return nil, handshakeOptions{}, err
+	}
+	options, err := config.handshakeOptions()
+	if err != nil {
+		return nil, handshakeOptions{}, log.Error("Check your config: %v", err)
 	}
 
 	userList := make([]account.User, 0)
@@ -30,18 +83,102 @@ func NewMaskListener(node *core.Node, configFile string) (*MaskListener, error)
 		}
 	}
 	if len(userList) == 0 {
-		return nil, log.Error("Check your config, don't find any allowed user!")
+		return nil, handshakeOptions{}, log.Error("Check your config, don't find any allowed user!")
 	}
+	return userList, options, nil
+}
 
-	userSet, err := account.NewTimedUserSet(userList...)
+// apply changes of user list, users authenticated already keep their connections
+// users added or removed by AddUser and RemoveUser are overridden too
+// policies of existing users are replaced, and apply to their active sessions
+func (listener *MaskListener) Reload(configFile string) error {
+	userList, options, err := loadListenerUsers(configFile)
 	if err != nil {
-		return nil, log.Error("Err in creating user set: %v", err)
+		return err
 	}
 
-	return &MaskListener{
-		node:    node,
-		userSet: userSet,
-	}, nil
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	listener.handshake = options
+
+	users := make(map[string]account.User, len(userList))
+	for _, user := range userList {
+		users[user.Id.Text] = user
+		if _, ok := listener.users[user.Id.Text]; !ok {
+			err = listener.addUser(user)
+		} else {
+			err = listener.updateUser(user)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for text, user := range listener.users {
+		if _, ok := users[text]; !ok {
+			if err = listener.removeUser(user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// add a user at runtime, config file is not changed
+func (listener *MaskListener) AddUser(user account.User) error {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if _, ok := listener.users[user.Id.Text]; ok {
+		return log.Error("User %s already exists in inbound %s.", user.Id.Text, listener.tag)
+	}
+	return listener.addUser(user)
+}
+
+// remove a user at runtime, config file is not changed
+func (listener *MaskListener) RemoveUser(user account.User) error {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	existing, ok := listener.users[user.Id.Text]
+	if !ok {
+		return log.Error("No user %s in inbound %s.", user.Id.Text, listener.tag)
+	}
+	return listener.removeUser(existing)
+}
+
+// users sorted by id
+func (listener *MaskListener) ListUsers() []account.User {
+	return listener.userSet.ListUsers()
+}
+
+// must hold the mutex
+func (listener *MaskListener) addUser(user account.User) error {
+	if err := listener.userSet.AddUser(user); err != nil {
+		return log.Error("Err in adding user %s: %v", user.Id.Text, err)
+	}
+	listener.users[user.Id.Text] = user
+	log.Info("User %s is added to inbound %s.", user.Id.Text, listener.tag)
+	return nil
+}
+
+// must hold the mutex
+func (listener *MaskListener) updateUser(user account.User) error {
+	if err := listener.userSet.UpdateUser(user); err != nil {
+		return log.Error("Err in updating user %s: %v", user.Id.Text, err)
+	}
+	listener.users[user.Id.Text] = user
+	return nil
+}
+
+// must hold the mutex
+func (listener *MaskListener) removeUser(user account.User) error {
+	if err := listener.userSet.RemoveUser(user); err != nil {
+		return log.Error("Err in removing user %s: %v", user.Id.Text, err)
+	}
+	delete(listener.users, user.Id.Text)
+	log.Info("User %s is removed from inbound %s.", user.Id.Text, listener.tag)
+	return nil
 }
 
 func (listener *MaskListener) Listen(port uint16) error {
@@ -51,69 +188,351 @@ func (listener *MaskListener) Listen(port uint16) error {
 	}
 	log.Info("Listening on port: %d...", port)
 
+	listener.ln = ln
 	go listener.acceptConnection(ln)
+	go listener.enforcePolicy()
 	return nil
 }
 
+func (listener *MaskListener) Close() error {
+	listener.stopOnce.Do(func() { close(listener.stop) })
+	listener.userSet.Close()
+	if listener.ln == nil {
+		return nil
+	}
+	return listener.ln.Close()
+}
+
+// take a connection of user if its policy allows, release it when the connection ends
+func (listener *MaskListener) acquireConnection(userID *account.ID) error {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	user, ok := listener.users[userID.Text]
+	if !ok {
+		return account.ErrNoSuchUser
+	}
+	if err := user.CheckQuota(listener.node.MonthlyUsage(userID.Text)); err != nil {
+		return err
+	}
+	if err := user.CheckConnections(listener.connections[userID.Text]); err != nil {
+		return err
+	}
+	listener.connections[userID.Text]++
+	return nil
+}
+
+func (listener *MaskListener) handshakeOptions() handshakeOptions {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	return listener.handshake
+}
+
+// cipher must be allowed by both listener and user
+func (listener *MaskListener) checkCipher(request *maskRequest, options handshakeOptions) error {
+	if !options.ciphers[request.cipher] {
+		return account.ErrCipherNotAllowed
+	}
+
+	listener.mutex.Lock()
+	user, ok := listener.users[request.userID.Text]
+	listener.mutex.Unlock()
+	if !ok {
+		return account.ErrNoSuchUser
+	}
+	return user.CheckCipher(request.cipher)
+}
+
+func (listener *MaskListener) releaseConnection(userID *account.ID) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.connections[userID.Text]--; listener.connections[userID.Text] <= 0 {
+		delete(listener.connections, userID.Text)
+	}
+}
+
+// cut active sessions of users whose quota runs out
+func (listener *MaskListener) enforcePolicy() {
+	ticker := time.NewTicker(policyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-listener.stop:
+			return
+		}
+
+		for _, session := range listener.node.Sessions() {
+			if session.InboundTag != listener.tag || session.Account == nil {
+				continue
+			}
+			listener.mutex.Lock()
+			user, ok := listener.users[session.Account.Text]
+			listener.mutex.Unlock()
+			if !ok {
+				continue
+			}
+			if err := user.CheckQuota(listener.node.MonthlyUsage(session.User)); err != nil {
+				log.Warning("Session %v of user %s is cut: %v", session, session.User, err)
+				listener.node.KillSession(session.ID)
+			}
+		}
+	}
+}
+
 func (listener *MaskListener) acceptConnection(ln net.Listener) {
 	// set max handle connections?
 	for true {
 		conn, err := ln.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			log.Info("Stop listening on %v.", ln.Addr())
+			return
+		} else if err != nil {
 			log.Error("Err in accepting socket connection: %v.", err)
-		} else {
+		} else if listener.node.AddConnection(conn) {
 			go listener.handleConnection(conn)
+		} else {
+			conn.Close()
 		}
 	}
 }
 
+func (listener *MaskListener) stopped() bool {
+	select {
+	case <-listener.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// reading request ends by requestTimeout, or once listener is closed, connections idle in pools of callers are not waited for
+func (listener *MaskListener) waitRequest(conn net.Conn) (stop func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	go func() {
+		select {
+		case <-listener.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	unbind := network.BindContext(ctx, conn)
+	return func() {
+		unbind()
+		cancel()
+	}
+}
+
 func (listener *MaskListener) handleConnection(conn net.Conn) error {
+	defer listener.node.RemoveConnection(conn)
 	defer conn.Close()
+	session := listener.node.NewSession(listener.tag, conn)
+	defer listener.node.EndSession(session)
 
 	// read request
-	maskRequest, err := readMaskRequest(conn, listener.userSet)
-	if err != nil {
-		log.Error("Err in reading mask request: %v", err)
+	options := listener.handshakeOptions()
+	stopWaiting := listener.waitRequest(conn)
+	maskRequest, err := readMaskRequest(conn, listener.userSet, options.versions)
+	stopWaiting()
+	if err != nil && listener.stopped() {
+		log.Debug("Connection from %v without a request is closed on stop.", conn.RemoteAddr())
+		return err
+	} else if err != nil {
+		log.Error("Err in reading mask request from %v: %v", conn.RemoteAddr(), err)
+		core.RecordHandshakeFailure(listener.tag, handshakeFailureReason(err))
 		return err
 	}
+	if err = listener.checkCipher(maskRequest, options); err != nil {
+		log.Warning("Refuse cipher %s of user %s from %v.", maskRequest.cipher, maskRequest.userID.Text, conn.RemoteAddr())
+		core.RecordHandshakeFailure(listener.tag, handshakeFailureReason(err))
+		return err
+	}
+	if maskRequest.version == headerV2 {
+		if err = maskRequest.acceptExchange(); err != nil {
+			log.Warning("Refuse user %s from %v: %v", maskRequest.userID.Text, conn.RemoteAddr(), err)
+			core.RecordHandshakeFailure(listener.tag, handshakeFailureReason(err))
+			return err
+		}
+	}
+	if !listener.replays.firstSeen(maskRequest) {
+		log.Warning("Replay attempt from %v with user %s, refused.", conn.RemoteAddr(), maskRequest.userID.Text)
+		core.RecordHandshakeFailure(listener.tag, handshakeFailureReason(errReplayedRequest))
+		return errReplayedRequest
+	}
+	if maskRequest.mux {
+		return listener.serveMux(conn, maskRequest, options.maxStreams)
+	}
+	if err = listener.acquireConnection(maskRequest.userID); err != nil {
+		log.Warning("Refuse user %s from %v: %v", maskRequest.userID.Text, conn.RemoteAddr(), err)
+		core.RecordHandshakeFailure(listener.tag, handshakeFailureReason(err))
+		return err
+	}
+	defer listener.releaseConnection(maskRequest.userID)
+	session.User = maskRequest.userID.Text
+	session.Account = maskRequest.userID
+	session.Destination = maskRequest.dest
+
+	// call destination, then tell client the result
+	ctx, cancel := context.WithTimeout(context.Background(), core.DialTimeout)
+	channel, callErr := listener.node.NewConnectionAccept(ctx, session)
+	cancel()
+	if callErr != nil {
+		log.Error("Session %v: err in calling %s: %v", session, maskRequest.dest.String(), callErr)
+	}
 
-	channel, err := listener.node.NewConnectionAccept(maskRequest.dest)
+	encryptWriter, err := sendResponse(conn, maskRequest, callErr)
 	if err != nil {
-		log.Error("Err in calling destination: %v", err)
 		return err
 	}
-	readFinish := make(chan bool, 1)
-	writeFinish := make(chan bool, 1)
+	if callErr != nil {
+		return callErr
+	}
 
 	// transmit request
-	decryptReader, err := cryption.NewAESDecryptReader(conn, maskRequest.requestKey[:], maskRequest.requestIV[:])
+	key, IV := maskRequest.requestKeyIV()
+	decryptReader, err := cryption.NewDecryptReader(maskRequest.cipher, conn, key, IV)
 	if err != nil {
 		log.Error("Err in creating decrypt reader: %v", err)
 		return err
 	}
-	go channel.ForwardChannel.Input(decryptReader, readFinish)
+	readFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Input(newDataReader(newTamperGuard(decryptReader, channel.Close), maskRequest.version), readFinish)
 
-	// send response
-	key := md5.Sum(maskRequest.requestKey[:])
-	IV := md5.Sum(maskRequest.requestIV[:])
-	encryptWriter, err := cryption.NewAESEncryptWriter(conn, key[:], IV[:])
+	// transmit response
+	writeFinish := make(chan bool, 1)
+	go channel.BackwardChannel.Output(newDataWriter(encryptWriter, maskRequest.version), writeFinish)
+
+	<-writeFinish
+	<-readFinish
+	return nil
+}
+
+// send response with the result of calling destination
+// return the writer to encrypt data after response
+func sendResponse(writer io.Writer, request *maskRequest, callErr error) (cryption.EncryptWriter, error) {
+	// legacy response has no status, old nodes take a closed connection for the failure
+	if request.version == headerLegacy && callErr != nil {
+		return nil, callErr
+	}
+	if request.version == headerV2 {
+		if err := request.sendExchangeKey(writer); err != nil {
+			log.Error("Err in sending exchange key: %v", err)
+			return nil, err
+		}
+	}
+	key, IV := request.responseKeyIV()
+	encryptWriter, err := cryption.NewEncryptWriter(request.cipher, writer, key, IV)
 	if err != nil {
 		log.Error("Err in creating encrypt writer: %v", err)
-		return err
+		return nil, err
 	}
 
-	response := newMaskResponse(maskRequest)
-	buffer := make([]byte, 0, 1024)
-	buffer = append(buffer, response[:]...)
-	if payload, ok := channel.BackwardChannel.Pop(); ok {
-		buffer = append(buffer, payload...)
-		encryptWriter.Write(buffer)
-		go channel.BackwardChannel.Output(encryptWriter, writeFinish)
-		<-writeFinish
-	} else {
-		log.Error("Err in first response block.")
+	response := newMaskResponse(request, callErr)
+	if _, err = encryptWriter.Write(response.byteSlice()); err != nil {
+		log.Error("Err in sending mask response: %v", err)
+		return nil, err
 	}
+	return encryptWriter, nil
+}
 
-	<-readFinish
+// streams of a mux connection are sessions of their own, return once all of them end
+func (listener *MaskListener) serveMux(conn net.Conn, request *maskRequest, maxStreams int) error {
+	encryptWriter, err := sendResponse(conn, request, nil)
+	if err != nil {
+		return err
+	}
+	key, IV := request.requestKeyIV()
+	decryptReader, err := cryption.NewDecryptReader(request.cipher, conn, key, IV)
+	if err != nil {
+		log.Error("Err in creating decrypt reader: %v", err)
+		return err
+	}
+	log.Info("Mux connection of user %s from %v.", request.userID.Text, conn.RemoteAddr())
+
+	var streams sync.WaitGroup
+	muxSession := newMuxSession(conn, decryptReader, encryptWriter, maxStreams)
+	muxSession.accept = func(stream *muxStream) {
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			listener.handleMuxStream(stream, request.userID)
+		}()
+	}
+	muxSession.run()
+	streams.Wait()
 	return nil
 }
+
+// like a connection after handshake, except that policy of user is checked for each stream
+func (listener *MaskListener) handleMuxStream(stream *muxStream, userID *account.ID) {
+	defer stream.Close()
+	session := listener.node.NewSession(listener.tag, stream)
+	defer listener.node.EndSession(session)
+
+	if err := listener.acquireConnection(userID); err != nil {
+		log.Warning("Refuse stream of user %s from %v: %v", userID.Text, stream.RemoteAddr(), err)
+		stream.reply(err)
+		return
+	}
+	defer listener.releaseConnection(userID)
+	session.User = userID.Text
+	session.Account = userID
+	session.Destination = stream.dest
+
+	ctx, cancel := context.WithTimeout(context.Background(), core.DialTimeout)
+	channel, callErr := listener.node.NewConnectionAccept(ctx, session)
+	cancel()
+	if callErr != nil {
+		log.Error("Session %v: err in calling %s: %v", session, stream.dest.String(), callErr)
+	}
+	if err := stream.reply(callErr); err != nil || callErr != nil {
+		return
+	}
+
+	readFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Input(stream, readFinish)
+
+	writeFinish := make(chan bool, 1)
+	go channel.BackwardChannel.Output(stream, writeFinish)
+
+	network.CloseConnection(stream, readFinish, writeFinish, channel.Done())
+}
+
+func handshakeFailureReason(err error) string {
+	switch {
+	case errors.Is(err, errInvalidUser):
+		return core.HandshakeInvalidUser
+	case errors.Is(err, errBadPadding):
+		return "bad_padding"
+	case errors.Is(err, errUnsupportedAddressType):
+		return core.HandshakeUnsupportedAddress
+	case errors.Is(err, errReplayedRequest):
+		return "replay"
+	case errors.Is(err, errUnsupportedCipher):
+		return "unsupported_cipher"
+	case errors.Is(err, account.ErrCipherNotAllowed):
+		return "cipher_not_allowed"
+	case errors.Is(err, errBadTimestamp):
+		return "bad_timestamp"
+	case errors.Is(err, errBadExchangeKey):
+		return "bad_exchange_key"
+	case errors.Is(err, cryption.ErrAuthenticationFailed):
+		return "bad_header"
+	case errors.Is(err, account.ErrNoSuchUser):
+		return core.HandshakeInvalidUser
+	case errors.Is(err, account.ErrUserDisabled):
+		return "user_disabled"
+	case errors.Is(err, account.ErrUserExpired):
+		return "user_expired"
+	case errors.Is(err, account.ErrQuotaExceeded):
+		return "quota_exceeded"
+	case errors.Is(err, account.ErrTooManyConnections):
+		return "too_many_connections"
+	default:
+		return core.HandshakeReadError
+	}
+}
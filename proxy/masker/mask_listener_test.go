@@ -0,0 +1,258 @@
+package masker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"masker/account"
+	"masker/core"
+	"masker/cryption"
+	"masker/network"
+)
+
+// fakeCaller accepts every call
+type fakeCaller struct{}
+
+func (fakeCaller) Call(ctx context.Context, session *core.Session, channel core.FullDuplexChannel) error {
+	return nil
+}
+
+func (fakeCaller) Close() error {
+	return nil
+}
+
+type fakeCallerConstructor struct{}
+
+func (fakeCallerConstructor) Create(configFile string) (core.Caller, error) {
+	return fakeCaller{}, nil
+}
+
+const testUserID = "a90779d4-f0e8-456a-8a12-a84387c58b4d"
+
+func init() {
+	core.RegisterCallerConstructor("mask-fake", fakeCallerConstructor{})
+}
+
+func newTestListener(t *testing.T, users ...account.User) *MaskListener {
+	node, err := core.NewNode(core.NodeConfig{
+		Outbounds: []core.OutboundConfig{{Tag: "out", ConnectionConfig: core.ConnectionConfig{Protocol: "mask-fake"}}},
+	})
+	if err != nil {
+		t.Fatalf("Err in creating node: %v", err)
+	}
+	userSet, _ := account.NewTimedUserSet(users...)
+
+	listener := &MaskListener{
+		node:        node,
+		tag:         "in",
+		userSet:     userSet,
+		users:       make(map[string]account.User),
+		connections: make(map[string]int),
+		handshake: handshakeOptions{
+			ciphers:    map[string]bool{cryption.CipherAES128GCM: true},
+			versions:   allHeaderVersions,
+			maxStreams: defaultListenerMaxStreams,
+		},
+		replays: newReplayFilter(),
+		stop:    make(chan struct{}),
+	}
+	for _, user := range users {
+		listener.users[user.Id.Text] = user
+	}
+	return listener
+}
+
+func newTestUser(t *testing.T, id string, policy account.Policy) account.User {
+	userID, err := account.NewID(id)
+	if err != nil {
+		t.Fatalf("Err in creating user id: %v", err)
+	}
+	return account.User{Id: userID, Policy: policy}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{MaxConnections: 2})
+	listener := newTestListener(t, user)
+
+	for i := 0; i < 2; i++ {
+		if err := listener.acquireConnection(user.Id); err != nil {
+			t.Fatalf("Err in acquiring connection %d: %v", i, err)
+		}
+	}
+	if err := listener.acquireConnection(user.Id); err != account.ErrTooManyConnections {
+		t.Errorf("Third connection get %v, want %v", err, account.ErrTooManyConnections)
+	}
+	listener.releaseConnection(user.Id)
+	if err := listener.acquireConnection(user.Id); err != nil {
+		t.Errorf("Err in acquiring connection after release: %v", err)
+	}
+
+	other := newTestUser(t, "0d6f4c71-f78c-432a-9f71-194cb63e646f", account.Policy{})
+	if err := listener.acquireConnection(other.Id); err != account.ErrNoSuchUser {
+		t.Errorf("Unknown user get %v, want %v", err, account.ErrNoSuchUser)
+	}
+}
+
+func TestQuotaCutsSession(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{MonthlyQuota: 10})
+	listener := newTestListener(t, user)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	session := listener.node.NewSession(listener.tag, conn)
+	session.User = user.Id.Text
+	session.Account = user.Id
+	session.Destination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+	channel, err := listener.node.NewConnectionAccept(context.Background(), session)
+	if err != nil {
+		t.Fatalf("Err in accepting connection: %v", err)
+	}
+
+	finish := make(chan bool, 2)
+	go channel.ForwardChannel.Input(bytes.NewReader([]byte("more than ten bytes")), finish)
+	go channel.ForwardChannel.Output(io.Discard, finish)
+	<-finish
+	<-finish
+
+	go listener.enforcePolicy()
+	defer close(listener.stop)
+	select {
+	case <-channel.Done():
+	case <-time.After(3 * policyCheckInterval):
+		t.Errorf("Session should be cut when quota is used up")
+	}
+
+	if err = listener.acquireConnection(user.Id); err != account.ErrQuotaExceeded {
+		t.Errorf("New connection get %v, want %v", err, account.ErrQuotaExceeded)
+	}
+}
+
+func TestCipherNegotiation(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	pinned := newTestUser(t, "0d6f4c71-f78c-432a-9f71-194cb63e646f", account.Policy{Cipher: cryption.CipherChaCha20Poly1305})
+	listener := newTestListener(t, user, pinned)
+	listener.handshake.ciphers[cryption.CipherChaCha20Poly1305] = true
+	dest := network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+
+	for _, test := range []struct {
+		user    account.User
+		cipher  string
+		allowed bool
+	}{
+		{user, cryption.CipherAES128GCM, true},
+		{user, cryption.CipherChaCha20Poly1305, true},
+		{user, cryption.CipherAES128CFB, false},
+		{user, cryption.CipherNone, false},
+		{pinned, cryption.CipherChaCha20Poly1305, true},
+		{pinned, cryption.CipherAES128GCM, false},
+	} {
+		client, conn := net.Pipe()
+		go listener.handleConnection(conn)
+
+		request := newMaskRequest(test.user, dest, test.cipher, headerV1)
+		_, _, err := handshake(context.Background(), client, request)
+		client.Close()
+		if test.allowed != (err == nil) {
+			t.Errorf("Handshake of user %s with cipher %s get %v, allowed: %v", test.user.Id.Text, test.cipher, err, test.allowed)
+		}
+	}
+}
+
+func TestTamperedStream(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	listener := newTestListener(t, user)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	closed := make(chan struct{})
+	go func() {
+		listener.handleConnection(conn)
+		close(closed)
+	}()
+
+	request := newMaskRequest(user, network.NewTCPDestination(network.NewDomainAddress("example.com", 80)), cryption.CipherAES128GCM, headerV2)
+	if _, _, err := handshake(context.Background(), client, request); err != nil {
+		t.Fatalf("Err in handshake: %v", err)
+	}
+
+	// flip a bit of the first chunk after request
+	var sealed bytes.Buffer
+	key, IV := request.requestKeyIV()
+	encryptWriter, _ := cryption.NewEncryptWriter(request.cipher, &sealed, key, IV)
+	newMaskStreamWriter(encryptWriter).Write([]byte("data"))
+	tampered := sealed.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	client.Write(tampered)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("Connection should be cut after a tampered chunk")
+	}
+}
+
+// old nodes read a response of 4 bytes, without status
+func TestLegacyResponse(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	listener := newTestListener(t, user)
+	listener.handshake.ciphers[cryption.CipherAES128CFB] = true
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go listener.handleConnection(conn)
+
+	request := newMaskRequest(user, network.NewTCPDestination(network.NewDomainAddress("example.com", 80)), cryption.CipherAES128CFB, headerLegacy)
+	if err := sendRequest(client, request); err != nil {
+		t.Fatalf("Err in sending request: %v", err)
+	}
+	key, IV := request.responseKeyIV()
+	decryptReader, _ := cryption.NewDecryptReader(request.cipher, client, key, IV)
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(decryptReader, header); err != nil {
+		t.Fatalf("Err in reading response: %v", err)
+	}
+	if !bytes.Equal(header, request.responseHeader[:]) {
+		t.Errorf("Response header get %x, want %x", header, request.responseHeader)
+	}
+
+	// nothing follows until destination sends data
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if nBytes, err := decryptReader.Read(make([]byte, 1)); nBytes != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read after response get %d bytes, %v, want a timeout", nBytes, err)
+	}
+}
+
+// policy of user applies to each stream of a mux connection
+func TestMuxStreamPolicy(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{MaxConnections: 1})
+	listener := newTestListener(t, user)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go listener.handleConnection(conn)
+
+	request := newMaskRequest(user, muxHeaderDestination, cryption.CipherAES128GCM, headerV2)
+	request.mux = true
+	encryptWriter, decryptReader, err := handshake(context.Background(), client, request)
+	if err != nil {
+		t.Fatalf("Err in handshake: %v", err)
+	}
+	session := newMuxSession(client, decryptReader, encryptWriter, defaultCallerMaxStreams)
+	go session.run()
+	defer session.Close()
+
+	dest := network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+	if _, err = session.openStream(context.Background(), dest); err != nil {
+		t.Fatalf("Err in opening the first stream: %v", err)
+	}
+	var remoteErr *remoteCallError
+	if _, err = session.openStream(context.Background(), dest); !errors.As(err, &remoteErr) {
+		t.Errorf("Open a stream over connection limit get %v, want it refused by next node", err)
+	}
+}
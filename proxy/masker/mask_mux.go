@@ -0,0 +1,683 @@
+package masker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"masker/cryption"
+	"masker/log"
+	"masker/network"
+)
+
+/**
+ * Mux carries many streams over one mask connection, after a mask request with command mux
+ * - frame: type (1 byte) | stream id (4 bytes, big endian) | data length (2 bytes, big endian) | data
+ * - caller opens a stream by open with its destination, listener calls it, then answers by reply with the status
+ * - data of a stream is limited by the window of the other side, which grows by window as data is read
+ * - fin ends a stream in one direction, reset aborts it in both
+ * - both sides ping every muxKeepaliveInterval, a connection silent for muxIdleTimeout is dead
+ *
+ */
+const (
+	frameOpen   = byte(iota + 1) // destination, caller to listener
+	frameReply                   // status of calling destination, listener to caller
+	frameData                    // data
+	frameFin                     // no data
+	frameReset                   // no data
+	frameWindow                  // window increment (4 bytes, big endian)
+	framePing                    // anything, answered by pong with the same data, stream 0
+	framePong                    // data of ping
+)
+
+const (
+	muxFrameHeaderLen    = 7
+	maxMuxFrameDataLen   = 0x3FFF - muxFrameHeaderLen // a frame in one chunk of aead ciphers
+	muxInitialWindow     = 256 * 1024
+	muxKeepaliveInterval = 30 * time.Second
+	muxIdleTimeout       = 3 * muxKeepaliveInterval
+
+	defaultCallerMaxStreams   = 8
+	defaultListenerMaxStreams = 64
+)
+
+// destination of mux request header, streams carry their own
+var muxHeaderDestination = network.NewTCPDestination(network.NewDomainAddress("", 0))
+
+var (
+	errMuxClosed        = errors.New("mux connection is closed")
+	errMuxStreamReset   = errors.New("mux stream is reset")
+	errMuxStreamRefused = errors.New("mux stream is refused")
+	errMuxProtocol      = errors.New("mux protocol violated")
+)
+
+type muxSession struct {
+	conn       net.Conn // closed with session, deadlines of frames are set on it
+	reader     io.Reader
+	writer     io.Writer
+	writeMutex sync.Mutex // frames are written whole
+	buffer     []byte     // of a frame, guarded by writeMutex
+
+	accept    func(*muxStream) // listener side, called for each stream opened by the other side, must not block
+	closeIdle bool             // caller side, close once no stream is open for muxIdleTimeout
+	onClose   func()
+	onPong    func(rtt time.Duration) // caller side, round trip of keepalive ping
+
+	mutex      sync.Mutex // guard the fields below
+	streams    map[uint32]*muxStream
+	maxStreams int
+	lastID     uint32
+	idleSince  time.Time // zero if any stream is open
+	closed     bool
+	done       chan struct{}
+}
+
+// reader and writer of the data stream after mask response, which are on conn
+func newMuxSession(conn net.Conn, reader io.Reader, writer io.Writer, maxStreams int) *muxSession {
+	return &muxSession{
+		conn:       conn,
+		reader:     reader,
+		writer:     writer,
+		buffer:     make([]byte, muxFrameHeaderLen+maxMuxFrameDataLen),
+		streams:    make(map[uint32]*muxStream),
+		maxStreams: maxStreams,
+		idleSince:  time.Now(),
+		done:       make(chan struct{}),
+	}
+}
+
+// read frames until the connection fails or closes, then close the session
+func (session *muxSession) run() {
+	go session.keepalive()
+
+	err := session.readFrames()
+	if errors.Is(err, cryption.ErrAuthenticationFailed) {
+		log.Warning("Tampered data in mask stream, cut the connection.")
+	} else if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		log.Warning("Mux connection to %v ends: %v", session.conn.RemoteAddr(), err)
+	}
+	session.Close()
+}
+
+func (session *muxSession) readFrames() error {
+	header := make([]byte, muxFrameHeaderLen)
+	data := make([]byte, maxMuxFrameDataLen)
+	for {
+		session.conn.SetReadDeadline(time.Now().Add(muxIdleTimeout))
+		if _, err := io.ReadFull(session.reader, header); err != nil {
+			return err
+		}
+		frameType := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		dataLen := int(binary.BigEndian.Uint16(header[5:7]))
+		if dataLen > maxMuxFrameDataLen {
+			return fmt.Errorf("%w: frame of %d bytes", errMuxProtocol, dataLen)
+		}
+		if _, err := io.ReadFull(session.reader, data[:dataLen]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		if err := session.handleFrame(frameType, id, data[:dataLen]); err != nil {
+			return err
+		}
+	}
+}
+
+// errors returned cut the whole connection, those of a stream only reset it
+// frames are written in background, reading never waits for writing, which may wait for the other side reading
+func (session *muxSession) handleFrame(frameType byte, id uint32, data []byte) error {
+	switch frameType {
+	case framePing:
+		go session.writeFrame(framePong, 0, append([]byte(nil), data...))
+		return nil
+	case framePong:
+		// data is the time of ping sent by keepalive
+		if session.onPong != nil && len(data) == 8 {
+			session.onPong(time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(data)))))
+		}
+		return nil
+	case frameOpen:
+		return session.acceptStream(id, data)
+	}
+
+	session.mutex.Lock()
+	stream, ok := session.streams[id]
+	session.mutex.Unlock()
+	if !ok {
+		// closed already, frames sent before knowing it are dropped
+		return nil
+	}
+
+	switch frameType {
+	case frameReply:
+		if len(data) != 1 {
+			return fmt.Errorf("%w: reply of %d bytes", errMuxProtocol, len(data))
+		}
+		stream.receiveReply((&maskResponse{status: data[0]}).callError())
+	case frameData:
+		if err := stream.receiveData(data); err != nil {
+			log.Warning("Reset mux stream %d: %v", id, err)
+			go stream.Close()
+		}
+	case frameFin:
+		stream.receiveFin()
+	case frameReset:
+		stream.fail(errMuxStreamReset)
+		session.removeStream(id)
+	case frameWindow:
+		if len(data) != 4 {
+			return fmt.Errorf("%w: window of %d bytes", errMuxProtocol, len(data))
+		}
+		stream.receiveWindowUpdate(int(binary.BigEndian.Uint32(data)))
+	default:
+		return fmt.Errorf("%w: unknown frame type %d", errMuxProtocol, frameType)
+	}
+	return nil
+}
+
+// listener side, streams over maxStreams are refused by reset
+func (session *muxSession) acceptStream(id uint32, data []byte) error {
+	if session.accept == nil {
+		return fmt.Errorf("%w: stream opened by listener", errMuxProtocol)
+	}
+	dest, command, err := readDestination(bytes.NewReader(data))
+	if err == nil && command&cmdMux != 0 {
+		err = fmt.Errorf("%w: %v", errUnsupportedAddressType, command)
+	}
+	if err != nil {
+		return err
+	}
+
+	session.mutex.Lock()
+	if _, ok := session.streams[id]; ok {
+		session.mutex.Unlock()
+		return fmt.Errorf("%w: stream %d opened twice", errMuxProtocol, id)
+	}
+	if len(session.streams) >= session.maxStreams {
+		session.mutex.Unlock()
+		log.Warning("Refuse mux stream to %s from %v, %d streams open already.", dest.String(), session.conn.RemoteAddr(), session.maxStreams)
+		go session.writeFrame(frameReset, id, nil)
+		return nil
+	}
+	stream := newMuxStream(session, id, dest)
+	session.addStream(stream)
+	session.mutex.Unlock()
+
+	session.accept(stream)
+	return nil
+}
+
+// caller side, return once listener replies
+func (session *muxSession) openStream(ctx context.Context, dest network.Destination) (*muxStream, error) {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return nil, errMuxClosed
+	}
+	if len(session.streams) >= session.maxStreams {
+		session.mutex.Unlock()
+		return nil, errMuxStreamRefused
+	}
+	session.lastID++
+	stream := newMuxStream(session, session.lastID, dest)
+	session.addStream(stream)
+	session.mutex.Unlock()
+
+	if err := session.writeFrame(frameOpen, stream.id, appendDestination(nil, dest, 0)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	select {
+	case err := <-stream.replied:
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	case <-ctx.Done():
+		stream.Close()
+		return nil, network.ClassifyDialError(ctx.Err())
+	case <-session.done:
+		return nil, errMuxClosed
+	}
+}
+
+// whether another stream can be opened
+func (session *muxSession) available() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	return !session.closed && len(session.streams) < session.maxStreams
+}
+
+// the other side refuses more streams than those open now
+func (session *muxSession) refuse() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.maxStreams = len(session.streams)
+}
+
+// must hold the mutex
+func (session *muxSession) addStream(stream *muxStream) {
+	session.streams[stream.id] = stream
+	session.idleSince = time.Time{}
+}
+
+func (session *muxSession) removeStream(id uint32) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	delete(session.streams, id)
+	if len(session.streams) == 0 {
+		session.idleSince = time.Now()
+	}
+}
+
+func (session *muxSession) writeFrame(frameType byte, id uint32, data []byte) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	frame := session.buffer[:muxFrameHeaderLen+len(data)]
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint16(frame[5:7], uint16(len(data)))
+	copy(frame[muxFrameHeaderLen:], data)
+
+	session.conn.SetWriteDeadline(time.Now().Add(muxIdleTimeout))
+	if _, err := session.writer.Write(frame); err != nil {
+		session.Close()
+		return err
+	}
+	return nil
+}
+
+func (session *muxSession) keepalive() {
+	ticker := time.NewTicker(muxKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-session.done:
+			return
+		}
+
+		session.mutex.Lock()
+		idle := !session.idleSince.IsZero() && time.Since(session.idleSince) >= muxIdleTimeout
+		session.mutex.Unlock()
+		if session.closeIdle && idle {
+			session.Close()
+			return
+		}
+
+		var ping [8]byte
+		binary.BigEndian.PutUint64(ping[:], uint64(time.Now().UnixNano()))
+		if session.writeFrame(framePing, 0, ping[:]) != nil {
+			return
+		}
+	}
+}
+
+// close the connection, streams still open fail
+func (session *muxSession) Close() error {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return nil
+	}
+	session.closed = true
+	close(session.done)
+	streams := session.streams
+	session.streams = make(map[uint32]*muxStream)
+	session.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(errMuxClosed)
+	}
+	err := session.conn.Close()
+	if session.onClose != nil {
+		session.onClose()
+	}
+	return err
+}
+
+/**
+ * muxStream implement interface net.Conn, so that it is relayed like a connection
+ * data received is buffered up to muxInitialWindow, so that a slow stream never blocks the others
+ * deadlines work like those of net.Conn, for timeout of channels
+ *
+ */
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	dest    network.Destination
+	replied chan error // caller side, result of open
+
+	mutex         sync.Mutex // guard the fields below
+	received      bytes.Buffer
+	receiveWindow int // bytes the other side may send more
+	unacked       int // bytes read, not given back to the other side by window yet
+	sendWindow    int // bytes this side may send more
+	finReceived   bool
+	finSent       bool
+	err           error         // stream fails, reading and writing fail too
+	readable      chan struct{} // signalled once data, fin or failure comes
+	writable      chan struct{} // signalled once window grows or stream fails
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newMuxStream(session *muxSession, id uint32, dest network.Destination) *muxStream {
+	return &muxStream{
+		session:       session,
+		id:            id,
+		dest:          dest,
+		replied:       make(chan error, 1),
+		receiveWindow: muxInitialWindow,
+		sendWindow:    muxInitialWindow,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+	}
+}
+
+func signal(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// wait for notify until deadline, zero deadline means no limit
+func wait(notify chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-notify
+		return nil
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-notify:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (stream *muxStream) receiveReply(err error) {
+	if err != nil {
+		err = &remoteCallError{err}
+	}
+	select {
+	case stream.replied <- err:
+	default:
+	}
+}
+
+// the other side sending more than the window is a fault
+func (stream *muxStream) receiveData(data []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	if stream.finReceived {
+		return fmt.Errorf("%w: data after fin", errMuxProtocol)
+	}
+	if len(data) > stream.receiveWindow {
+		return fmt.Errorf("%w: %d bytes over window %d", errMuxProtocol, len(data), stream.receiveWindow)
+	}
+	stream.receiveWindow -= len(data)
+	stream.received.Write(data)
+	signal(stream.readable)
+	return nil
+}
+
+func (stream *muxStream) receiveFin() {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.finReceived = true
+	signal(stream.readable)
+}
+
+func (stream *muxStream) receiveWindowUpdate(increment int) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+
+	stream.sendWindow += increment
+	signal(stream.writable)
+}
+
+// a reset before reply means the stream is refused
+func (stream *muxStream) fail(err error) {
+	stream.mutex.Lock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.mutex.Unlock()
+
+	signal(stream.readable)
+	signal(stream.writable)
+	if errors.Is(err, errMuxStreamReset) {
+		err = errMuxStreamRefused
+	}
+	select {
+	case stream.replied <- err:
+	default:
+	}
+}
+
+// listener side, tell caller the result of calling destination
+func (stream *muxStream) reply(callErr error) error {
+	return stream.session.writeFrame(frameReply, stream.id, []byte{statusFromError(callErr)})
+}
+
+// implement io.Reader interface, return io.EOF after fin
+func (stream *muxStream) Read(data []byte) (int, error) {
+	for {
+		stream.mutex.Lock()
+		if stream.received.Len() > 0 {
+			nBytes, _ := stream.received.Read(data)
+			increment := stream.consume(nBytes)
+			stream.mutex.Unlock()
+
+			if increment > 0 {
+				var window [4]byte
+				binary.BigEndian.PutUint32(window[:], uint32(increment))
+				stream.session.writeFrame(frameWindow, stream.id, window[:])
+			}
+			return nBytes, nil
+		}
+		if stream.finReceived {
+			stream.mutex.Unlock()
+			return 0, io.EOF
+		}
+		err := stream.err
+		deadline := stream.readDeadline
+		stream.mutex.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err = wait(stream.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// give back window once half of it is read, must hold the mutex
+func (stream *muxStream) consume(nBytes int) int {
+	stream.unacked += nBytes
+	if stream.unacked < muxInitialWindow/2 {
+		return 0
+	}
+	increment := stream.unacked
+	stream.receiveWindow += increment
+	stream.unacked = 0
+	return increment
+}
+
+// implement io.Writer interface, wait for window of the other side
+func (stream *muxStream) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		stream.mutex.Lock()
+		err := stream.err
+		if err == nil && stream.finSent {
+			err = errStreamClosed
+		}
+		if err != nil {
+			stream.mutex.Unlock()
+			return written, err
+		}
+		if stream.sendWindow == 0 {
+			deadline := stream.writeDeadline
+			stream.mutex.Unlock()
+			if err = wait(stream.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		frameDataLen := len(data)
+		if frameDataLen > stream.sendWindow {
+			frameDataLen = stream.sendWindow
+		}
+		if frameDataLen > maxMuxFrameDataLen {
+			frameDataLen = maxMuxFrameDataLen
+		}
+		stream.sendWindow -= frameDataLen
+		stream.mutex.Unlock()
+
+		if err = stream.session.writeFrame(frameData, stream.id, data[:frameDataLen]); err != nil {
+			return written, err
+		}
+		written += frameDataLen
+		data = data[frameDataLen:]
+	}
+	return written, nil
+}
+
+// send fin, the stream is still open for reading
+func (stream *muxStream) CloseWrite() error {
+	stream.mutex.Lock()
+	if stream.finSent || stream.err != nil {
+		stream.mutex.Unlock()
+		return stream.err
+	}
+	stream.finSent = true
+	stream.mutex.Unlock()
+
+	return stream.session.writeFrame(frameFin, stream.id, nil)
+}
+
+// reset the stream, unless it ends in both directions already
+func (stream *muxStream) Close() error {
+	stream.mutex.Lock()
+	ended := stream.finSent && stream.finReceived
+	failed := stream.err != nil
+	if !failed {
+		stream.err = net.ErrClosed
+	}
+	stream.mutex.Unlock()
+
+	signal(stream.readable)
+	signal(stream.writable)
+	stream.session.removeStream(stream.id)
+	if ended || failed {
+		return nil
+	}
+	return stream.session.writeFrame(frameReset, stream.id, nil)
+}
+
+func (stream *muxStream) LocalAddr() net.Addr {
+	return stream.session.conn.LocalAddr()
+}
+
+func (stream *muxStream) RemoteAddr() net.Addr {
+	return stream.session.conn.RemoteAddr()
+}
+
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *muxStream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.mutex.Unlock()
+
+	signal(stream.readable)
+	return nil
+}
+
+func (stream *muxStream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.mutex.Unlock()
+
+	signal(stream.writable)
+	return nil
+}
+
+// mux connections of a MaskCaller to a next node
+type muxPool struct {
+	mutex      sync.Mutex
+	sessions   []*muxSession
+	maxStreams int // of each connection
+}
+
+func newMuxPool(maxStreams int) *muxPool {
+	return &muxPool{
+		maxStreams: maxStreams,
+	}
+}
+
+// a connection able to open another stream, nil if none, those closed are dropped
+func (pool *muxPool) pick() *muxSession {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var picked *muxSession
+	open := pool.sessions[:0]
+	for _, session := range pool.sessions {
+		select {
+		case <-session.done:
+			continue
+		default:
+		}
+		open = append(open, session)
+		if picked == nil && session.available() {
+			picked = session
+		}
+	}
+	for i := len(open); i < len(pool.sessions); i++ {
+		pool.sessions[i] = nil
+	}
+	pool.sessions = open
+	return picked
+}
+
+func (pool *muxPool) add(session *muxSession) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.sessions = append(pool.sessions, session)
+}
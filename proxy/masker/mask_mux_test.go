@@ -0,0 +1,131 @@
+package masker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"masker/network"
+)
+
+var testMuxDestination = network.NewTCPDestination(network.NewDomainAddress("example.com", 80))
+
+// sessions of caller and listener over a pipe, data is not encrypted
+func newTestMuxSessions(t *testing.T, maxStreams int, accept func(*muxStream)) (*muxSession, *muxSession) {
+	client, server := net.Pipe()
+	caller := newMuxSession(client, client, client, defaultCallerMaxStreams)
+	listener := newMuxSession(server, server, server, maxStreams)
+	listener.accept = accept
+	go caller.run()
+	go listener.run()
+	t.Cleanup(func() {
+		caller.Close()
+		listener.Close()
+	})
+	return caller, listener
+}
+
+// reply then echo until fin
+func echoStream(stream *muxStream) {
+	go func() {
+		defer stream.Close()
+		if stream.reply(nil) != nil {
+			return
+		}
+		io.Copy(stream, stream)
+		stream.CloseWrite()
+	}()
+}
+
+func TestMuxStreams(t *testing.T) {
+	caller, _ := newTestMuxSessions(t, defaultListenerMaxStreams, echoStream)
+
+	// more than the window in both directions, streams at the same time
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		payload := bytes.Repeat([]byte{byte('a' + i)}, muxInitialWindow*2+100)
+		stream, err := caller.openStream(context.Background(), testMuxDestination)
+		if err != nil {
+			t.Fatalf("Err in opening stream: %v", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			go func() {
+				stream.Write(payload)
+				stream.CloseWrite()
+			}()
+
+			stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			echoed, err := io.ReadAll(stream)
+			if err != nil || !bytes.Equal(echoed, payload) {
+				t.Errorf("Stream %d echoes %d bytes, want %d, err: %v", stream.id, len(echoed), len(payload), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamRefused(t *testing.T) {
+	accept := func(stream *muxStream) {
+		if stream.dest.String() == testMuxDestination.String() {
+			stream.reply(nil)
+		} else {
+			stream.reply(network.ErrConnectionRefused)
+		}
+	}
+	caller, _ := newTestMuxSessions(t, 1, accept)
+
+	closed := network.NewTCPDestination(network.NewDomainAddress("example.com", 81))
+	var remoteErr *remoteCallError
+	if _, err := caller.openStream(context.Background(), closed); !errors.As(err, &remoteErr) || !errors.Is(err, network.ErrConnectionRefused) {
+		t.Errorf("Open stream to %s get %v, want %v", closed.String(), err, network.ErrConnectionRefused)
+	}
+
+	if _, err := caller.openStream(context.Background(), testMuxDestination); err != nil {
+		t.Fatalf("Err in opening stream: %v", err)
+	}
+	// over max streams of listener
+	if _, err := caller.openStream(context.Background(), testMuxDestination); !errors.Is(err, errMuxStreamRefused) {
+		t.Errorf("Open stream over max streams get %v, want %v", err, errMuxStreamRefused)
+	}
+}
+
+func TestMuxStreamReset(t *testing.T) {
+	accepted := make(chan *muxStream, 1)
+	caller, _ := newTestMuxSessions(t, defaultListenerMaxStreams, func(stream *muxStream) {
+		stream.reply(nil)
+		accepted <- stream
+	})
+
+	stream, err := caller.openStream(context.Background(), testMuxDestination)
+	if err != nil {
+		t.Fatalf("Err in opening stream: %v", err)
+	}
+	remote := <-accepted
+
+	// closed without fin, the other side fails but other streams go on
+	stream.Close()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = remote.Read(make([]byte, 1)); !errors.Is(err, errMuxStreamReset) {
+		t.Errorf("Read a reset stream get %v, want %v", err, errMuxStreamReset)
+	}
+	if _, err = caller.openStream(context.Background(), testMuxDestination); err != nil {
+		t.Errorf("Err in opening stream after reset: %v", err)
+	}
+
+	// closed connection fails all streams
+	remote = <-accepted
+	caller.Close()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = remote.Read(make([]byte, 1)); !errors.Is(err, errMuxClosed) {
+		t.Errorf("Read a stream of closed connection get %v, want %v", err, errMuxClosed)
+	}
+}
@@ -0,0 +1,160 @@
+package masker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"masker/core"
+	"masker/log"
+	"masker/network"
+)
+
+const (
+	defaultPoolSize    = 4
+	defaultPoolIdleTTL = 60 * time.Second
+
+	// a connection may stay idle for 1.5 idle ttl till expired, it must be closed before requestTimeout of listener
+	maxPoolIdleTTL = requestTimeout / 2
+)
+
+/**
+ * connPool keeps connections to a next node dialed in advance, so that a call sends its request at once
+ * - a connection taken is replaced in background, so are those idle for idleTTL, checked every half of it
+ * - the newest connection is taken first, the other side or middle boxes may have closed older ones
+ * - a connection closed meanwhile fails the handshake, then the call dials a new one, see MaskCaller.connect
+ *
+ */
+type connPool struct {
+	destination network.Destination
+	size        int
+	idleTTL     time.Duration
+	onDial      func(rtt time.Duration) // round trip of tcp handshake, for each connection dialed
+
+	mutex   sync.Mutex   // guard the fields below
+	idle    []pooledConn // oldest first
+	dialing int
+	closed  bool
+	stop    chan struct{}
+}
+
+type pooledConn struct {
+	conn     net.Conn
+	pooledAt time.Time
+}
+
+func newConnPool(destination network.Destination, size int, idleTTL time.Duration) *connPool {
+	return &connPool{
+		destination: destination,
+		size:        size,
+		idleTTL:     idleTTL,
+		stop:        make(chan struct{}),
+	}
+}
+
+// fill the pool, and keep it filled until closed
+func (pool *connPool) start() {
+	pool.refill()
+	go pool.maintain()
+}
+
+func (pool *connPool) maintain() {
+	ticker := time.NewTicker(pool.idleTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-pool.stop:
+			return
+		}
+		pool.expire()
+		pool.refill()
+	}
+}
+
+// an idle connection, nil if none
+func (pool *connPool) get() net.Conn {
+	pool.mutex.Lock()
+	var conn net.Conn
+	for conn == nil && len(pool.idle) > 0 {
+		newest := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(newest.pooledAt) < pool.idleTTL {
+			conn = newest.conn
+		} else {
+			newest.conn.Close()
+		}
+	}
+	pool.mutex.Unlock()
+
+	pool.refill()
+	return conn
+}
+
+// dial in background until size connections are idle or being dialed
+func (pool *connPool) refill() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for !pool.closed && len(pool.idle)+pool.dialing < pool.size {
+		pool.dialing++
+		go pool.dial()
+	}
+}
+
+func (pool *connPool) dial() {
+	ctx, cancel := context.WithTimeout(context.Background(), core.DialTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	startTime := time.Now()
+	conn, err := dialer.DialContext(ctx, pool.destination.Network(), pool.destination.String())
+	if err == nil && pool.onDial != nil {
+		pool.onDial(time.Since(startTime))
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pool.dialing--
+	if err != nil {
+		log.Debug("Err in dialing pooled connection to %s: %v", pool.destination.String(), err)
+		return
+	}
+	if pool.closed {
+		conn.Close()
+		return
+	}
+	pool.idle = append(pool.idle, pooledConn{conn: conn, pooledAt: time.Now()})
+}
+
+// close connections idle for idleTTL
+func (pool *connPool) expire() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	expired := 0
+	for expired < len(pool.idle) && time.Since(pool.idle[expired].pooledAt) >= pool.idleTTL {
+		pool.idle[expired].conn.Close()
+		expired++
+	}
+	pool.idle = append(pool.idle[:0], pool.idle[expired:]...)
+}
+
+// close idle connections, those taken already are not affected
+func (pool *connPool) close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+	close(pool.stop)
+	for _, idle := range pool.idle {
+		idle.conn.Close()
+	}
+	pool.idle = nil
+}
@@ -0,0 +1,206 @@
+package masker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"masker/account"
+	"masker/core"
+	"masker/cryption"
+	"masker/network"
+)
+
+// accept connections of pool, passing them to accepted
+func newPoolServer(t *testing.T) (network.Destination, <-chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	tcpAddr := ln.Addr().(*net.TCPAddr)
+	addr, _ := network.NewIPv4Address(tcpAddr.IP.To4(), uint16(tcpAddr.Port))
+	return network.NewTCPDestination(addr), accepted
+}
+
+func waitAccepted(t *testing.T, accepted <-chan net.Conn) net.Conn {
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(time.Second):
+		t.Fatalf("Pool should dial a connection")
+		return nil
+	}
+}
+
+func idleConnections(pool *connPool) int {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	return len(pool.idle)
+}
+
+func TestConnPool(t *testing.T) {
+	destination, accepted := newPoolServer(t)
+	pool := newConnPool(destination, 2, time.Minute)
+	pool.start()
+
+	waitAccepted(t, accepted)
+	waitAccepted(t, accepted)
+	for idleConnections(pool) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// taken one is replaced
+	if conn := pool.get(); conn == nil {
+		t.Fatalf("Pool of 2 connections gives none")
+	}
+	waitAccepted(t, accepted)
+
+	// idle ones are closed with pool
+	for idleConnections(pool) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	pool.close()
+	if conn := pool.get(); conn != nil {
+		t.Errorf("Closed pool gives a connection")
+	}
+	select {
+	case conn := <-accepted:
+		t.Errorf("Closed pool dials %v", conn.RemoteAddr())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnPoolExpire(t *testing.T) {
+	destination, accepted := newPoolServer(t)
+	pool := newConnPool(destination, 1, 100*time.Millisecond)
+	pool.start()
+	defer pool.close()
+
+	// closed after idle ttl, then replaced
+	conn := waitAccepted(t, accepted)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Pooled connection should be closed after idle ttl")
+	}
+	waitAccepted(t, accepted)
+}
+
+// health of a node kept by reload goes on with the latency of its new pool
+func TestReloadPoolLatency(t *testing.T) {
+	destination, accepted := newPoolServer(t)
+	node := fmt.Sprintf(`{"address": "127.0.0.1", "port": %d, "users": [{"id": "%s"}]`, destination.Port(), testUserID)
+	configFile := filepath.Join(t.TempDir(), "mask_caller.json")
+	os.WriteFile(configFile, []byte("["+node+"}]"), 0644)
+	caller, err := NewMaskCaller(configFile)
+	if err != nil {
+		t.Fatalf("Err in creating caller: %v", err)
+	}
+	defer caller.Close()
+	health := caller.nextNodeList[0].health
+
+	os.WriteFile(configFile, []byte("["+node+`, "pool": {"size": 1}}]`), 0644)
+	if err = caller.Reload(configFile); err != nil {
+		t.Fatalf("Err in reloading caller: %v", err)
+	}
+	if caller.nextNodeList[0].health != health {
+		t.Fatalf("Reload should keep health of the same node")
+	}
+	waitAccepted(t, accepted)
+	for i := 0; health.latency() == 0; i++ {
+		if i == 100 {
+			t.Fatalf("Latency of pooled connection is not observed by the health kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// pooled connection closed by the other side, the handshake goes on a new one with a new request
+func TestPooledConnectionClosed(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	listener := newTestListener(t, user)
+	destination, accepted := newPoolServer(t)
+	pool := newConnPool(destination, 1, time.Minute)
+	pool.start()
+	defer pool.close()
+
+	waitAccepted(t, accepted).Close()
+	for idleConnections(pool) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	go func() {
+		for conn := range accepted {
+			go listener.handleConnection(conn)
+		}
+	}()
+
+	caller := &MaskCaller{connections: network.NewConnectionSet()}
+	node := nextNode{destination: destination, pool: pool, health: &nodeHealth{}}
+	var requests []*maskRequest
+	conn, _, _, err := caller.connect(context.Background(), &core.Session{}, node, func() *maskRequest {
+		request := newMaskRequest(user, network.NewTCPDestination(network.NewDomainAddress("example.com", 80)), cryption.CipherAES128GCM, headerV1)
+		requests = append(requests, request)
+		return request
+	})
+	if err != nil {
+		t.Fatalf("Err in connecting with a closed pooled connection: %v", err)
+	}
+	conn.Close()
+
+	if len(requests) != 2 {
+		t.Fatalf("Connect builds %d requests, want one for each of 2 attempts", len(requests))
+	}
+	if bytes.Equal(requests[0].requestKey[:], requests[1].requestKey[:]) || bytes.Equal(requests[0].requestIV[:], requests[1].requestIV[:]) {
+		t.Errorf("Retry sends the key material of the first request again")
+	}
+}
+
+// connections idle in pool have sent no request, node stops without waiting for them
+func TestStopWithPooledConnections(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	listener := newTestListener(t, user)
+	listener.node.Inbounds = append(listener.node.Inbounds, &core.Inbound{Tag: "in", Protocol: "mask", ListenEnd: listener})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in reserving a port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if err = listener.Listen(uint16(port)); err != nil {
+		t.Fatalf("Err in listening: %v", err)
+	}
+
+	addr, _ := network.NewIPv4Address(net.IPv4(127, 0, 0, 1), uint16(port))
+	pool := newConnPool(network.NewTCPDestination(addr), 2, time.Minute)
+	pool.start()
+	defer pool.close()
+	for idleConnections(pool) < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // accepted by listener
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err = listener.node.Stop(ctx); err != nil {
+		t.Errorf("Stop waits for connections idle in pool: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package masker
+
+import (
+	"sync"
+	"time"
+
+	"masker/account"
+)
+
+// how often requests too old to be replayed are forgotten
+const replayPurgeIntervalSec = 10
+
+// user hash, request key and IV, a replayed request has all of them the same
+type replayKey [account.IDBytesLen + 16 + 16]byte
+
+/**
+ * replayFilter remembers requests seen while their user hash is valid
+ * after that a replayed request is refused as an invalid user anyway
+ * memory is bounded by connections accepted in the window
+ *
+ */
+type replayFilter struct {
+	mutex     sync.Mutex
+	seen      map[replayKey]int64 // value: time sec after which the request can be forgotten
+	lastPurge int64
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{
+		seen: make(map[replayKey]int64),
+	}
+}
+
+// return false if the request has been seen
+func (filter *replayFilter) firstSeen(request *maskRequest) bool {
+	var key replayKey
+	n := copy(key[:], request.userHash[:])
+	n += copy(key[n:], request.requestKey[:])
+	copy(key[n:], request.requestIV[:])
+	now := time.Now().Unix()
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	if now-filter.lastPurge >= replayPurgeIntervalSec {
+		for seenKey, forgetAt := range filter.seen {
+			if forgetAt < now {
+				delete(filter.seen, seenKey)
+			}
+		}
+		filter.lastPurge = now
+	}
+
+	if _, ok := filter.seen[key]; ok {
+		return false
+	}
+	// one more second for slots rebuilt late
+	filter.seen[key] = request.timeSec + account.HashWindowSec + 1
+	return true
+}
@@ -0,0 +1,61 @@
+package masker
+
+import (
+	"bytes"
+	"testing"
+
+	"masker/account"
+	"masker/cryption"
+	"masker/network"
+)
+
+func TestReplayFilter(t *testing.T) {
+	user := newTestUser(t, testUserID, account.Policy{})
+	userSet, err := account.NewTimedUserSet(user)
+	if err != nil {
+		t.Fatalf("Err in creating user set: %v", err)
+	}
+	defer userSet.Close()
+
+	dest := network.NewTCPDestination(network.NewDomainAddress("example.com", 443))
+	header, err := newMaskRequest(user, dest, cryption.CipherAES128GCM, headerV1).encryptedByteSlice()
+	if err != nil {
+		t.Fatalf("Err in encrypting request: %v", err)
+	}
+	filter := newReplayFilter()
+
+	request, err := readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if err != nil {
+		t.Fatalf("Err in reading request: %v", err)
+	}
+	if !filter.firstSeen(request) {
+		t.Errorf("A new request should pass")
+	}
+
+	// the same header sent again, by someone who captured it
+	replayed, err := readMaskRequest(bytes.NewReader(header), userSet, allHeaderVersions)
+	if err != nil {
+		t.Fatalf("Err in reading replayed request: %v", err)
+	}
+	if filter.firstSeen(replayed) {
+		t.Errorf("A replayed request should be refused")
+	}
+
+	// another request of the same user is not a replay, even in the same second
+	other := newMaskRequest(user, dest, cryption.CipherAES128GCM, headerV1)
+	other.userHash, other.timeSec = request.userHash, request.timeSec
+	if !filter.firstSeen(other) {
+		t.Errorf("Another request of the same user should pass")
+	}
+
+	// forgotten once they are too old to be accepted
+	request.timeSec -= 2*account.HashWindowSec + 10*replayPurgeIntervalSec
+	old := *request
+	old.requestIV[0]++
+	filter.firstSeen(&old)
+	filter.lastPurge = 0
+	filter.firstSeen(other)
+	if len(filter.seen) != 2 {
+		t.Errorf("Filter keeps %d requests, want 2", len(filter.seen))
+	}
+}
@@ -0,0 +1,198 @@
+package masker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"masker/cryption"
+	"masker/log"
+)
+
+const (
+	chunkHeaderLen  = 2
+	maxChunkDataLen = 0xFFFF
+)
+
+var (
+	errStreamClosed = errors.New("mask stream is closed for writing")
+)
+
+// net.Conn, and readers or writers wrapping one, like those in package cryption
+type readDeadlineSetter interface {
+	SetReadDeadline(time.Time) error
+}
+
+type writeDeadlineSetter interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// data stream of legacy header is the raw cipher stream, old nodes know nothing of chunks
+func newDataWriter(writer io.Writer, version byte) io.Writer {
+	if version == headerLegacy {
+		return writer
+	}
+	return newMaskStreamWriter(writer)
+}
+
+func newDataReader(reader io.Reader, version byte) io.Reader {
+	if version == headerLegacy {
+		return reader
+	}
+	return newMaskStreamReader(reader)
+}
+
+/**
+ * Data after mask response of v1 and v2 headers goes in chunks, both directions
+ * - chunk: data length (2 bytes, big endian) | data
+ * - a chunk of length 0 marks the end of stream, the other direction keeps going
+ * - connection closed without the marker is an unexpected EOF
+ *
+ */
+type maskStreamWriter struct {
+	writer io.Writer
+	buffer []byte // header and data of a chunk, written by one Write
+	closed bool
+}
+
+func newMaskStreamWriter(writer io.Writer) *maskStreamWriter {
+	return &maskStreamWriter{
+		writer: writer,
+	}
+}
+
+// data larger than maxChunkDataLen is cut into several chunks
+func (streamWriter *maskStreamWriter) Write(data []byte) (int, error) {
+	if streamWriter.closed {
+		return 0, errStreamClosed
+	}
+
+	written := 0
+	for len(data) > 0 {
+		chunkDataLen := len(data)
+		if chunkDataLen > maxChunkDataLen {
+			chunkDataLen = maxChunkDataLen
+		}
+
+		if err := streamWriter.writeChunk(data[:chunkDataLen]); err != nil {
+			return written, err
+		}
+		written += chunkDataLen
+		data = data[chunkDataLen:]
+	}
+	return written, nil
+}
+
+// send the end of stream marker, the connection is still open for reading
+func (streamWriter *maskStreamWriter) CloseWrite() error {
+	if streamWriter.closed {
+		return nil
+	}
+	streamWriter.closed = true
+	return streamWriter.writeChunk(nil)
+}
+
+func (streamWriter *maskStreamWriter) writeChunk(data []byte) error {
+	chunkLen := chunkHeaderLen + len(data)
+	if cap(streamWriter.buffer) < chunkLen {
+		streamWriter.buffer = make([]byte, chunkLen)
+	}
+	chunk := streamWriter.buffer[:chunkLen]
+	binary.BigEndian.PutUint16(chunk, uint16(len(data)))
+	copy(chunk[chunkHeaderLen:], data)
+
+	_, err := streamWriter.writer.Write(chunk)
+	return err
+}
+
+func (streamWriter *maskStreamWriter) SetWriteDeadline(t time.Time) error {
+	if setter, ok := streamWriter.writer.(writeDeadlineSetter); ok {
+		return setter.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type maskStreamReader struct {
+	reader    io.Reader
+	header    [chunkHeaderLen]byte
+	remaining int  // data bytes of current chunk not read yet
+	ended     bool // end of stream marker is read
+}
+
+func newMaskStreamReader(reader io.Reader) *maskStreamReader {
+	return &maskStreamReader{
+		reader: reader,
+	}
+}
+
+// return io.EOF at the end of stream marker
+func (streamReader *maskStreamReader) Read(data []byte) (int, error) {
+	if streamReader.ended {
+		return 0, io.EOF
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if streamReader.remaining == 0 {
+		if _, err := io.ReadFull(streamReader.reader, streamReader.header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+
+		streamReader.remaining = int(binary.BigEndian.Uint16(streamReader.header[:]))
+		if streamReader.remaining == 0 {
+			streamReader.ended = true
+			return 0, io.EOF
+		}
+	}
+
+	if len(data) > streamReader.remaining {
+		data = data[:streamReader.remaining]
+	}
+	nBytes, err := streamReader.reader.Read(data)
+	streamReader.remaining -= nBytes
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return nBytes, err
+}
+
+func (streamReader *maskStreamReader) SetReadDeadline(t time.Time) error {
+	if setter, ok := streamReader.reader.(readDeadlineSetter); ok {
+		return setter.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// a tampered chunk of data stream cuts the whole connection, not just the direction reading it
+type tamperGuard struct {
+	reader  io.Reader
+	onClose func()
+}
+
+func newTamperGuard(reader io.Reader, onClose func()) *tamperGuard {
+	return &tamperGuard{
+		reader:  reader,
+		onClose: onClose,
+	}
+}
+
+func (guard *tamperGuard) Read(data []byte) (int, error) {
+	nBytes, err := guard.reader.Read(data)
+	if errors.Is(err, cryption.ErrAuthenticationFailed) {
+		log.Warning("Tampered data in mask stream, cut the connection.")
+		guard.onClose()
+	}
+	return nBytes, err
+}
+
+func (guard *tamperGuard) SetReadDeadline(t time.Time) error {
+	if setter, ok := guard.reader.(readDeadlineSetter); ok {
+		return setter.SetReadDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package masker
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMaskStream(t *testing.T) {
+	var conn bytes.Buffer
+	writer := newMaskStreamWriter(&conn)
+
+	payload := bytes.Repeat([]byte("masker"), maxChunkDataLen/3)
+	if _, err := writer.Write(payload); err != nil {
+		t.Fatalf("Err in writing stream: %v", err)
+	}
+	if err := writer.CloseWrite(); err != nil {
+		t.Fatalf("Err in closing stream: %v", err)
+	}
+	if _, err := writer.Write(payload); err == nil {
+		t.Errorf("Write after CloseWrite should fail")
+	}
+	// bytes after the marker are not part of the stream
+	conn.WriteString("next")
+
+	data, err := io.ReadAll(newMaskStreamReader(&conn))
+	if err != nil {
+		t.Fatalf("Err in reading stream: %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("Read %d bytes, want %d bytes", len(data), len(payload))
+	}
+	if conn.String() != "next" {
+		t.Errorf("Reader should stop at the end of stream marker, left %q", conn.String())
+	}
+}
+
+func TestMaskStreamTruncated(t *testing.T) {
+	var conn bytes.Buffer
+	newMaskStreamWriter(&conn).Write([]byte("data"))
+
+	// connection closed without end of stream marker
+	_, err := io.ReadAll(newMaskStreamReader(&conn))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Read a truncated stream get %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// old nodes read and write the raw cipher stream
+func TestLegacyDataStream(t *testing.T) {
+	for _, version := range []byte{headerLegacy, headerV1, headerV2} {
+		var conn bytes.Buffer
+		newDataWriter(&conn, version).Write([]byte("data"))
+		if raw := conn.String() == "data"; raw != (version == headerLegacy) {
+			t.Errorf("Data stream of header version %d get %q", version, conn.String())
+		}
+
+		data, _ := io.ReadAll(newDataReader(bytes.NewReader([]byte("data")), version))
+		if raw := string(data) == "data"; raw != (version == headerLegacy) {
+			t.Errorf("Read raw data with header version %d get %q", version, data)
+		}
+	}
+}
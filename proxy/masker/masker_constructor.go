@@ -12,8 +12,8 @@ func (MaskCallerConstructor) Create(configFile string) (core.Caller, error) {
 
 type MaskListenerConstructor struct{}
 
-func (MaskListenerConstructor) Create(node *core.Node, configFile string) (core.Listener, error) {
-	return NewMaskListener(node, configFile)
+func (MaskListenerConstructor) Create(node *core.Node, tag string, configFile string) (core.Listener, error) {
+	return NewMaskListener(node, tag, configFile)
 }
 
 func init() {
@@ -1,13 +1,20 @@
 package socks
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
 	"masker/network"
 )
 
+var (
+	errUnsupportedAddressType = errors.New("unsupported address type")
+	errFragmentedDatagram     = errors.New("fragmented datagram")
+)
+
 func canNotBeIgnoredErr(err error) bool {
 	return (err != nil) && (err != io.EOF)
 }
@@ -236,7 +243,7 @@ func readDestination(reader io.Reader) (request socks5ConfirmDestinationRequest,
 		}
 		request.domain = string(tmpBuffer[:domainLen])
 	default:
-		err = fmt.Errorf("Unknown address type: %d", request.addrType)
+		err = fmt.Errorf("%w: %d", errUnsupportedAddressType, request.addrType)
 		return
 	}
 
@@ -265,6 +272,26 @@ const (
 	statusAddressTypeNotSupported
 )
 
+// status to reply with when calling destination fails for err
+func statusFromError(err error) byte {
+	switch {
+	case err == nil:
+		return statusSucceed
+	case errors.Is(err, network.ErrConnectionNotAllowed):
+		return statusConnectionNotAllowed
+	case errors.Is(err, network.ErrNetworkUnreachable):
+		return statusNetworkUnreachable
+	case errors.Is(err, network.ErrHostUnreachable):
+		return statusHostUnreachable
+	case errors.Is(err, network.ErrConnectionRefused):
+		return statusConnectionRefused
+	case errors.Is(err, network.ErrDialTimeout):
+		return statusTTLExpired
+	default:
+		return statusGeneralFailure
+	}
+}
+
 type socks5ConfirmDestinationResponse struct {
 	version    byte
 	statusCode byte
@@ -307,23 +334,76 @@ func (r socks5ConfirmDestinationResponse) byteSlice() []byte {
 	return buffer
 }
 
-// ignore udp connection for the time being
-func (r socks5ConfirmDestinationResponse) Destination() (dest network.Destination, err error) {
-	var addr network.Address
+func (r socks5ConfirmDestinationResponse) Destination() (network.Destination, error) {
+	addr, err := r.address()
+	if err != nil {
+		return nil, err
+	}
+	return network.NewTCPDestination(addr), nil
+}
+
+func (r socks5ConfirmDestinationResponse) address() (addr network.Address, err error) {
 	switch r.addrType {
 	case addrTypeIPv4:
 		addr, err = network.NewIPv4Address(r.ipv4[:], r.port)
-		if err != nil {
-			return nil, err
-		}
 	case addrTypeIPv6:
 		addr, err = network.NewIPv6Address(r.ipv6[:], r.port)
-		if err != nil {
-			return nil, err
-		}
 	case addrTypeDomain:
 		addr = network.NewDomainAddress(r.domain, r.port)
+	default:
+		err = fmt.Errorf("%w: %d", errUnsupportedAddressType, r.addrType)
+	}
+	return
+}
+
+// reply carrying addr, like the address bound for udp association
+func newAddressResponse(version byte, addr network.Address) socks5ConfirmDestinationResponse {
+	response := socks5ConfirmDestinationResponse{
+		version:    version,
+		statusCode: statusSucceed,
+		port:       addr.Port(),
 	}
+	switch {
+	case addr.IsIPv4():
+		response.addrType = addrTypeIPv4
+		copy(response.ipv4[:], addr.IP().To4())
+	case addr.IsIPv6():
+		response.addrType = addrTypeIPv6
+		copy(response.ipv6[:], addr.IP().To16())
+	default:
+		response.addrType = addrTypeDomain
+		response.domain = addr.Domain()
+	}
+	return response
+}
 
-	return network.NewTCPDestination(addr), nil
+/**
+ * udp datagram between client and listener: reserved (2 bytes) | fragment | address type | address | port | data
+ * it is laid out like the destination request and reply, whose version and command or status stand for reserved bytes
+ * fragments are not supported, they are dropped
+ *
+ */
+func readUDPDatagram(datagram []byte) (dest network.Destination, payload []byte, err error) {
+	if len(datagram) < 4 {
+		return nil, nil, fmt.Errorf("Expect at least 4 bytes datagram, but got %d", len(datagram))
+	}
+	if datagram[2] != 0 {
+		return nil, nil, errFragmentedDatagram
+	}
+
+	reader := bytes.NewReader(datagram)
+	request, err := readDestination(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := newConfirmDestinationResponse(request).address()
+	if err != nil {
+		return nil, nil, err
+	}
+	return network.NewUDPDestination(addr), datagram[len(datagram)-reader.Len():], nil
+}
+
+// header of datagrams sent to client from addr
+func udpDatagramHeader(addr network.Address) []byte {
+	return newAddressResponse(0x00, addr).byteSlice()
 }
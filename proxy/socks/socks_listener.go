@@ -1,8 +1,11 @@
 package socks
 
 import (
+	"context"
+	"errors"
 	"net"
 	"strconv"
+	"sync"
 
 	"masker/core"
 	"masker/log"
@@ -10,20 +13,37 @@ import (
 
 type SocksListener struct {
 	node   *core.Node
+	tag    string
 	config socksConfig
+	mutex  sync.RWMutex // guard config against reloading
+	ln     net.Listener
 }
 
-func NewSocksListener(node *core.Node, configFile string) (*SocksListener, error) {
+func NewSocksListener(node *core.Node, tag string, configFile string) (*SocksListener, error) {
 	config, err := loadConfig(configFile)
 	if err != nil {
 		return nil, err
 	}
 	return &SocksListener{
 		node:   node,
+		tag:    tag,
 		config: config,
 	}, nil
 }
 
+// connections accepted already keep the auth method they negotiated
+func (listener *SocksListener) Reload(configFile string) error {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	listener.mutex.Lock()
+	listener.config = config
+	listener.mutex.Unlock()
+	return nil
+}
+
 func (listener *SocksListener) Listen(port uint16) error {
 	ln, err := net.Listen("tcp", ":"+strconv.Itoa(int(port)))
 	if err != nil {
@@ -31,42 +51,62 @@ func (listener *SocksListener) Listen(port uint16) error {
 	}
 	log.Info("Listening on port: %d...", port)
 
+	listener.ln = ln
 	go listener.acceptConnection(ln)
 	return nil
 }
 
+func (listener *SocksListener) Close() error {
+	if listener.ln == nil {
+		return nil
+	}
+	return listener.ln.Close()
+}
+
 func (listener *SocksListener) acceptConnection(ln net.Listener) {
 	// set max handle connections?
 	for true {
 		conn, err := ln.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			log.Info("Stop listening on %v.", ln.Addr())
+			return
+		} else if err != nil {
 			log.Error("Err in accepting socket connection: %v.", err)
-		} else {
+		} else if listener.node.AddConnection(conn) {
 			go listener.handleConnection(conn)
+		} else {
+			conn.Close()
 		}
 	}
 }
 
 func (listener *SocksListener) handleConnection(conn net.Conn) error {
+	defer listener.node.RemoveConnection(conn)
 	defer conn.Close()
-	log.Debug("Handling a new connection.")
+	session := listener.node.NewSession(listener.tag, conn)
+	defer listener.node.EndSession(session)
+	log.Debug("Handling a new connection, session %v.", session)
 
 	// client request to choose auth method
 	authRequest, err := readAuthentication(conn)
 	if err != nil {
 		log.Error("Err in reading auth: %v.", err)
+		core.RecordHandshakeFailure(listener.tag, core.HandshakeReadError)
 		return err
 	}
 	log.Debug("auth request: %v", authRequest)
 
 	// server choose an appropriate method and reply
+	listener.mutex.RLock()
 	authMethod := listener.config.authMethod
+	listener.mutex.RUnlock()
 	if authRequest.hasSupportedMethod(authMethod) == false {
 		authResponse := newAuthenticationResponse(authNoAcceptableMethod)
 		err = writeResponse(conn, authResponse)
 		if err != nil {
 			log.Error("Err in writing response to auth request: %v.", err)
 		}
+		core.RecordHandshakeFailure(listener.tag, "no_acceptable_method")
 		return log.Error("Server don't support any methods that client have.")
 	} else {
 		authResponse := newAuthenticationResponse(authMethod)
@@ -78,11 +118,13 @@ func (listener *SocksListener) handleConnection(conn net.Conn) error {
 		log.Debug("auth response: %v", authResponse)
 	}
 
+	// authenticated username stays empty without password auth
 	if authMethod == authUserPass {
 		// additional part, verify the user
 		userpassRequest, err := readUserPass(conn)
 		if err != nil {
 			log.Error("Err in reading username and password: %v", err)
+			core.RecordHandshakeFailure(listener.tag, core.HandshakeReadError)
 			return err
 		}
 		log.Debug("user pass request: %v", userpassRequest)
@@ -95,50 +137,68 @@ func (listener *SocksListener) handleConnection(conn net.Conn) error {
 			return err
 		}
 		if status != validUser {
-			return log.Error("Invalid user.")
+			core.RecordHandshakeFailure(listener.tag, core.HandshakeInvalidUser)
+			return log.Error("Invalid user %s from %v.", userpassRequest.username, conn.RemoteAddr())
 		}
 		log.Debug("user pass response: %v", userpassResponse)
+		session.User = userpassRequest.username
 	}
 
 	// client show the destination address
 	destRequest, err := readDestination(conn)
 	if err != nil {
 		log.Error("Err in reading the destination address: %v.", err)
+		if errors.Is(err, errUnsupportedAddressType) {
+			core.RecordHandshakeFailure(listener.tag, core.HandshakeUnsupportedAddress)
+		} else {
+			core.RecordHandshakeFailure(listener.tag, core.HandshakeReadError)
+		}
 		return err
 	}
 	log.Debug("final request: %v", destRequest)
 
 	// server reply
 	destResponse := newConfirmDestinationResponse(destRequest)
+	if destRequest.command == cmdUDPAssociate {
+		return listener.associateUDP(conn, session.User, destResponse)
+	}
 	if destRequest.command != cmdConnect {
 		destResponse.statusCode = statusCommandNotSupported
 		err = writeResponse(conn, destResponse)
 		if err != nil {
 			log.Error("Err in confirming the destination: %v", err)
 		}
+		core.RecordHandshakeFailure(listener.tag, "unsupported_command")
 		return log.Error("Unsupported socks command %d", destRequest.command)
-	} else {
-		err = writeResponse(conn, destResponse)
-		if err != nil {
-			log.Error("Err in confirming the destination: %v.", err)
-			return err
-		}
-		log.Debug("final response: %v", destResponse)
 	}
 
-	// start communicating with caller
 	dest, err := destResponse.Destination()
 	if err != nil {
+		destResponse.statusCode = statusAddressTypeNotSupported
+		writeResponse(conn, destResponse)
+		core.RecordHandshakeFailure(listener.tag, core.HandshakeUnsupportedAddress)
 		log.Error("Err in getting the destination: %v.", err)
 		return err
 	}
 	log.Debug("Destination is :%v", dest)
 
-	channel, err := listener.node.NewConnectionAccept(dest)
+	// start communicating with caller, reply after the destination is connected
+	ctx, cancel := context.WithTimeout(context.Background(), core.DialTimeout)
+	session.Destination = dest
+	channel, callErr := listener.node.NewConnectionAccept(ctx, session)
+	cancel()
+
+	destResponse.statusCode = statusFromError(callErr)
+	err = writeResponse(conn, destResponse)
 	if err != nil {
-		log.Error("Err in calling destination: %v.", err)
+		log.Error("Err in confirming the destination: %v.", err)
 		return err
 	}
+	log.Debug("final response: %v", destResponse)
+	if callErr != nil {
+		log.Error("Session %v: err in calling %s: %v.", session, dest.String(), callErr)
+		return callErr
+	}
 
 	readFinish := make(chan bool, 1)
 	go channel.ForwardChannel.Input(conn, readFinish)
@@ -146,7 +206,9 @@ func (listener *SocksListener) handleConnection(conn net.Conn) error {
 	writeFinish := make(chan bool, 1)
 	go channel.BackwardChannel.Output(conn, writeFinish)
 
+	// either side may half-close, wait for both directions
 	<-writeFinish
+	<-readFinish
 	log.Debug("Connection Finished.")
 	return nil
 }
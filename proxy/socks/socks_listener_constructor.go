@@ -6,8 +6,8 @@ import (
 
 type SocksListenerConstructor struct{}
 
-func (SocksListenerConstructor) Create(node *core.Node, configFile string) (core.Listener, error) {
-	return NewSocksListener(node, configFile)
+func (SocksListenerConstructor) Create(node *core.Node, tag string, configFile string) (core.Listener, error) {
+	return NewSocksListener(node, tag, configFile)
 }
 
 func init() {
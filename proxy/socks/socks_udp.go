@@ -0,0 +1,319 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"masker/core"
+	"masker/log"
+	"masker/network"
+)
+
+// datagrams from client waiting for a flow to be called, more are dropped
+const udpFlowQueueLen = 64
+
+/**
+ * udpAssociation relays datagrams of client, set up by UDP ASSOCIATE on a tcp connection
+ * - the association lives as long as that tcp connection, as RFC 1928 says
+ * - only datagrams from the host of that connection are relayed, from the first port it sends from
+ * - datagrams to each destination go through a session of their own, a udpFlow, which ends once idle
+ *
+ */
+type udpAssociation struct {
+	listener *SocksListener
+	user     string
+	control  net.Conn
+	conn     *net.UDPConn
+
+	mutex  sync.Mutex // guard the fields below
+	client *net.UDPAddr
+	flows  map[string]*udpFlow // by destination
+	closed bool
+}
+
+// bind on the address that control connection reaches, the client is able to reach it too
+func newUDPAssociation(listener *SocksListener, control net.Conn, user string) (*udpAssociation, error) {
+	localIP := control.LocalAddr().(*net.TCPAddr).IP
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpAssociation{
+		listener: listener,
+		user:     user,
+		control:  control,
+		conn:     conn,
+		flows:    make(map[string]*udpFlow),
+	}, nil
+}
+
+func (association *udpAssociation) address() (network.Address, error) {
+	addr := association.conn.LocalAddr().(*net.UDPAddr)
+	if ip := addr.IP.To4(); ip != nil {
+		return network.NewIPv4Address(ip, uint16(addr.Port))
+	}
+	return network.NewIPv6Address(addr.IP, uint16(addr.Port))
+}
+
+// datagrams from client to flows, until closed
+func (association *udpAssociation) relay() {
+	buffer := make([]byte, 0xFFFF)
+	for {
+		nBytes, addr, err := association.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !association.accept(addr) {
+			log.Debug("Drop datagram from %v, not the client of association.", addr)
+			continue
+		}
+
+		dest, payload, err := readUDPDatagram(buffer[:nBytes])
+		if err != nil {
+			log.Debug("Drop datagram from %v: %v.", addr, err)
+			continue
+		}
+		if flow := association.flow(dest); flow != nil {
+			flow.push(payload)
+		}
+	}
+}
+
+func (association *udpAssociation) accept(addr *net.UDPAddr) bool {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	if association.client == nil {
+		if !addr.IP.Equal(association.control.RemoteAddr().(*net.TCPAddr).IP) {
+			return false
+		}
+		association.client = addr
+	}
+	return addr.IP.Equal(association.client.IP) && addr.Port == association.client.Port
+}
+
+func (association *udpAssociation) clientAddr() net.Addr {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	if association.client == nil {
+		return association.control.RemoteAddr()
+	}
+	return association.client
+}
+
+// flow to dest, started if none, nil if association is closed
+func (association *udpAssociation) flow(dest network.Destination) *udpFlow {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	if association.closed {
+		return nil
+	}
+	key := dest.String()
+	if flow, ok := association.flows[key]; ok {
+		return flow
+	}
+
+	flow := &udpFlow{
+		association: association,
+		dest:        dest,
+		header:      udpDatagramHeader(dest),
+		packets:     make(chan []byte, udpFlowQueueLen),
+		closed:      make(chan struct{}),
+	}
+	association.flows[key] = flow
+	go association.listener.relayFlow(association.user, flow)
+	return flow
+}
+
+func (association *udpAssociation) removeFlow(flow *udpFlow) {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	key := flow.dest.String()
+	if association.flows[key] == flow {
+		delete(association.flows, key)
+	}
+}
+
+func (association *udpAssociation) send(datagram []byte) error {
+	association.mutex.Lock()
+	client := association.client
+	association.mutex.Unlock()
+
+	_, err := association.conn.WriteToUDP(datagram, client)
+	return err
+}
+
+func (association *udpAssociation) close() {
+	association.mutex.Lock()
+	association.closed = true
+	flows := make([]*udpFlow, 0, len(association.flows))
+	for _, flow := range association.flows {
+		flows = append(flows, flow)
+	}
+	association.mutex.Unlock()
+
+	association.conn.Close()
+	for _, flow := range flows {
+		flow.Close()
+	}
+}
+
+/**
+ * udpFlow is a net.Conn of datagrams between client and one destination
+ * Read gives payloads from client, Write sends a payload to client with the header of destination
+ * it goes through channels in network.PacketStream, like udp conns of identical caller
+ *
+ */
+type udpFlow struct {
+	association *udpAssociation
+	dest        network.Destination
+	header      []byte // of datagrams to client
+	packets     chan []byte
+
+	mutex        sync.Mutex
+	readDeadline time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// like a udp socket, datagrams are dropped once the queue is full
+func (flow *udpFlow) push(payload []byte) {
+	packet := make([]byte, len(payload))
+	copy(packet, payload)
+	select {
+	case flow.packets <- packet:
+	default:
+		log.Debug("Drop datagram to %s, queue is full.", flow.dest.String())
+	}
+}
+
+// closed flow is at the end, no more datagrams from client
+func (flow *udpFlow) Read(data []byte) (int, error) {
+	flow.mutex.Lock()
+	deadline := flow.readDeadline
+	flow.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-flow.packets:
+		return copy(data, packet), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-flow.closed:
+		return 0, io.EOF
+	}
+}
+
+func (flow *udpFlow) Write(data []byte) (int, error) {
+	datagram := make([]byte, 0, len(flow.header)+len(data))
+	datagram = append(datagram, flow.header...)
+	datagram = append(datagram, data...)
+	if err := flow.association.send(datagram); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (flow *udpFlow) Close() error {
+	flow.closeOnce.Do(func() {
+		close(flow.closed)
+		flow.association.removeFlow(flow)
+	})
+	return nil
+}
+
+func (flow *udpFlow) LocalAddr() net.Addr {
+	return flow.association.conn.LocalAddr()
+}
+
+func (flow *udpFlow) RemoteAddr() net.Addr {
+	return flow.association.clientAddr()
+}
+
+func (flow *udpFlow) SetDeadline(t time.Time) error {
+	return flow.SetReadDeadline(t)
+}
+
+func (flow *udpFlow) SetReadDeadline(t time.Time) error {
+	flow.mutex.Lock()
+	flow.readDeadline = t
+	flow.mutex.Unlock()
+	return nil
+}
+
+// datagrams are sent without blocking
+func (flow *udpFlow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// answer UDP ASSOCIATE, then relay datagrams until control connection ends
+func (listener *SocksListener) associateUDP(conn net.Conn, user string, destResponse socks5ConfirmDestinationResponse) error {
+	association, err := newUDPAssociation(listener, conn, user)
+	if err != nil {
+		destResponse.statusCode = statusGeneralFailure
+		writeResponse(conn, destResponse)
+		return log.Error("Err in binding udp for %v: %v.", conn.RemoteAddr(), err)
+	}
+	defer association.close()
+
+	addr, err := association.address()
+	if err != nil {
+		destResponse.statusCode = statusGeneralFailure
+		writeResponse(conn, destResponse)
+		return log.Error("Err in getting the udp address: %v.", err)
+	}
+	bindResponse := newAddressResponse(destResponse.version, addr)
+	if err = writeResponse(conn, bindResponse); err != nil {
+		log.Error("Err in confirming udp association: %v.", err)
+		return err
+	}
+	log.Debug("udp association on %v for %v", addr, conn.RemoteAddr())
+
+	go association.relay()
+
+	// nothing more is sent on control connection, it is read only to see the end
+	io.Copy(io.Discard, conn)
+	log.Debug("udp association on %v finished.", addr)
+	return nil
+}
+
+// a session for datagrams to flow.dest, called like a connection of CONNECT
+func (listener *SocksListener) relayFlow(user string, flow *udpFlow) {
+	defer flow.Close()
+	session := listener.node.NewSession(listener.tag, flow)
+	defer listener.node.EndSession(session)
+	session.User = user
+	session.Destination = flow.dest
+
+	ctx, cancel := context.WithTimeout(context.Background(), core.DialTimeout)
+	channel, err := listener.node.NewConnectionAccept(ctx, session)
+	cancel()
+	if err != nil {
+		log.Error("Session %v: err in calling %s: %v.", session, flow.dest.String(), err)
+		return
+	}
+
+	stream := network.NewPacketStream(flow, network.UDPIdleTimeout)
+	readFinish := make(chan bool, 1)
+	go channel.ForwardChannel.Input(stream, readFinish)
+
+	writeFinish := make(chan bool, 1)
+	go channel.BackwardChannel.Output(stream, writeFinish)
+
+	network.CloseConnection(flow, readFinish, writeFinish, channel.Done())
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Rules           []RuleConfig `json:"rules"`
+	DefaultOutbound string       `json:"default_outbound"` // empty means the first outbound of the node
+}
+
+/**
+ * a rule matches a connection when all of its non-empty parts match:
+ * - destination: any of domain, domain_suffix, keyword, regex or ip matches
+ * - port: destination port is in one of the ranges, like "53,80,1000-2000"
+ * - source: client ip is in one of the ips or cidrs
+ * - inbound: connection comes in on one of the inbound tags
+ * - user: connection is authenticated as one of the users
+ *
+ */
+type RuleConfig struct {
+	Domain       []string `json:"domain"`
+	DomainSuffix []string `json:"domain_suffix"`
+	Keyword      []string `json:"keyword"`
+	Regex        []string `json:"regex"`
+	IP           []string `json:"ip"`
+	Port         string   `json:"port"`
+	Source       []string `json:"source"`
+	Inbound      []string `json:"inbound"`
+	User         []string `json:"user"`
+	Outbound     string   `json:"outbound"`
+}
+
+func (config RuleConfig) toRule() (*rule, error) {
+	if config.Outbound == "" {
+		return nil, fmt.Errorf("rule has no outbound")
+	}
+
+	r := &rule{
+		outbound: config.Outbound,
+	}
+
+	for _, domain := range config.Domain {
+		r.domains = append(r.domains, strings.ToLower(domain))
+	}
+	for _, suffix := range config.DomainSuffix {
+		r.domainSuffixes = append(r.domainSuffixes, strings.ToLower(strings.TrimPrefix(suffix, ".")))
+	}
+	for _, keyword := range config.Keyword {
+		r.keywords = append(r.keywords, strings.ToLower(keyword))
+	}
+	for _, expr := range config.Regex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("illegal regex %s: %v", expr, err)
+		}
+		r.regexes = append(r.regexes, re)
+	}
+	for _, ip := range config.IP {
+		ipNet, err := parseIPNet(ip)
+		if err != nil {
+			return nil, err
+		}
+		r.ipNets = append(r.ipNets, ipNet)
+	}
+
+	if config.Port != "" {
+		portRanges, err := parsePortRanges(config.Port)
+		if err != nil {
+			return nil, err
+		}
+		r.portRanges = portRanges
+	}
+
+	for _, source := range config.Source {
+		ipNet, err := parseIPNet(source)
+		if err != nil {
+			return nil, err
+		}
+		r.sourceNets = append(r.sourceNets, ipNet)
+	}
+
+	r.inbounds = toSet(config.Inbound)
+	r.users = toSet(config.User)
+	return r, nil
+}
+
+// accept both "10.0.0.1" and "10.0.0.0/8"
+func parseIPNet(text string) (*net.IPNet, error) {
+	if strings.Contains(text, "/") {
+		_, ipNet, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("illegal cidr %s: %v", text, err)
+		}
+		return ipNet, nil
+	}
+
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, fmt.Errorf("illegal ip %s", text)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parsePortRanges(text string) ([]portRange, error) {
+	portRanges := make([]portRange, 0)
+	for _, part := range strings.Split(text, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("illegal port %s", part)
+		}
+		to := from
+		if len(bounds) == 2 {
+			to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("illegal port %s", part)
+			}
+		}
+		if from > to {
+			return nil, fmt.Errorf("illegal port range %s", part)
+		}
+		portRanges = append(portRanges, portRange{uint16(from), uint16(to)})
+	}
+	return portRanges, nil
+}
+
+func toSet(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		set[item] = true
+	}
+	return set
+}
@@ -0,0 +1,165 @@
+package router
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"masker/network"
+)
+
+// what router needs to know about a connection
+type Context interface {
+	Destination() network.Destination
+	InboundTag() string
+	User() string   // empty if the connection is not authenticated
+	Source() net.IP // ip of the client, nil if unknown
+}
+
+type Router struct {
+	rules           []*rule
+	defaultOutbound string
+}
+
+func NewRouter(config Config, defaultOutbound string) (*Router, error) {
+	router := &Router{
+		rules:           make([]*rule, 0, len(config.Rules)),
+		defaultOutbound: defaultOutbound,
+	}
+	if config.DefaultOutbound != "" {
+		router.defaultOutbound = config.DefaultOutbound
+	}
+
+	for _, ruleConfig := range config.Rules {
+		r, err := ruleConfig.toRule()
+		if err != nil {
+			return nil, err
+		}
+		router.rules = append(router.rules, r)
+	}
+	return router, nil
+}
+
+// tags of all outbounds that rules may pick
+func (router *Router) Outbounds() []string {
+	outbounds := []string{router.defaultOutbound}
+	for _, r := range router.rules {
+		outbounds = append(outbounds, r.outbound)
+	}
+	return outbounds
+}
+
+// rules are checked in order, the first matching one decides the outbound
+func (router *Router) PickOutbound(ctx Context) string {
+	for _, r := range router.rules {
+		if r.match(ctx) {
+			return r.outbound
+		}
+	}
+	return router.defaultOutbound
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type rule struct {
+	domains        []string
+	domainSuffixes []string
+	keywords       []string
+	regexes        []*regexp.Regexp
+	ipNets         []*net.IPNet
+	portRanges     []portRange
+	sourceNets     []*net.IPNet
+	inbounds       map[string]bool
+	users          map[string]bool
+	outbound       string
+}
+
+func (r *rule) hasDestinationCondition() bool {
+	return len(r.domains) > 0 || len(r.domainSuffixes) > 0 || len(r.keywords) > 0 ||
+		len(r.regexes) > 0 || len(r.ipNets) > 0
+}
+
+func (r *rule) match(ctx Context) bool {
+	dest := ctx.Destination()
+
+	if r.hasDestinationCondition() && !r.matchDestination(dest) {
+		return false
+	}
+	if len(r.portRanges) > 0 && !r.matchPort(dest.Port()) {
+		return false
+	}
+	if len(r.sourceNets) > 0 && !r.matchSource(ctx.Source()) {
+		return false
+	}
+	if r.inbounds != nil && !r.inbounds[ctx.InboundTag()] {
+		return false
+	}
+	if r.users != nil && !r.users[ctx.User()] {
+		return false
+	}
+	return true
+}
+
+// domain conditions only match domain destinations and ip conditions only match ip destinations
+// domains are never resolved by router
+func (r *rule) matchDestination(dest network.Destination) bool {
+	if dest.IsDomain() {
+		return r.matchDomain(strings.ToLower(dest.Domain()))
+	}
+
+	ip := dest.IP()
+	for _, ipNet := range r.ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchDomain(domain string) bool {
+	for _, target := range r.domains {
+		if domain == target {
+			return true
+		}
+	}
+	for _, suffix := range r.domainSuffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range r.keywords {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, re := range r.regexes {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchPort(port uint16) bool {
+	for _, portRange := range r.portRanges {
+		if portRange.from <= port && port <= portRange.to {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchSource(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range r.sourceNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
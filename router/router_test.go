@@ -0,0 +1,112 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"masker/network"
+)
+
+type testContext struct {
+	dest       network.Destination
+	inboundTag string
+	user       string
+	source     net.IP
+}
+
+func (ctx testContext) Destination() network.Destination {
+	return ctx.dest
+}
+
+func (ctx testContext) InboundTag() string {
+	return ctx.inboundTag
+}
+
+func (ctx testContext) User() string {
+	return ctx.user
+}
+
+func (ctx testContext) Source() net.IP {
+	return ctx.source
+}
+
+func domainContext(domain string, port uint16) testContext {
+	return testContext{dest: network.NewTCPDestination(network.NewDomainAddress(domain, port))}
+}
+
+func ipContext(ip string, port uint16) testContext {
+	addr, err := network.NewIPv4Address(net.ParseIP(ip), port)
+	if err != nil {
+		addr, _ = network.NewIPv6Address(net.ParseIP(ip), port)
+	}
+	return testContext{dest: network.NewTCPDestination(addr)}
+}
+
+func TestPickOutbound(t *testing.T) {
+	config := Config{
+		Rules: []RuleConfig{
+			{Domain: []string{"exact.com"}, Outbound: "exact"},
+			{DomainSuffix: []string{"cn"}, IP: []string{"10.0.0.0/8", "192.168.1.1"}, Outbound: "direct"},
+			{Keyword: []string{"google"}, Outbound: "keyword"},
+			{Regex: []string{`^ads\d+\.`}, Outbound: "regex"},
+			{Port: "25,6000-6100", Outbound: "port"},
+			{Inbound: []string{"lan-in"}, User: []string{"alice"}, Outbound: "alice"},
+			{Source: []string{"172.16.0.0/12"}, Outbound: "source"},
+		},
+	}
+	router, err := NewRouter(config, "proxy")
+	if err != nil {
+		t.Fatalf("Err in creating router: %v", err)
+	}
+
+	testCases := []struct {
+		ctx      testContext
+		outbound string
+	}{
+		{domainContext("exact.com", 443), "exact"},
+		{domainContext("www.exact.com", 443), "proxy"},
+		{domainContext("www.baidu.CN", 443), "direct"},
+		{domainContext("cn", 443), "direct"},
+		{domainContext("notcn", 443), "proxy"},
+		{ipContext("10.1.2.3", 443), "direct"},
+		{ipContext("192.168.1.1", 443), "direct"},
+		{ipContext("192.168.1.2", 443), "proxy"},
+		{domainContext("mail.google.com", 443), "keyword"},
+		{domainContext("ads12.example.com", 443), "regex"},
+		{domainContext("example.com", 25), "port"},
+		{domainContext("example.com", 6050), "port"},
+		{ipContext("2001:db8::68", 6101), "proxy"},
+		{testContext{dest: domainContext("example.com", 80).dest, inboundTag: "lan-in", user: "alice"}, "alice"},
+		{testContext{dest: domainContext("example.com", 80).dest, inboundTag: "lan-in", user: "bob"}, "proxy"},
+		{testContext{dest: domainContext("example.com", 80).dest, inboundTag: "wan-in", user: "alice"}, "proxy"},
+		{testContext{dest: domainContext("example.com", 80).dest, source: net.ParseIP("172.16.5.5")}, "source"},
+		{testContext{dest: domainContext("example.com", 80).dest, source: net.ParseIP("172.32.5.5")}, "proxy"},
+		{domainContext("example.com", 80), "proxy"},
+	}
+
+	for _, testCase := range testCases {
+		outbound := router.PickOutbound(testCase.ctx)
+		if outbound != testCase.outbound {
+			t.Errorf("Err in routing %s (inbound %q, user %q), want %s but get %s",
+				testCase.ctx.dest.String(), testCase.ctx.inboundTag, testCase.ctx.user, testCase.outbound, outbound)
+		}
+	}
+}
+
+func TestIllegalRule(t *testing.T) {
+	illegalRules := []RuleConfig{
+		{Domain: []string{"example.com"}},
+		{IP: []string{"10.0.0.0/33"}, Outbound: "direct"},
+		{Source: []string{"localhost"}, Outbound: "direct"},
+		{IP: []string{"not an ip"}, Outbound: "direct"},
+		{Port: "80-20", Outbound: "direct"},
+		{Port: "70000", Outbound: "direct"},
+		{Regex: []string{"("}, Outbound: "direct"},
+	}
+
+	for _, illegalRule := range illegalRules {
+		if _, err := NewRouter(Config{Rules: []RuleConfig{illegalRule}}, "proxy"); err == nil {
+			t.Errorf("illegal rule %+v, but is accepted by mistake", illegalRule)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package local
 
 import (
+	"encoding/binary"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -26,31 +31,54 @@ var (
 	response = []byte("1 + 1 = 2")
 )
 
-func TestRunningLocally(t *testing.T) {
-	log.SetCurLogLevel(log.InfoLevel)
-
-	// init client node and server node
-	go startNode(t, "server_a_config.json")
-	go startNode(t, "server_b_config.json")
-	go startNode(t, "client_config.json")
-	time.Sleep(10e9)
+var (
+	nodesOnce sync.Once
+	nodesErr  error
+)
 
-	// init target server
-	go startServer(t)
-	time.Sleep(2e9)
+// init client node and server node, shared by all tests
+func setUpNodes(t *testing.T) {
+	nodesOnce.Do(func() {
+		log.SetCurLogLevel(log.InfoLevel)
+		for _, configFile := range []string{"server_a_config.json", "server_b_config.json", "client_config.json"} {
+			if err := startNode(configFile); err != nil {
+				nodesErr = fmt.Errorf("Err in starting node with %s: %v.", configFile, err)
+				return
+			}
+		}
+		time.Sleep(1e9) // user hashes are ready once nodes start, no need to wait for them
+	})
+	if nodesErr != nil {
+		t.Fatal(nodesErr)
+	}
+}
 
-	// create a local socks5 proxy client
-	// first, get client node's listening port
+// address of socks5 listener on client node
+func socks5Address(t *testing.T) string {
 	config, err := core.LoadConfig("client_config.json")
 	if err != nil {
 		t.Fatalf("Err in loading config: %v.", err)
 	}
+	return "127.0.0.1:" + strconv.Itoa(int(config.Inbounds[0].Port))
+}
 
-	// then create the socks5 client
-	socks5Client, err := proxy.SOCKS5("tcp", "127.0.0.1:"+strconv.Itoa(int(config.Port)), nil, proxy.Direct)
+// create a local socks5 proxy client
+func newSocks5Client(t *testing.T) proxy.Dialer {
+	socks5Client, err := proxy.SOCKS5("tcp", socks5Address(t), nil, proxy.Direct)
 	if err != nil {
 		t.Fatalf("Err in creating socks5 client: %v.", err)
 	}
+	return socks5Client
+}
+
+func TestRunningLocally(t *testing.T) {
+	setUpNodes(t)
+
+	// init target server
+	go startServer(t)
+	time.Sleep(2e9)
+
+	socks5Client := newSocks5Client(t)
 
 	// finally dial the target server
 	// send the request and receive the response
@@ -83,6 +111,131 @@ func TestRunningLocally(t *testing.T) {
 	conn.Close()
 }
 
+// the failure of dialing on server node comes back to socks5 client as reply code
+func TestDialRefused(t *testing.T) {
+	setUpNodes(t)
+
+	// reserve a port then release it, nobody is listening on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in reserving a port: %v", err)
+	}
+	closedAddress := ln.Addr().String()
+	ln.Close()
+
+	_, err = newSocks5Client(t).Dial("tcp", closedAddress)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Socks5 client: want connection refused when dialing %s but get %v", closedAddress, err)
+	}
+}
+
+// client shuts its write side, then waits for the response
+func TestHalfClose(t *testing.T) {
+	setUpNodes(t)
+
+	// target server answers after reading the whole request
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in creating the target server: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		data, err := io.ReadAll(conn)
+		if err != nil || !cmp.Equal(data, request) {
+			t.Errorf("Target server: want request %s but get %s, err: %v", string(request), string(data), err)
+			return
+		}
+		conn.Write(response)
+	}()
+
+	conn, err := newSocks5Client(t).Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Socks5 client: err in dialing the target server: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(request)
+	if err = conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Socks5 client: err in closing write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil || !cmp.Equal(data, response) {
+		t.Errorf("Socks5 client: want response %s but get %s, err: %v", string(response), string(data), err)
+	}
+}
+
+// datagrams go through socks5 udp association, mask caller, mask listener and identical caller to an echo server
+func TestUDPAssociate(t *testing.T) {
+	setUpNodes(t)
+
+	echoServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Err in creating the echo server: %v", err)
+	}
+	defer echoServer.Close()
+	go func() {
+		buffer := make([]byte, 512)
+		for {
+			nBytes, addr, err := echoServer.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echoServer.WriteTo(buffer[:nBytes], addr)
+		}
+	}()
+
+	// no auth, then UDP ASSOCIATE without the address of client
+	control, err := net.Dial("tcp", socks5Address(t))
+	if err != nil {
+		t.Fatalf("Socks5 client: err in dialing: %v", err)
+	}
+	defer control.Close()
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reply := make([]byte, 10)
+	control.Write([]byte{0x05, 0x01, 0x00})
+	if _, err = io.ReadFull(control, reply[:2]); err != nil || reply[1] != 0x00 {
+		t.Fatalf("Socks5 client: want no auth but get %v, err: %v", reply[:2], err)
+	}
+	control.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if _, err = io.ReadFull(control, reply); err != nil || reply[1] != 0x00 || reply[3] != 0x01 {
+		t.Fatalf("Socks5 client: want udp association on ipv4 but get %v, err: %v", reply, err)
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:]))}
+
+	conn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("Socks5 client: err in dialing udp relay %v: %v", relayAddr, err)
+	}
+	defer conn.Close()
+
+	// the reply comes with the address of echo server, same as the header sent
+	echoAddr := echoServer.LocalAddr().(*net.UDPAddr)
+	header := []byte{0, 0, 0, 0x01, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(header[8:], uint16(echoAddr.Port))
+	datagram := append(header, request...)
+
+	buffer := make([]byte, 512)
+	for i := 0; i < 5; i++ {
+		if _, err = conn.Write(datagram); err != nil {
+			t.Fatalf("Socks5 client: err in sending datagram: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		nBytes, err := conn.Read(buffer)
+		if err != nil || !cmp.Equal(buffer[:nBytes], datagram) {
+			t.Fatalf("Socks5 client: want datagram %v but get %v, err: %v", datagram, buffer[:nBytes], err)
+		}
+	}
+}
+
 func startServer(t *testing.T) {
 	// init server
 	var ln net.Listener
@@ -103,7 +256,7 @@ func startServer(t *testing.T) {
 		ln.Close()
 
 		if i == tryTimes {
-			t.Fatalf("Can not create the target server")
+			t.Errorf("Can not create the target server")
 			return
 		}
 	}
@@ -134,19 +287,16 @@ func startServer(t *testing.T) {
 	ln.Close()
 }
 
-func startNode(t *testing.T, configFile string) {
+func startNode(configFile string) error {
 	config, err := core.LoadConfig(configFile)
 	if err != nil {
-		t.Fatalf("Err in loading config: %v.", err)
+		return err
 	}
 
 	node, err := core.NewNode(config)
 	if err != nil {
-		t.Fatalf("Err in creating a new node: %v.", err)
+		return err
 	}
 
-	err = node.Start()
-	if err != nil {
-		t.Fatalf("Err in starting node: %v.", err)
-	}
+	return node.Start()
 }
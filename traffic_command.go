@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"masker/account"
+)
+
+const trafficUsage = `Usage: masker traffic show|reset [-state_file file] [-user user]...
+
+  show   print traffic of users in state file
+  reset  clear traffic of the given users, or of all users if none is given
+         a running node keeps counting from zero after its next flush
+`
+
+type userList []string
+
+func (users *userList) String() string {
+	return fmt.Sprint(*users)
+}
+
+func (users *userList) Set(user string) error {
+	*users = append(*users, user)
+	return nil
+}
+
+// read or reset traffic kept by nodes, return exit code
+func runTrafficCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, trafficUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("traffic", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, trafficUsage)
+		flags.PrintDefaults()
+	}
+	stateFile := flags.String("state_file", "traffic.json", "Traffic state file, the same as state_file in node config.")
+	var users userList
+	flags.Var(&users, "user", "User to show or reset, may be repeated.")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	switch args[0] {
+	case "show":
+		return showTraffic(*stateFile, users)
+	case "reset":
+		if err := account.ResetTraffic(*stateFile, users...); err != nil {
+			fmt.Fprintf(os.Stderr, "Err in resetting traffic: %v\n", err)
+			return 1
+		}
+		return 0
+	default:
+		flags.Usage()
+		return 2
+	}
+}
+
+func showTraffic(stateFile string, users []string) int {
+	traffic, err := account.ReadTraffic(stateFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Err in reading traffic: %v\n", err)
+		return 1
+	}
+	if len(users) == 0 {
+		users = account.SortedTrafficUsers(traffic)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "USER\tUPLINK\tDOWNLINK")
+	for _, user := range users {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", user, traffic[user].Uplink, traffic[user].Downlink)
+	}
+	writer.Flush()
+	return 0
+}